@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// config is a file declaring mounts, such as
+//
+//	mounts:
+//	  - name: backups
+//	    source: sdfss://backup-01:6442
+//	    mountpoint: /mnt/backups
+//	    user: admin
+//	    password_file: /etc/sdfs/backups.password
+//	    volume_id: 3
+//	    tls:
+//	      mtls: true
+//	      ca: /etc/sdfs/keys/ca.crt
+//	    cache:
+//	      attr_ttl: 5s
+//	      block_dir: /var/cache/sdfs
+//	    timeouts:
+//	      data: 5m
+//	    fuse:
+//	      attr_timeout: 30s
+//	    options: [ro, noexec]
+//
+// in YAML, or the same in TOML with a [[mounts]] table for each mount.
+// Files ending in .toml are read as TOML, all others as YAML.
+type config struct {
+	Mounts []map[string]interface{} `yaml:"mounts" toml:"mounts"`
+}
+
+// configKeys are the flags the settings of a mount stand for. name,
+// source, mountpoint, password_file and options are handled apart.
+var configKeys = map[string]string{
+	"user":                      "u",
+	"volume_id":                 "volumeID",
+	"dedupe":                    "dedupe",
+	"dedupe_buffers":            "dedupe-buffers",
+	"dedupe_threads":            "dedupe-threads",
+	"nocompress":                "nocompress",
+	"trust_all":                 "trust-all",
+	"debug":                     "debug",
+	"log_path":                  "log-path",
+	"metrics_listen":            "metrics-listen",
+	"admin_socket":              "admin-socket",
+	"trace":                     "trace",
+	"tls.mtls":                  "mtls",
+	"tls.ca":                    "root-ca",
+	"tls.key":                   "mtls-key",
+	"tls.cert":                  "mtls-cert",
+	"tls.trust_cert":            "trust-cert",
+	"cache.attr_ttl":            "attr-cache-ttl",
+	"cache.negative_ttl":        "negative-cache-ttl",
+	"cache.dir_page_size":       "dir-page-size",
+	"cache.write_buffer_size":   "write-buffer-size",
+	"cache.write_buffer_memory": "write-buffer-memory",
+	"cache.read_ahead_size":     "read-ahead-size",
+	"cache.read_ahead_parallel": "read-ahead-parallel",
+	"cache.block_dir":           "block-cache-dir",
+	"cache.block_size":          "block-cache-size",
+	"cache.dedupe_size":         "dedupe-cache-size",
+	"cache.dedupe_age":          "dedupe-cache-age",
+	"timeouts.reconnect":        "reconnect-timeout",
+	"timeouts.metadata":         "metadata-timeout",
+	"timeouts.data":             "data-timeout",
+	"timeouts.fsync":            "fsync-timeout",
+	"fuse.attr_timeout":         "attr-timeout",
+	"fuse.entry_timeout":        "entry-timeout",
+}
+
+func loadConfig(path string) (*config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &config{}
+	if filepath.Ext(path) == ".toml" {
+		md, err := toml.Decode(string(b), c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		// Sections of mounts count as undecoded although they are kept.
+		for _, key := range md.Undecoded() {
+			if key[0] != "mounts" {
+				return nil, fmt.Errorf("%s: unknown setting %s", path, key)
+			}
+		}
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if len(c.Mounts) == 0 {
+		return nil, fmt.Errorf("%s declares no mounts", path)
+	}
+	return c, nil
+}
+
+// mountName returns the name of mount m, its mount point unless it has
+// one.
+func mountName(m map[string]interface{}) string {
+	if name, ok := m["name"].(string); ok && name != "" {
+		return name
+	}
+	mp, _ := m["mountpoint"].(string)
+	return mp
+}
+
+// sameMountPoint reports whether the mount point a is b.
+func sameMountPoint(a, b string) bool {
+	a, errA := filepath.Abs(a)
+	b, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && a == b
+}
+
+// applyConfig sets the settings of the mount chosen from the config file,
+// except those in set, the flags and mount options given explicitly. The
+// mount is the one on the mount point given, else the one selector names
+// by name or mount point, else the only one declared. When the file
+// declares several and none is chosen, mountAll gets their names.
+func (o *options) applyConfig(f *flag.FlagSet, set map[string]bool, selector string) error {
+	c, err := loadConfig(o.configPath)
+	if err != nil {
+		return err
+	}
+	names := map[string]bool{}
+	for _, m := range c.Mounts {
+		name := mountName(m)
+		if name == "" {
+			return fmt.Errorf("%s: a mount has neither name nor mountpoint", o.configPath)
+		}
+		if names[name] {
+			return fmt.Errorf("%s: %s is declared twice", o.configPath, name)
+		}
+		names[name] = true
+	}
+
+	var chosen map[string]interface{}
+	switch {
+	case o.connection.MountPath != "":
+		for _, m := range c.Mounts {
+			if mp, _ := m["mountpoint"].(string); sameMountPoint(mp, o.connection.MountPath) {
+				chosen = m
+			}
+		}
+		if chosen == nil {
+			return fmt.Errorf("%s declares no mount on %s", o.configPath, o.connection.MountPath)
+		}
+	case selector != "":
+		for _, m := range c.Mounts {
+			if mp, _ := m["mountpoint"].(string); mountName(m) == selector || sameMountPoint(mp, selector) {
+				chosen = m
+			}
+		}
+		if chosen == nil {
+			return fmt.Errorf("%s declares no mount %s", o.configPath, selector)
+		}
+	case len(c.Mounts) == 1:
+		chosen = c.Mounts[0]
+	default:
+		if o.standalone {
+			return errors.New("-s mounts a single volume, choose one by name or mountpoint")
+		}
+		for _, m := range c.Mounts {
+			o.mountAll = append(o.mountAll, mountName(m))
+		}
+		return nil
+	}
+	if err := o.applyMount(f, set, chosen); err != nil {
+		return fmt.Errorf("%s: mount %s: %v", o.configPath, mountName(chosen), err)
+	}
+	return nil
+}
+
+// flattenConfig adds the settings of m to out, those of sections by the
+// name of the section, a dot and their own.
+func flattenConfig(prefix string, m map[string]interface{}, out map[string]interface{}) {
+	for k, v := range m {
+		if section, ok := v.(map[string]interface{}); ok {
+			flattenConfig(prefix+k+".", section, out)
+			continue
+		}
+		out[prefix+k] = v
+	}
+}
+
+func (o *options) applyMount(f *flag.FlagSet, set map[string]bool, m map[string]interface{}) error {
+	settings := map[string]interface{}{}
+	flattenConfig("", m, settings)
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	applied := map[string]bool{}
+	var mountOptions []string
+	for _, k := range keys {
+		v := settings[k]
+		switch k {
+		case "name":
+		case "source":
+			if o.source == "" {
+				o.source = fmt.Sprint(v)
+			}
+		case "mountpoint":
+			if o.connection.MountPath == "" {
+				o.connection.MountPath = fmt.Sprint(v)
+			}
+		case "password_file":
+			if set["p"] {
+				continue
+			}
+			name := fmt.Sprint(v)
+			fi, err := os.Stat(name)
+			if err != nil {
+				return err
+			}
+			// Like ssh with private keys, a password others may read is
+			// refused rather than used.
+			if perm := fi.Mode().Perm(); perm&^0600 != 0 {
+				return fmt.Errorf("password_file: %s has mode %o, it may only be readable by its owner", name, perm)
+			}
+			b, err := ioutil.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			if err := f.Set("p", strings.TrimRight(string(b), "\r\n")); err != nil {
+				return fmt.Errorf("password_file: %v", err)
+			}
+			applied["p"] = true
+		case "options":
+			switch opts := v.(type) {
+			case string:
+				mountOptions = strings.Split(opts, ",")
+			case []interface{}:
+				for _, opt := range opts {
+					mountOptions = append(mountOptions, fmt.Sprint(opt))
+				}
+			default:
+				return fmt.Errorf("options: expected a list, not %v", v)
+			}
+		default:
+			name, ok := configKeys[k]
+			if !ok {
+				return fmt.Errorf("unknown setting %s", k)
+			}
+			if set[name] {
+				continue
+			}
+			if err := f.Set(name, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("%s: %v", k, err)
+			}
+			applied[name] = true
+		}
+	}
+	for name := range applied {
+		set[name] = true
+	}
+
+	// Mount options of the file come before those given with -o, which
+	// the kernel lets win.
+	set["config"] = true
+	given := o.kernelOptions
+	o.kernelOptions = nil
+	applied = map[string]bool{}
+	for _, opt := range mountOptions {
+		if err := o.setMountOption(f, set, applied, opt); err != nil {
+			return err
+		}
+	}
+	o.kernelOptions = append(o.kernelOptions, given...)
+	return nil
+}
+
+// mountAll mounts each of the mounts named by running mount.sdfs again
+// for it, with the same flags. It returns the code to exit with.
+func mountAll(names []string) int {
+	self, err := os.Executable()
+	if err != nil {
+		log.Errorf("Unable to find mount.sdfs: %v\n", err)
+		return 1
+	}
+	code := 0
+	for _, name := range names {
+		args := append(append([]string{}, os.Args[1:]...), name)
+		cmd := exec.Command(self, args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Errorf("Unable to mount %s: %v\n", name, err)
+			code = 1
+		}
+	}
+	return code
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// configDir returns a new directory with a password file and the files
+// given by name and content. The caller removes it.
+func configDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "sdfs-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["backups.password"] = "s3cret\n"
+	files["ca.crt"] = ""
+	for name, content := range files {
+		content = strings.Replace(content, "DIR", dir, -1)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+const yamlConfig = `
+mounts:
+  - name: backups
+    source: sdfss://backup-01:6442
+    mountpoint: /mnt/backups
+    user: backup
+    password_file: DIR/backups.password
+    volume_id: 3
+    dedupe: true
+    tls:
+      mtls: true
+      ca: DIR/ca.crt
+    cache:
+      attr_ttl: 5s
+      dedupe_size: 5000
+    timeouts:
+      data: 5m
+    fuse:
+      attr_timeout: 30s
+    options: [ro, noexec, uid=1000]
+  - mountpoint: /mnt/scratch
+    source: scratch
+`
+
+const tomlConfig = `
+[[mounts]]
+name = "backups"
+source = "sdfss://backup-01:6442"
+mountpoint = "/mnt/backups"
+user = "backup"
+password_file = "DIR/backups.password"
+volume_id = 3
+dedupe = true
+options = "ro,noexec,uid=1000"
+
+[mounts.tls]
+mtls = true
+ca = "DIR/ca.crt"
+
+[mounts.cache]
+attr_ttl = "5s"
+dedupe_size = 5000
+
+[mounts.timeouts]
+data = "5m"
+
+[mounts.fuse]
+attr_timeout = "30s"
+
+[[mounts]]
+mountpoint = "/mnt/scratch"
+source = "scratch"
+`
+
+func checkBackups(t *testing.T, o *options, dir string) {
+	t.Helper()
+	c := o.connection
+	if o.source != "sdfss://backup-01:6442" || c.MountPath != "/mnt/backups" {
+		t.Errorf("source %q and mountpoint %q", o.source, c.MountPath)
+	}
+	if c.User != "backup" || c.Pwd != "s3cret" || c.Volumeid != 3 || !c.Dedupe || c.Cachsize != 5000 {
+		t.Errorf("volume settings not applied: %+v", c)
+	}
+	if !o.mtls || o.mtlsCA != filepath.Join(dir, "ca.crt") {
+		t.Errorf("mtls %v with %q", o.mtls, o.mtlsCA)
+	}
+	if c.AttrCacheTTL != 5*time.Second || c.DataTimeout != 5*time.Minute || o.attrTimeout != 30*time.Second {
+		t.Errorf("attr-cache-ttl %v, data-timeout %v, attr-timeout %v", c.AttrCacheTTL, c.DataTimeout, o.attrTimeout)
+	}
+	if want := []string{"ro", "noexec"}; !reflect.DeepEqual(o.kernelOptions, want) || c.UID == nil || *c.UID != 1000 {
+		t.Errorf("kernel options %q and uid %v, want %q and 1000", o.kernelOptions, c.UID, want)
+	}
+}
+
+func TestConfigFormats(t *testing.T) {
+	dir := configDir(t, map[string]string{"mounts.yaml": yamlConfig, "mounts.toml": tomlConfig})
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"mounts.yaml", "mounts.toml"} {
+		cfg := filepath.Join(dir, name)
+		checkBackups(t, parse(t, "-config", cfg, "backups"), dir)
+		checkBackups(t, parse(t, "-config", cfg, "/mnt/backups/"), dir)
+		if o := parse(t, "-config", cfg, "/mnt/scratch"); o.source != "scratch" || o.connection.User != "Admin" {
+			t.Errorf("%s: scratch mount has source %q and user %q", name, o.source, o.connection.User)
+		}
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	dir := configDir(t, map[string]string{"mounts.yaml": yamlConfig})
+	defer os.RemoveAll(dir)
+	cfg := filepath.Join(dir, "mounts.yaml")
+
+	o := parse(t, "-u", "operator", "-p", "given", "-config", cfg, "-o", "volumeID=9,rw,uid=0", "backups")
+	if o.connection.User != "operator" || o.connection.Pwd != "given" {
+		t.Errorf("user %q and password %q, want the flags over the file", o.connection.User, o.connection.Pwd)
+	}
+	if o.connection.Volumeid != 9 || *o.connection.UID != 0 {
+		t.Errorf("volume %d and uid %d, want the mount options over the file", o.connection.Volumeid, *o.connection.UID)
+	}
+	if want := []string{"ro", "noexec", "rw"}; !reflect.DeepEqual(o.kernelOptions, want) {
+		t.Errorf("kernel options %q, want %q with -o last", o.kernelOptions, want)
+	}
+	if !o.connection.Dedupe || o.connection.AttrCacheTTL != 5*time.Second {
+		t.Errorf("settings of the file not given otherwise are missing: %+v", o.connection)
+	}
+
+	// As mount(8) calls it from fstab, the mount is the one on the mount
+	// point and the source given wins.
+	o = parse(t, "sdfs://other:6442", "/mnt/backups", "-o", "config="+cfg+",_netdev")
+	if o.source != "sdfs://other:6442" || o.connection.User != "backup" || o.connection.Volumeid != 3 {
+		t.Errorf("source %q, user %q and volume %d, want the source given and the rest from the file",
+			o.source, o.connection.User, o.connection.Volumeid)
+	}
+}
+
+func TestConfigMountAll(t *testing.T) {
+	dir := configDir(t, map[string]string{
+		"mounts.yaml": yamlConfig,
+		"single.toml": "[[mounts]]\nsource = \"pool\"\nmountpoint = \"/mnt/pool\"\n",
+	})
+	defer os.RemoveAll(dir)
+
+	o := parse(t, "-config", filepath.Join(dir, "mounts.yaml"))
+	if want := []string{"backups", "/mnt/scratch"}; !reflect.DeepEqual(o.mountAll, want) {
+		t.Errorf("mounting %q, want %q", o.mountAll, want)
+	}
+	if _, err := parseOptions("mount.sdfs", []string{"-s", "-config", filepath.Join(dir, "mounts.yaml")}, ioutil.Discard); err == nil {
+		t.Errorf("-s with several mounts was accepted")
+	}
+	o = parse(t, "-config", filepath.Join(dir, "single.toml"))
+	if o.mountAll != nil || o.source != "pool" || o.connection.MountPath != "/mnt/pool" {
+		t.Errorf("single mount gave %q on %q, mounting %q", o.source, o.connection.MountPath, o.mountAll)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	dir := configDir(t, map[string]string{
+		"mounts.yaml":    yamlConfig,
+		"typo.yaml":      "mounts:\n  - source: pool\n    mountpoint: /mnt/pool\n    tls:\n      cafile: /x\n",
+		"toplevel.yaml":  "mount:\n  - source: pool\n",
+		"toplevel.toml":  "[[mount]]\nsource = \"pool\"\n",
+		"twice.yaml":     "mounts:\n  - mountpoint: /mnt/a\n  - mountpoint: /mnt/a\n",
+		"empty.yaml":     "mounts: []\n",
+		"badvalue.toml":  "[[mounts]]\nsource = \"pool\"\nmountpoint = \"/mnt/pool\"\nvolume_id = \"three\"\n",
+		"badoption.yaml": "mounts:\n  - source: pool\n    mountpoint: /mnt/pool\n    options: [bogus]\n",
+		"loose.yaml":     "mounts:\n  - source: pool\n    mountpoint: /mnt/pool\n    password_file: DIR/loose.password\n",
+		"loose.password": "s3cret\n",
+	})
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(filepath.Join(dir, "loose.password"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-config", "typo.yaml"}, "unknown setting tls.cafile"},
+		{[]string{"-config", "toplevel.yaml"}, "field mount not found"},
+		{[]string{"-config", "toplevel.toml"}, "unknown setting mount"},
+		{[]string{"-config", "twice.yaml"}, "declared twice"},
+		{[]string{"-config", "empty.yaml"}, "declares no mounts"},
+		{[]string{"-config", "badvalue.toml"}, "volume_id"},
+		{[]string{"-config", "badoption.yaml"}, "unknown mount option bogus"},
+		{[]string{"-config", "loose.yaml"}, "has mode 644"},
+		{[]string{"-config", "mounts.yaml", "archive"}, "declares no mount archive"},
+		{[]string{"-config", "mounts.yaml", "pool", "/mnt/other"}, "declares no mount on /mnt/other"},
+		{[]string{"-config", "missing.yaml", "backups"}, "missing.yaml"},
+	} {
+		tc.args[1] = filepath.Join(dir, tc.args[1])
+		_, err := parseOptions("mount.sdfs", tc.args, ioutil.Discard)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("parseOptions(%q) = %v, want an error about %s", tc.args, err, tc.want)
+		}
+	}
+}
@@ -24,7 +24,6 @@ import (
 	"strings"
 	"sync"
 	"syscall"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -54,6 +53,20 @@ type Sdfscli struct {
 
 var connectionInfo sdfs.ConnectionInfo
 
+// nofail is set by the mount option of that name.
+var nofail bool
+
+// exit ends mount.sdfs with code. A mount made with nofail reports its
+// failure but exits with success, so that mount -a and the boot go on
+// without the volume.
+func exit(code int) {
+	if code != 0 && nofail {
+		log.Warnf("Mount of %s failed, ignored as it is nofail", connectionInfo.MountPath)
+		code = 0
+	}
+	os.Exit(code)
+}
+
 func writeMemProfile(fn string, sigs <-chan os.Signal) {
 	i := 0
 	for range sigs {
@@ -76,63 +89,34 @@ func writeMemProfile(fn string, sigs <-chan os.Signal) {
 func main() {
 	olog.SetFlags(olog.Lmicroseconds)
 	// Scans the arg list and sets up flags
-	pwd := flag.String("p", "Password", "The Password to authenticate to the remote Volume")
-	user := flag.String("u", "Admin", "The Username to authenticate to the remote Volume")
-	mtls := flag.Bool("mtls", false, "Use Mutual TLS. This will use the certs located in $HOME/.sdfs/keys/[client.crt,client.key,ca.crt]"+
-		"unless otherwise specified")
-	mtlsca := flag.String("root-ca", "", "The path the CA cert used to sign the MTLS Cert. This defaults to $HOME/.sdfs/keys/ca.crt")
-	mtlskey := flag.String("mtls-key", "", "The path the private used for mutual TLS. This defaults to $HOME/.sdfs/keys/client.key")
-	mtlscert := flag.String("mtls-cert", "", "The path the client cert used for mutual TLS. This defaults to $HOME/.sdfs/keys/client.crt")
-	dedupe := flag.Bool("dedupe", false, "Enable Client Side Dedupe")
-	debug := flag.Bool("debug", false, "print debugging messages.")
-	quiet := flag.Bool("q", false, "quiet")
-	standalone := flag.Bool("s", false, "do not daemonize mount")
-	disableTrust := flag.Bool("trust-all", false, "Trust Self Signed TLS Certs")
-	version := flag.Bool("version", false, "The Version of this build")
-	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to this file")
-	memprofile := flag.String("memprofile", "", "write memory profile to this file")
-	trustCert := flag.Bool("trust-cert", false, "Trust the certificate for url specified. This will download and store the certificate in $HOME/.sdfs/keys")
-	buffers := flag.Int("dedupe-buffers", 4, "number of local cache buffers for dedupe")
-	threads := flag.Int("dedupe-threads", 4, "number of threads used for dedupe")
-	logPath := flag.String("log-path", "/var/log/sdfs/", "Base Path for logs")
-	cachsize := flag.Int("dedupe-cache-size", 1000000, "Cache size for client size dedupe")
-	cachage := flag.Int("dedupe-cache-age", 30, "Maximum age for local dedupe cache")
-	volumeid := flag.Int64("volumeID", -1, "The volume id to connect to. Required for access through proxy")
-	nocompress := flag.Bool("nocompress", false, "Compress api traffic")
-
-	connectionInfo = sdfs.ConnectionInfo{
-		Buffers:      *buffers,
-		Threads:      *threads,
-		LogPath:      *logPath,
-		Cachsize:     *cachsize,
-		Cachage:      *cachage,
-		Volumeid:     *volumeid,
-		Nocompress:   *nocompress,
-		Dedupe:       *dedupe,
-		Debug:        *debug,
-		User:         *user,
-		Pwd:          *pwd,
-		DisableTrust: *disableTrust,
+	o, err := parseOptions(os.Args[0], os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		os.Exit(0)
 	}
-
-	flag.Parse()
-	if *version {
+	if err == errUsage {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path.Base(os.Args[0]), err)
+		os.Exit(2)
+	}
+	if o.version {
 		fmt.Printf("Version : %s\n", Version)
 		fmt.Printf("Build Date: %s\n", BuildDate)
 		os.Exit(0)
 	}
-	if flag.NArg() < 2 {
-		fmt.Printf("usage: %s options source mountpoint\n", path.Base(os.Args[0]))
-		fmt.Printf("\noptions:\n")
-		flag.PrintDefaults()
-		os.Exit(2)
+	if o.mountAll != nil {
+		os.Exit(mountAll(o.mountAll))
 	}
+	connectionInfo = o.connection
+	nofail = o.nofail
+	log.StandardLogger().ExitFunc = exit
 
-	if *cpuprofile != "" {
-		if !*quiet {
-			fmt.Printf("Writing cpu profile to %s\n", *cpuprofile)
+	if o.cpuprofile != "" {
+		if !o.quiet {
+			fmt.Printf("Writing cpu profile to %s\n", o.cpuprofile)
 		}
-		f, err := os.Create(*cpuprofile)
+		f, err := os.Create(o.cpuprofile)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(3)
@@ -140,40 +124,34 @@ func main() {
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
 	}
-	if *memprofile != "" {
-		if !*quiet {
+	if o.memprofile != "" {
+		if !o.quiet {
 			log.Printf("send SIGUSR1 to %d to dump memory profile", os.Getpid())
 		}
 		profSig := make(chan os.Signal, 1)
 		signal.Notify(profSig, syscall.SIGUSR1)
-		go writeMemProfile(*memprofile, profSig)
+		go writeMemProfile(o.memprofile, profSig)
 	}
-	if *cpuprofile != "" || *memprofile != "" {
-		if !*quiet {
+	if o.cpuprofile != "" || o.memprofile != "" {
+		if !o.quiet {
 			fmt.Printf("Note: You must unmount gracefully, otherwise the profile file(s) will stay empty!\n")
 		}
 	}
-	if isFlagPassed("root-ca") {
-		spb.MtlsCACert = *mtlsca
+	o.applyTLS()
+	if o.verbose {
+		fmt.Printf("%s: mounting %s on %s with %s\n", path.Base(os.Args[0]), o.source, connectionInfo.MountPath,
+			strings.Join(append([]string{"default_permissions", "allow_other"}, o.kernelOptions...), ","))
 	}
-	if isFlagPassed("mtls-key") {
-		spb.MtlsKey = *mtlskey
-	}
-	if isFlagPassed("mtls-cert") {
-		spb.MtlsCert = *mtlscert
-	}
-	if *mtls {
-		//fmt.Println("Using Mutual TLS")
-		spb.Mtls = *mtls
+	if o.fake {
+		return
 	}
 
-	orig := flag.Arg(0)
-	connectionInfo.MountPath = flag.Arg(1)
+	orig := o.source
 	if !strings.HasPrefix(orig, "sdfss://") && !strings.HasPrefix(orig, "sdfs://") {
 		xmlFilePath := fmt.Sprintf("/etc/sdfs/%s-volume-cfg.xml", orig)
 		if _, err := os.Stat(xmlFilePath); os.IsNotExist(err) {
 			fmt.Printf("File %s does not exist", xmlFilePath)
-			os.Exit(1)
+			exit(1)
 		}
 		basePath := os.Getenv("SDFS_BASE_PATH")
 		if len(basePath) == 0 {
@@ -207,13 +185,13 @@ func main() {
 		if err != nil && !running {
 			fmt.Printf("Error running command %s %s %s %s\n", "startsdfs", "-n", "-v", orig)
 			fmt.Printf("Error : %v\n", err)
-			os.Exit(1)
+			exit(1)
 		}
 		xmlFile, err := os.Open(xmlFilePath)
 		// if we os.Open returns an error then handle it
 		if err != nil {
 			fmt.Printf("Error Reading %s : %v\n", xmlFilePath, err)
-			os.Exit(1)
+			exit(1)
 		}
 
 		byteValue, _ := ioutil.ReadAll(xmlFile)
@@ -221,37 +199,40 @@ func main() {
 		var subsystem Subsystem
 		xml.Unmarshal(byteValue, &subsystem)
 		if subsystem.Sdfscli.Usessl {
-			*disableTrust = true
+			connectionInfo.DisableTrust = true
 			orig = fmt.Sprintf("sdfss://localhost:%s", subsystem.Sdfscli.Port)
 		} else {
 			orig = fmt.Sprintf("sdfs://localhost:%s", subsystem.Sdfscli.Port)
 		}
-		connectionInfo.ServerPath = orig
-
 	}
-	if *trustCert {
+	connectionInfo.ServerPath = orig
+	if o.trustCert {
 		err := spb.AddTrustedCert(orig)
 		if err != nil {
 			log.Fatalf("Unable to download cert from (%s): %v\n", orig, err)
 		}
 	}
-	sdfsRoot, err := sdfs.NewsdfsRoot(orig, connectionInfo)
+	con, err := sdfs.Dial(orig, connectionInfo)
+	if err != nil {
+		log.Fatalf("Dial(%s): %v\n", orig, err)
+	}
+	sdfsRoot, err := sdfs.NewsdfsRoot(con, connectionInfo)
 
 	if err != nil {
 		log.Fatalf("NewsdfsRoot(%s): %v\n", orig, err)
 	}
-	sec := time.Second * 10
 	opts := &fs.Options{
-		// These options are to be compatible with libfuse defaults,
+		// These options default to be compatible with libfuse defaults,
 		// making benchmarking easier.
-		AttrTimeout:  &sec,
-		EntryTimeout: &sec,
+		AttrTimeout:  &o.attrTimeout,
+		EntryTimeout: &o.entryTimeout,
 	}
-	opts.Debug = *debug
+	opts.Debug = connectionInfo.Debug
 	if opts.Debug {
 		sdfs.SetLogLevel(log.DebugLevel)
 	}
 	opts.MountOptions.Options = append(opts.MountOptions.Options, "default_permissions", "allow_other")
+	opts.MountOptions.Options = append(opts.MountOptions.Options, o.kernelOptions...)
 	sigs := make(chan os.Signal)
 
 	// catch all signals since not explicitly listing
@@ -272,18 +253,23 @@ func main() {
 	// Leave file permissions on "000" files as-is
 	opts.NullPermissions = true
 	opts.ExplicitDataCacheControl = true
+	// Forward fcntl and flock locks instead of keeping them in the kernel
+	opts.MountOptions.EnableLocks = true
 	// Enable diagnostics logging
-	if !*quiet {
+	if !o.quiet {
 		opts.Logger = olog.New(os.Stderr, "", 0)
 	}
 
 	_, file := filepath.Split(connectionInfo.MountPath)
+	if o.adminSocket == "" {
+		o.adminSocket = sdfs.AdminSocket(connectionInfo.MountPath)
+	}
 	os.MkdirAll("/var/run/sdfs/", os.ModePerm)
-	os.MkdirAll("/var/log/sdfs/", os.ModePerm)
-	if !*standalone {
+	os.MkdirAll(connectionInfo.LogPath, os.ModePerm)
+	if !o.standalone {
 
 		pidFile := "/var/run/sdfs/mount-" + file + ".pid"
-		logFile := "/var/log/sdfs/mount-" + file + ".log"
+		logFile := filepath.Join(connectionInfo.LogPath, "mount-"+file+".log")
 		mcntxt := &daemon.Context{
 			PidFileName: pidFile,
 			PidFilePerm: 0644,
@@ -298,29 +284,53 @@ func main() {
 		if err != nil {
 			log.Errorf("Unable to run: %v \n", err)
 			AppCleanup()
-			os.Exit(3)
+			exit(3)
 		}
 		if d != nil {
 			return
 		}
 		defer mcntxt.Release()
 		log.Print("Volume Mounting to " + connectionInfo.MountPath)
-		mount(sdfsRoot, opts, *quiet)
+		mount(sdfsRoot, opts, o)
 	} else {
-		mount(sdfsRoot, opts, *quiet)
+		mount(sdfsRoot, opts, o)
 	}
 
 }
 
-func mount(sdfsRoot fs.InodeEmbedder, opts *fs.Options, quiet bool) {
-	server, err := fs.Mount(connectionInfo.MountPath, sdfsRoot, opts)
+func mount(sdfsRoot fs.InodeEmbedder, opts *fs.Options, o *options) {
+	if o.traceTarget != "" {
+		stop, err := startTracing(o.traceTarget)
+		if err != nil {
+			log.Errorf("Unable to trace to %s: %v\n", o.traceTarget, err)
+			AppCleanup()
+			exit(5)
+		}
+		defer stop()
+	}
+	if o.metricsListen != "" {
+		l, err := sdfs.ServeMetrics(sdfsRoot, o.metricsListen)
+		if err != nil {
+			log.Errorf("Unable to serve metrics on %s: %v\n", o.metricsListen, err)
+			AppCleanup()
+			exit(5)
+		}
+		defer l.Close()
+	}
+	server, err := sdfs.Mount(connectionInfo.MountPath, sdfsRoot, opts)
 	if err != nil {
 		log.Errorf("Mount fail: %v\n", err)
 		AppCleanup()
-		os.Exit(5)
+		exit(5)
 	}
-	if !quiet {
-		log.Printf("Mounted %s from %s\n", connectionInfo.MountPath, flag.Arg(0))
+	if !o.quiet {
+		log.Printf("Mounted %s from %s\n", connectionInfo.MountPath, o.source)
+	}
+	admin, err := sdfs.ServeAdmin(sdfsRoot, o.adminSocket, connectionInfo.ServerPath, server.Unmount)
+	if err != nil {
+		log.Errorf("Unable to serve the admin socket %s: %v\n", o.adminSocket, err)
+	} else {
+		defer admin.Close()
 	}
 	server.Wait()
 	if running {
@@ -384,13 +394,3 @@ func copyAndCapture(w io.Writer, r io.Reader) ([]byte, error) {
 		}
 	}
 }
-
-func isFlagPassed(name string) bool {
-	found := false
-	flag.Visit(func(f *flag.Flag) {
-		if f.Name == name {
-			found = true
-		}
-	})
-	return found
-}
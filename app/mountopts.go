@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// kernelOptions are the mount options the kernel applies to a FUSE mount
+// by itself. They are handed to it as they are.
+var kernelOptions = map[string]bool{
+	"ro": true, "rw": true,
+	"suid": true, "nosuid": true,
+	"dev": true, "nodev": true,
+	"exec": true, "noexec": true,
+	"sync": true, "async": true, "dirsync": true,
+	"atime": true, "noatime": true,
+	"diratime": true, "nodiratime": true,
+	"relatime": true, "norelatime": true,
+	"strictatime": true, "nostrictatime": true,
+	"lazytime": true, "nolazytime": true,
+}
+
+// fstabOptions are meant for mount(8) and systemd, which pass them on to
+// helpers all the same. _netdev only orders the mount after the network
+// is up, and every mount is made with allow_other and default_permissions.
+var fstabOptions = map[string]bool{
+	"defaults": true, "auto": true, "noauto": true,
+	"user": true, "nouser": true, "users": true, "owner": true, "group": true,
+	"_netdev": true, "allow_other": true, "default_permissions": true,
+}
+
+// optionFlags are the flags of mount options that read better in fstab
+// under another name. Every other flag can be given by its own name.
+var optionFlags = map[string]string{
+	"user":     "u",
+	"password": "p",
+}
+
+// mountOptionList collects the values of -o.
+type mountOptionList []string
+
+func (l *mountOptionList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *mountOptionList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// newHelperFlagSet returns the flags mount(8) passes to mount.sdfs after
+// the source and mount point:
+//
+//	mount.sdfs source mountpoint [-sfnv] [-N namespace] [-o options] [-t type]
+//
+// -s there is sloppy, not the standalone flag that comes first.
+func newHelperFlagSet(name string, o *options, fsType, namespace *string) *flag.FlagSet {
+	h := flag.NewFlagSet(name, flag.ContinueOnError)
+	h.BoolVar(&o.sloppy, "s", false, "Ignore mount options that are not known")
+	h.BoolVar(&o.fake, "f", false, "Check everything but do not mount")
+	h.Bool("n", false, "Do not write /etc/mtab. FUSE mounts never do")
+	h.BoolVar(&o.verbose, "v", false, "Describe the mount")
+	h.Var(&o.mountOptions, "o", "Comma separated mount options")
+	h.StringVar(fsType, "t", "", "Type of the filesystem")
+	h.StringVar(namespace, "N", "", "Mount namespace to mount in")
+	return h
+}
+
+// applyMountOptions sets the mount options given with -o, except those
+// in set, the flags given explicitly on the command line. The options it
+// sets are added to set.
+func (o *options) applyMountOptions(f *flag.FlagSet, set map[string]bool) error {
+	applied := map[string]bool{}
+	for _, list := range o.mountOptions {
+		for _, opt := range strings.Split(list, ",") {
+			if err := o.setMountOption(f, set, applied, opt); err != nil {
+				return err
+			}
+		}
+	}
+	for name := range applied {
+		set[name] = true
+	}
+	return nil
+}
+
+// setMountOption sets the mount option opt unless it is in set, and adds
+// it to applied.
+func (o *options) setMountOption(f *flag.FlagSet, set, applied map[string]bool, opt string) error {
+	name, value := opt, ""
+	hasValue := false
+	if i := strings.IndexByte(opt, '='); i >= 0 {
+		name, value, hasValue = opt[:i], opt[i+1:], true
+	}
+	switch {
+	case name == "":
+		return nil
+	case kernelOptions[name] && !hasValue:
+		o.kernelOptions = append(o.kernelOptions, name)
+		return nil
+	case name == "nofail" && !hasValue:
+		o.nofail = true
+		return nil
+	case (name == "uid" || name == "gid") && hasValue:
+		if set[name] {
+			return nil
+		}
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("mount option %s: %s is not a numeric id", name, value)
+		}
+		v := uint32(id)
+		if name == "uid" {
+			o.connection.UID = &v
+		} else {
+			o.connection.GID = &v
+		}
+		applied[name] = true
+		return nil
+	case fstabOptions[name] && !hasValue,
+		strings.HasPrefix(name, "x-"), name == "comment":
+		return nil
+	}
+
+	if fl, ok := optionFlags[name]; ok && hasValue {
+		name = fl
+	}
+	fl := f.Lookup(name)
+	if fl == nil || name == "o" || name == "version" {
+		if o.sloppy {
+			return nil
+		}
+		return fmt.Errorf("unknown mount option %s", opt)
+	}
+	if set[name] {
+		return nil
+	}
+	if !hasValue {
+		if b, ok := fl.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+			return fmt.Errorf("mount option %s needs a value", name)
+		}
+		value = "true"
+	}
+	if err := f.Set(name, value); err != nil {
+		return fmt.Errorf("mount option %s: %v", opt, err)
+	}
+	applied[name] = true
+	return nil
+}
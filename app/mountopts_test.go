@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMountHelperOptions(t *testing.T) {
+	o := parse(t, "sdfs://localhost:6442", "/mnt/sdfs", "-n", "-o",
+		"rw,noexec,nosuid,user=operator,password=secret,volumeID=3,dedupe,nocompress,mtls,"+
+			"attr-cache-ttl=5s,uid=1000,gid=100,allow_other,_netdev,nofail,noauto,x-systemd.automount",
+		"-t", "fuse.sdfs")
+	c := o.connection
+	if c.User != "operator" || c.Pwd != "secret" || c.Volumeid != 3 || !c.Dedupe || !c.Nocompress || !o.mtls {
+		t.Errorf("volume options not applied: %+v, mtls %v", c, o.mtls)
+	}
+	if c.AttrCacheTTL != 5*time.Second {
+		t.Errorf("attr-cache-ttl %v, want 5s", c.AttrCacheTTL)
+	}
+	if c.UID == nil || *c.UID != 1000 || c.GID == nil || *c.GID != 100 {
+		t.Errorf("uid %v and gid %v, want 1000 and 100", c.UID, c.GID)
+	}
+	if want := []string{"rw", "noexec", "nosuid"}; !reflect.DeepEqual(o.kernelOptions, want) {
+		t.Errorf("kernel options %q, want %q", o.kernelOptions, want)
+	}
+	if !o.nofail || o.fake || o.verbose || o.standalone {
+		t.Errorf("nofail %v, fake %v, verbose %v, standalone %v", o.nofail, o.fake, o.verbose, o.standalone)
+	}
+
+	o = parse(t, "pool", "/mnt/sdfs", "-f", "-v", "-s", "-o", "ro,bogus")
+	if !o.sloppy || !o.fake || !o.verbose || o.standalone {
+		t.Errorf("-f -v -s gave sloppy %v, fake %v, verbose %v, standalone %v", o.sloppy, o.fake, o.verbose, o.standalone)
+	}
+}
+
+func TestMountOptionsPrecedence(t *testing.T) {
+	o := parse(t, "-u", "admin", "-o", "volumeID=7", "pool", "/mnt/sdfs", "-o", "user=operator,dedupe-cache-age=9")
+	if o.connection.User != "admin" {
+		t.Errorf("user %q, want the -u flag over the mount option", o.connection.User)
+	}
+	if o.connection.Volumeid != 7 || o.connection.Cachage != 9 {
+		t.Errorf("volume %d and cache age %d, want both -o lists applied", o.connection.Volumeid, o.connection.Cachage)
+	}
+	// A bare user is the fstab option letting users mount.
+	if o := parse(t, "pool", "/mnt/sdfs", "-o", "user"); o.connection.User != "Admin" {
+		t.Errorf("bare user option set the user to %q", o.connection.User)
+	}
+}
+
+func TestMountOptionErrors(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"pool", "/mnt", "-o", "bogus"}, "unknown mount option bogus"},
+		{[]string{"pool", "/mnt", "-o", "version"}, "unknown mount option"},
+		{[]string{"pool", "/mnt", "-o", "volumeID"}, "needs a value"},
+		{[]string{"pool", "/mnt", "-o", "volumeID=x"}, "mount option volumeID=x"},
+		{[]string{"pool", "/mnt", "-o", "uid=bob"}, "not a numeric id"},
+		{[]string{"pool", "/mnt", "-o", "dir-page-size=0"}, "-dir-page-size"},
+		{[]string{"pool", "/mnt", "-t", "nfs"}, "not an sdfs mount"},
+		{[]string{"pool", "/mnt", "-N", "/proc/1/ns/mnt"}, "namespace"},
+	} {
+		_, err := parseOptions("mount.sdfs", tc.args, ioutil.Discard)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("parseOptions(%q) = %v, want an error about %s", tc.args, err, tc.want)
+		}
+	}
+	if _, err := parseOptions("mount.sdfs", []string{"pool", "/mnt", "extra"}, ioutil.Discard); err != errUsage {
+		t.Errorf("extra argument = %v, want the usage", err)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	sdfs "github.com/opendedup/gofuse-sdfs/fs"
+	spb "github.com/opendedup/sdfs-client-go/api"
+)
+
+// options are the settings of a mount taken from the command line and
+// the config file.
+// Everything that concerns the volume and the node tree is kept in
+// connection, which goes to Dial and NewsdfsRoot as it is.
+type options struct {
+	source     string
+	connection sdfs.ConnectionInfo
+
+	mtls     bool
+	mtlsCA   string
+	mtlsKey  string
+	mtlsCert string
+
+	quiet         bool
+	standalone    bool
+	trustCert     bool
+	version       bool
+	cpuprofile    string
+	memprofile    string
+	metricsListen string
+	adminSocket   string
+	traceTarget   string
+	attrTimeout   time.Duration
+	entryTimeout  time.Duration
+
+	// configPath is the file mounts are declared in and mountAll the
+	// names of those to mount when none was chosen.
+	configPath string
+	mountAll   []string
+
+	// mountOptions are the values of -o and kernelOptions those among
+	// them that go to the kernel. The rest are the flags of mount(8).
+	mountOptions  mountOptionList
+	kernelOptions []string
+	nofail        bool
+	sloppy        bool
+	fake          bool
+	verbose       bool
+}
+
+// newFlagSet returns the flags of mount.sdfs, bound to o and set to their
+// defaults.
+func newFlagSet(name string, o *options) *flag.FlagSet {
+	f := flag.NewFlagSet(name, flag.ContinueOnError)
+	c := &o.connection
+	f.StringVar(&c.Pwd, "p", "Password", "The Password to authenticate to the remote Volume")
+	f.StringVar(&c.User, "u", "Admin", "The Username to authenticate to the remote Volume")
+	f.BoolVar(&o.mtls, "mtls", false, "Use Mutual TLS. This will use the certs located in $HOME/.sdfs/keys/[client.crt,client.key,ca.crt]"+
+		"unless otherwise specified")
+	f.StringVar(&o.mtlsCA, "root-ca", "", "The path the CA cert used to sign the MTLS Cert. This defaults to $HOME/.sdfs/keys/ca.crt")
+	f.StringVar(&o.mtlsKey, "mtls-key", "", "The path the private used for mutual TLS. This defaults to $HOME/.sdfs/keys/client.key")
+	f.StringVar(&o.mtlsCert, "mtls-cert", "", "The path the client cert used for mutual TLS. This defaults to $HOME/.sdfs/keys/client.crt")
+	f.BoolVar(&c.Dedupe, "dedupe", false, "Enable Client Side Dedupe")
+	f.BoolVar(&c.Debug, "debug", false, "print debugging messages.")
+	f.BoolVar(&o.quiet, "q", false, "quiet")
+	f.BoolVar(&o.standalone, "s", false, "do not daemonize mount")
+	f.BoolVar(&c.DisableTrust, "trust-all", false, "Trust Self Signed TLS Certs")
+	f.BoolVar(&o.version, "version", false, "The Version of this build")
+	f.StringVar(&o.cpuprofile, "cpuprofile", "", "write cpu profile to this file")
+	f.StringVar(&o.memprofile, "memprofile", "", "write memory profile to this file")
+	f.BoolVar(&o.trustCert, "trust-cert", false, "Trust the certificate for url specified. This will download and store the certificate in $HOME/.sdfs/keys")
+	f.Int("dedupe-buffers", 4, "Deprecated and ignored: "+deprecatedFlags["dedupe-buffers"])
+	f.Int("dedupe-threads", 4, "Deprecated and ignored: "+deprecatedFlags["dedupe-threads"])
+	f.StringVar(&c.LogPath, "log-path", "/var/log/sdfs/", "Base Path for logs")
+	f.IntVar(&c.Cachsize, "dedupe-cache-size", 1000000, "Cache size for client size dedupe")
+	f.IntVar(&c.Cachage, "dedupe-cache-age", 30, "Maximum age for local dedupe cache")
+	f.Int64Var(&c.Volumeid, "volumeID", -1, "The volume id to connect to. Required for access through proxy")
+	f.BoolVar(&c.Nocompress, "nocompress", false, "Do not compress api traffic")
+	f.IntVar(&c.DirPageSize, "dir-page-size", sdfs.DefaultDirPageSize, "Number of directory entries fetched per listing request")
+	f.DurationVar(&c.AttrCacheTTL, "attr-cache-ttl", time.Second, "How long file attributes are cached by the mount. 0 disables the cache")
+	f.DurationVar(&c.NegativeCacheTTL, "negative-cache-ttl", 0, "How long missing files are remembered by the mount. 0 disables negative caching")
+	f.IntVar(&c.WriteBufferSize, "write-buffer-size", sdfs.DefaultWriteBufferSize, "Bytes of adjacent writes a file handle collects before sending them. 0 writes through")
+	f.Int64Var(&c.WriteBufferMemory, "write-buffer-memory", sdfs.DefaultWriteBufferMemory, "Maximum bytes held in write buffers across the mount")
+	f.IntVar(&c.ReadAheadSize, "read-ahead-size", sdfs.DefaultReadAheadSize, "Largest window a file handle reads ahead of sequential reads. 0 disables read-ahead")
+	f.IntVar(&c.ReadAheadParallel, "read-ahead-parallel", sdfs.DefaultReadAheadParallel, "Number of concurrent reads filling the read-ahead window")
+	f.StringVar(&c.BlockCacheDir, "block-cache-dir", "", "Local directory, ideally on an SSD, that keeps data read from the volume across mounts. Empty disables the cache")
+	f.Int64Var(&c.BlockCacheSize, "block-cache-size", sdfs.DefaultBlockCacheSize, "Maximum bytes kept in the block cache for a volume")
+	f.DurationVar(&c.ReconnectTimeout, "reconnect-timeout", sdfs.DefaultReconnectTimeout, "How long operations wait for the volume to come back after the connection is lost. 0 fails them right away")
+	f.DurationVar(&c.MetadataTimeout, "metadata-timeout", sdfs.DefaultMetadataTimeout, "Deadline for metadata requests to the volume, including waiting for a reconnect. 0 disables it")
+	f.DurationVar(&c.DataTimeout, "data-timeout", sdfs.DefaultDataTimeout, "Deadline for read and write requests to the volume, including waiting for a reconnect. 0 disables it")
+	f.DurationVar(&c.FsyncTimeout, "fsync-timeout", sdfs.DefaultFsyncTimeout, "Deadline for flush and fsync requests to the volume, including waiting for a reconnect. 0 disables it")
+	f.StringVar(&o.metricsListen, "metrics-listen", "", "host:port or unix:path to serve Prometheus metrics on at /metrics. Empty disables metrics")
+	f.StringVar(&o.adminSocket, "admin-socket", "", "Unix socket sdfsctl manages the mount through. Defaults to one named after the mount point in "+sdfs.AdminSocketDir)
+	f.StringVar(&o.traceTarget, "trace", "", "host:port of an OTLP collector, or file:path, to send traces of FUSE operations and volume requests to. Empty disables tracing")
+	f.DurationVar(&o.attrTimeout, "attr-timeout", 10*time.Second, "How long the kernel caches file attributes")
+	f.DurationVar(&o.entryTimeout, "entry-timeout", 10*time.Second, "How long the kernel caches names looked up")
+	f.StringVar(&o.configPath, "config", "", "YAML or TOML file declaring mounts. Flags and mount options given here override its values")
+	f.Var(&o.mountOptions, "o", "Comma separated mount options as in fstab: the flags above by name, user=, password=, uid=, gid=, ro, noexec and the like, nofail")
+	f.Usage = func() {
+		fmt.Fprintf(f.Output(), "usage: %s options source mountpoint\n", path.Base(name))
+		fmt.Fprintf(f.Output(), "       %s source mountpoint [-sfnv] [-o options]\n", path.Base(name))
+		fmt.Fprintf(f.Output(), "       %s -config file [options] [name|mountpoint]\n", path.Base(name))
+		fmt.Fprintf(f.Output(), "\noptions:\n")
+		f.PrintDefaults()
+	}
+	return f
+}
+
+// deprecatedFlags are accepted so that existing mounts keep working, but
+// do nothing. Setting one prints why.
+var deprecatedFlags = map[string]string{
+	"dedupe-buffers": "the client library sizes its dedupe engine itself",
+	"dedupe-threads": "the client library sizes its dedupe engine itself",
+}
+
+// errUsage is returned by parseOptions when the arguments are incomplete
+// and the usage was printed.
+var errUsage = errors.New("source and mountpoint are required")
+
+// parseOptions parses the arguments of mount.sdfs, without the program
+// name, and checks them. Usage and errors of the flags themselves are
+// written to out.
+func parseOptions(name string, args []string, out io.Writer) (*options, error) {
+	o := &options{}
+	f := newFlagSet(name, o)
+	f.SetOutput(out)
+	if err := f.Parse(args); err != nil {
+		return nil, err
+	}
+	if o.version {
+		return o, nil
+	}
+	if f.NArg() < 2 && o.configPath == "" {
+		f.Usage()
+		return nil, errUsage
+	}
+	var selector string
+	switch f.NArg() {
+	case 0:
+	case 1:
+		selector = f.Arg(0)
+	default:
+		o.source = f.Arg(0)
+		o.connection.MountPath = f.Arg(1)
+	}
+	if f.NArg() > 2 {
+		var fsType, namespace string
+		h := newHelperFlagSet(name, o, &fsType, &namespace)
+		h.SetOutput(out)
+		h.Usage = f.Usage
+		if err := h.Parse(f.Args()[2:]); err != nil {
+			return nil, err
+		}
+		if h.NArg() > 0 {
+			f.Usage()
+			return nil, errUsage
+		}
+		if fsType != "" && fsType != "sdfs" && fsType != "fuse.sdfs" {
+			return nil, fmt.Errorf("-t %s: not an sdfs mount", fsType)
+		}
+		if namespace != "" {
+			return nil, errors.New("-N: mounting in another namespace is not supported")
+		}
+	}
+
+	set := map[string]bool{}
+	f.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = true
+	})
+	if err := o.applyMountOptions(f, set); err != nil {
+		return nil, err
+	}
+	if o.configPath != "" {
+		if err := o.applyConfig(f, set, selector); err != nil {
+			return nil, err
+		}
+		if o.mountAll != nil {
+			return o, nil
+		}
+	}
+	f.VisitAll(func(fl *flag.Flag) {
+		if why, ok := deprecatedFlags[fl.Name]; ok && set[fl.Name] {
+			fmt.Fprintf(out, "-%s is deprecated and ignored: %s\n", fl.Name, why)
+		}
+	})
+	o.connection.Trace = o.traceTarget != ""
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// validate checks that the options make sense together and cleans up the
+// paths among them.
+func (o *options) validate() error {
+	c := &o.connection
+	if strings.Contains(o.source, "://") {
+		if !strings.HasPrefix(o.source, "sdfs://") && !strings.HasPrefix(o.source, "sdfss://") {
+			return fmt.Errorf("source %s: the url has to start with sdfs:// or sdfss://", o.source)
+		}
+	} else if o.source == "" || strings.ContainsRune(o.source, '/') {
+		return fmt.Errorf("source %q: expected a url or the name of a local volume", o.source)
+	}
+	if c.MountPath == "" {
+		return errors.New("mountpoint is empty")
+	}
+	mountPath, err := filepath.Abs(c.MountPath)
+	if err != nil {
+		return fmt.Errorf("mountpoint %s: %v", c.MountPath, err)
+	}
+	c.MountPath = mountPath
+
+	positive := []struct {
+		name  string
+		value int64
+	}{
+		{"dir-page-size", int64(c.DirPageSize)},
+		{"read-ahead-parallel", int64(c.ReadAheadParallel)},
+	}
+	for _, p := range positive {
+		if p.value <= 0 {
+			return fmt.Errorf("-%s has to be greater than 0, not %d", p.name, p.value)
+		}
+	}
+	nonNegative := []struct {
+		name  string
+		value int64
+	}{
+		{"dedupe-cache-size", int64(c.Cachsize)},
+		{"dedupe-cache-age", int64(c.Cachage)},
+		{"write-buffer-size", int64(c.WriteBufferSize)},
+		{"write-buffer-memory", c.WriteBufferMemory},
+		{"read-ahead-size", int64(c.ReadAheadSize)},
+		{"attr-cache-ttl", int64(c.AttrCacheTTL)},
+		{"negative-cache-ttl", int64(c.NegativeCacheTTL)},
+		{"reconnect-timeout", int64(c.ReconnectTimeout)},
+		{"metadata-timeout", int64(c.MetadataTimeout)},
+		{"data-timeout", int64(c.DataTimeout)},
+		{"fsync-timeout", int64(c.FsyncTimeout)},
+		{"attr-timeout", int64(o.attrTimeout)},
+		{"entry-timeout", int64(o.entryTimeout)},
+	}
+	for _, p := range nonNegative {
+		if p.value < 0 {
+			return fmt.Errorf("-%s cannot be negative", p.name)
+		}
+	}
+	if c.BlockCacheDir != "" && c.BlockCacheSize <= 0 {
+		return fmt.Errorf("-block-cache-size has to be greater than 0, not %d", c.BlockCacheSize)
+	}
+	if c.Volumeid < -1 {
+		return fmt.Errorf("-volumeID %d is not a volume id", c.Volumeid)
+	}
+	if c.WriteBufferSize > 0 && c.WriteBufferMemory < int64(c.WriteBufferSize) {
+		return fmt.Errorf("-write-buffer-memory %d is less than one write buffer of %d bytes", c.WriteBufferMemory, c.WriteBufferSize)
+	}
+	if c.LogPath == "" {
+		return errors.New("-log-path is empty")
+	}
+	for _, p := range []struct{ name, path string }{
+		{"root-ca", o.mtlsCA},
+		{"mtls-key", o.mtlsKey},
+		{"mtls-cert", o.mtlsCert},
+	} {
+		if p.path == "" {
+			continue
+		}
+		if _, err := os.Stat(p.path); err != nil {
+			return fmt.Errorf("-%s: %v", p.name, err)
+		}
+	}
+	return nil
+}
+
+// applyTLS hands the mutual TLS settings to the client library, which
+// keeps them globally. Paths that are not set keep its defaults.
+func (o *options) applyTLS() {
+	if o.mtlsCA != "" {
+		spb.MtlsCACert = o.mtlsCA
+	}
+	if o.mtlsKey != "" {
+		spb.MtlsKey = o.mtlsKey
+	}
+	if o.mtlsCert != "" {
+		spb.MtlsCert = o.mtlsCert
+	}
+	if o.mtls {
+		spb.Mtls = true
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	spb "github.com/opendedup/sdfs-client-go/api"
+)
+
+func parse(t *testing.T, args ...string) *options {
+	t.Helper()
+	o, err := parseOptions("mount.sdfs", args, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("parseOptions(%q): %v", args, err)
+	}
+	return o
+}
+
+// TestEveryFlagTakesEffect sets every flag to a value other than its
+// default and checks that the value ends up in the options.
+func TestEveryFlagTakesEffect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdfs-options")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert := filepath.Join(dir, "client.crt")
+	if err := ioutil.WriteFile(cert, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := filepath.Join(dir, "mounts.yaml")
+	if err := ioutil.WriteFile(cfg, []byte("mounts:\n  - mountpoint: /mnt/sdfs\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		value string
+		check func(o *options) bool
+	}{
+		"p":                   {"secret", func(o *options) bool { return o.connection.Pwd == "secret" }},
+		"u":                   {"operator", func(o *options) bool { return o.connection.User == "operator" }},
+		"mtls":                {"true", func(o *options) bool { return o.mtls }},
+		"root-ca":             {cert, func(o *options) bool { return o.mtlsCA == cert }},
+		"mtls-key":            {cert, func(o *options) bool { return o.mtlsKey == cert }},
+		"mtls-cert":           {cert, func(o *options) bool { return o.mtlsCert == cert }},
+		"dedupe":              {"true", func(o *options) bool { return o.connection.Dedupe }},
+		"debug":               {"true", func(o *options) bool { return o.connection.Debug }},
+		"q":                   {"true", func(o *options) bool { return o.quiet }},
+		"s":                   {"true", func(o *options) bool { return o.standalone }},
+		"trust-all":           {"true", func(o *options) bool { return o.connection.DisableTrust }},
+		"version":             {"true", func(o *options) bool { return o.version }},
+		"cpuprofile":          {"cpu.prof", func(o *options) bool { return o.cpuprofile == "cpu.prof" }},
+		"memprofile":          {"mem.prof", func(o *options) bool { return o.memprofile == "mem.prof" }},
+		"trust-cert":          {"true", func(o *options) bool { return o.trustCert }},
+		"log-path":            {dir, func(o *options) bool { return o.connection.LogPath == dir }},
+		"dedupe-cache-size":   {"500", func(o *options) bool { return o.connection.Cachsize == 500 }},
+		"dedupe-cache-age":    {"7", func(o *options) bool { return o.connection.Cachage == 7 }},
+		"volumeID":            {"42", func(o *options) bool { return o.connection.Volumeid == 42 }},
+		"nocompress":          {"true", func(o *options) bool { return o.connection.Nocompress }},
+		"dir-page-size":       {"250", func(o *options) bool { return o.connection.DirPageSize == 250 }},
+		"attr-cache-ttl":      {"5s", func(o *options) bool { return o.connection.AttrCacheTTL == 5*time.Second }},
+		"negative-cache-ttl":  {"3s", func(o *options) bool { return o.connection.NegativeCacheTTL == 3*time.Second }},
+		"write-buffer-size":   {"4096", func(o *options) bool { return o.connection.WriteBufferSize == 4096 }},
+		"write-buffer-memory": {"8388608", func(o *options) bool { return o.connection.WriteBufferMemory == 8<<20 }},
+		"read-ahead-size":     {"65536", func(o *options) bool { return o.connection.ReadAheadSize == 65536 }},
+		"read-ahead-parallel": {"3", func(o *options) bool { return o.connection.ReadAheadParallel == 3 }},
+		"block-cache-dir":     {dir, func(o *options) bool { return o.connection.BlockCacheDir == dir }},
+		"block-cache-size":    {"1024", func(o *options) bool { return o.connection.BlockCacheSize == 1024 }},
+		"reconnect-timeout":   {"5s", func(o *options) bool { return o.connection.ReconnectTimeout == 5*time.Second }},
+		"metadata-timeout":    {"6s", func(o *options) bool { return o.connection.MetadataTimeout == 6*time.Second }},
+		"data-timeout":        {"7s", func(o *options) bool { return o.connection.DataTimeout == 7*time.Second }},
+		"fsync-timeout":       {"8s", func(o *options) bool { return o.connection.FsyncTimeout == 8*time.Second }},
+		"metrics-listen":      {":9100", func(o *options) bool { return o.metricsListen == ":9100" }},
+		"admin-socket":        {"/tmp/a.sock", func(o *options) bool { return o.adminSocket == "/tmp/a.sock" }},
+		"trace":               {"file:/tmp/trace.json", func(o *options) bool { return o.traceTarget == "file:/tmp/trace.json" && o.connection.Trace }},
+		"attr-timeout":        {"30s", func(o *options) bool { return o.attrTimeout == 30*time.Second }},
+		"entry-timeout":       {"20s", func(o *options) bool { return o.entryTimeout == 20*time.Second }},
+		"config":              {cfg, func(o *options) bool { return o.configPath == cfg }},
+		"o":                   {"ro", func(o *options) bool { return len(o.kernelOptions) == 1 && o.kernelOptions[0] == "ro" }},
+	}
+
+	defaults := parse(t, "sdfs://localhost:6442", "/mnt/sdfs")
+	newFlagSet("mount.sdfs", &options{}).VisitAll(func(f *flag.Flag) {
+		if _, ok := deprecatedFlags[f.Name]; ok {
+			return
+		}
+		tc, ok := tests[f.Name]
+		if !ok {
+			t.Errorf("-%s is not covered", f.Name)
+			return
+		}
+		if tc.check(defaults) {
+			t.Errorf("-%s: the default already passes the check", f.Name)
+		}
+		o := parse(t, "-"+f.Name+"="+tc.value, "sdfs://localhost:6442", "/mnt/sdfs")
+		if !tc.check(o) {
+			t.Errorf("-%s=%s did not take effect", f.Name, tc.value)
+		}
+	})
+}
+
+func TestOptionsArguments(t *testing.T) {
+	o := parse(t, "-u", "operator", "sdfss://volume:6442", "/mnt/sdfs/")
+	if o.source != "sdfss://volume:6442" || o.connection.MountPath != "/mnt/sdfs" {
+		t.Errorf("source %q and mountpoint %q", o.source, o.connection.MountPath)
+	}
+	if o.connection.Trace {
+		t.Errorf("tracing enabled without -trace")
+	}
+	wd, _ := os.Getwd()
+	if o := parse(t, "pool0", "mnt"); o.source != "pool0" || o.connection.MountPath != filepath.Join(wd, "mnt") {
+		t.Errorf("source %q and mountpoint %q, want the local volume and an absolute path", o.source, o.connection.MountPath)
+	}
+	if _, err := parseOptions("mount.sdfs", []string{"sdfs://localhost:6442"}, ioutil.Discard); err != errUsage {
+		t.Errorf("missing mountpoint = %v, want the usage", err)
+	}
+	if _, err := parseOptions("mount.sdfs", []string{"-h"}, ioutil.Discard); err != flag.ErrHelp {
+		t.Errorf("-h = %v, want flag.ErrHelp", err)
+	}
+	if o := parse(t, "-version"); !o.version {
+		t.Errorf("-version without arguments was not accepted")
+	}
+}
+
+func TestOptionsValidation(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"http://localhost:6442", "/mnt"}, "sdfs://"},
+		{[]string{"../pool", "/mnt"}, "local volume"},
+		{[]string{"-dir-page-size=0", "pool", "/mnt"}, "-dir-page-size"},
+		{[]string{"-read-ahead-parallel=0", "pool", "/mnt"}, "-read-ahead-parallel"},
+		{[]string{"-dedupe-cache-size=-5", "pool", "/mnt"}, "-dedupe-cache-size"},
+		{[]string{"-attr-cache-ttl=-1s", "pool", "/mnt"}, "-attr-cache-ttl"},
+		{[]string{"-fsync-timeout=-1s", "pool", "/mnt"}, "-fsync-timeout"},
+		{[]string{"-volumeID=-2", "pool", "/mnt"}, "-volumeID"},
+		{[]string{"-write-buffer-size=4096", "-write-buffer-memory=1024", "pool", "/mnt"}, "-write-buffer-memory"},
+		{[]string{"-block-cache-dir=/tmp", "-block-cache-size=0", "pool", "/mnt"}, "-block-cache-size"},
+		{[]string{"-log-path=", "pool", "/mnt"}, "-log-path"},
+		{[]string{"-mtls-key=/nonexistent/client.key", "pool", "/mnt"}, "-mtls-key"},
+		{[]string{"-dir-page-size=many", "pool", "/mnt"}, "invalid value"},
+	} {
+		_, err := parseOptions("mount.sdfs", tc.args, ioutil.Discard)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("parseOptions(%q) = %v, want an error about %s", tc.args, err, tc.want)
+		}
+	}
+	// Without a block cache its size does not matter.
+	parse(t, "-block-cache-size=0", "pool", "/mnt")
+}
+
+func TestDeprecatedFlags(t *testing.T) {
+	var out bytes.Buffer
+	if _, err := parseOptions("mount.sdfs", []string{"-dedupe-threads=0", "pool", "/mnt"}, &out); err != nil {
+		t.Fatalf("parseOptions: %v", err)
+	}
+	if !strings.Contains(out.String(), "-dedupe-threads is deprecated") {
+		t.Errorf("no deprecation warning for -dedupe-threads, got %q", out.String())
+	}
+	if strings.Contains(out.String(), "-dedupe-buffers") {
+		t.Errorf("warned about -dedupe-buffers, which was not set: %q", out.String())
+	}
+}
+
+func TestApplyTLS(t *testing.T) {
+	saved := []interface{}{spb.Mtls, spb.MtlsCACert, spb.MtlsKey, spb.MtlsCert}
+	defer func() {
+		spb.Mtls = saved[0].(bool)
+		spb.MtlsCACert = saved[1].(string)
+		spb.MtlsKey = saved[2].(string)
+		spb.MtlsCert = saved[3].(string)
+	}()
+	spb.MtlsKey = "default.key"
+	o := &options{mtls: true, mtlsCA: "ca.crt", mtlsCert: "client.crt"}
+	o.applyTLS()
+	if !spb.Mtls || spb.MtlsCACert != "ca.crt" || spb.MtlsCert != "client.crt" {
+		t.Errorf("mutual TLS settings not applied: %v %q %q", spb.Mtls, spb.MtlsCACert, spb.MtlsCert)
+	}
+	if spb.MtlsKey != "default.key" {
+		t.Errorf("unset -mtls-key replaced the default key with %q", spb.MtlsKey)
+	}
+}
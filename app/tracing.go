@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// startTracing exports the spans of the mount to target, either the
+// host:port of an OTLP collector reached over gRPC without TLS, usually
+// one running locally, or file:path to append them to path as JSON. The
+// returned function flushes the spans still buffered and stops exporting.
+func startTracing(target string) (func(), error) {
+	var exporter sdktrace.SpanExporter
+	var out *os.File
+	if strings.HasPrefix(target, "file:") {
+		f, err := os.OpenFile(strings.TrimPrefix(target, "file:"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			return nil, err
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		out = f
+	} else {
+		var err error
+		exporter, err = otlptracegrpc.New(context.Background(),
+			otlptracegrpc.WithEndpoint(target), otlptracegrpc.WithInsecure())
+		if err != nil {
+			return nil, err
+		}
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "mount.sdfs"),
+			attribute.String("service.version", Version),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return func() {
+		tp.Shutdown(context.Background())
+		if out != nil {
+			out.Close()
+		}
+	}, nil
+}
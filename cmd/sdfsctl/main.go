@@ -0,0 +1,170 @@
+// sdfsctl manages running mount.sdfs mounts through their admin sockets.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	sdfs "github.com/opendedup/gofuse-sdfs/fs"
+)
+
+var Version = "development"
+var BuildDate = "NAN"
+
+const usage = `usage: %s [options] command [args]
+
+commands:
+  list              list the mounts that have an admin socket
+  status            show the server, volume, uptime and open handles
+  stats             dump cache, handle and connection counters
+  flush             write out buffered data and empty the caches
+  log-level LEVEL   set the log level (trace, debug, info, warning, error)
+  reconnect         replace the connection to the volume
+  unmount           unmount the volume, failing while it is in use
+
+options:
+`
+
+func main() {
+	mountPoint := flag.String("m", "", "Mount point of the mount to manage. Not needed when only one volume is mounted")
+	socket := flag.String("socket", "", "Admin socket of the mount to manage, instead of -m")
+	asJSON := flag.Bool("json", false, "Print answers as JSON")
+	timeout := flag.Duration("timeout", 2*time.Minute, "How long to wait for the mount to answer")
+	version := flag.Bool("version", false, "The Version of this build")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, path.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *version {
+		fmt.Printf("Version : %s\n", Version)
+		fmt.Printf("Build Date: %s\n", BuildDate)
+		os.Exit(0)
+	}
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cmd := flag.Arg(0)
+	if cmd == "list" {
+		sockets, err := adminSockets()
+		if err != nil {
+			fatalf("%v", err)
+		}
+		for _, s := range sockets {
+			fmt.Println(s)
+		}
+		return
+	}
+
+	sock := *socket
+	if sock == "" {
+		var err error
+		if sock, err = findSocket(*mountPoint); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	c := &sdfs.AdminClient{Socket: sock, Timeout: *timeout}
+	var err error
+	switch cmd {
+	case "status":
+		var st sdfs.AdminStatus
+		if err = c.Do(http.MethodGet, "/status", nil, &st); err == nil {
+			printStatus(&st, *asJSON)
+		}
+	case "stats":
+		var st sdfs.AdminStats
+		if err = c.Do(http.MethodGet, "/stats", nil, &st); err == nil {
+			printJSON(&st)
+		}
+	case "flush":
+		var st sdfs.AdminStats
+		if err = c.Do(http.MethodPost, "/flush", nil, &st); err == nil && *asJSON {
+			printJSON(&st)
+		}
+	case "log-level":
+		if flag.NArg() != 2 {
+			fatalf("usage: %s log-level LEVEL", path.Base(os.Args[0]))
+		}
+		var st sdfs.AdminStatus
+		err = c.Do(http.MethodPost, "/log-level", url.Values{"level": {flag.Arg(1)}}, &st)
+		if err == nil {
+			printStatus(&st, *asJSON)
+		}
+	case "reconnect":
+		var st sdfs.AdminStats
+		if err = c.Do(http.MethodPost, "/reconnect", nil, &st); err == nil && *asJSON {
+			printJSON(&st)
+		}
+	case "unmount":
+		err = c.Do(http.MethodPost, "/unmount", nil, nil)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatalf("%s: %v", cmd, err)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
+
+// adminSockets returns the admin sockets in the default directory.
+func adminSockets() ([]string, error) {
+	return filepath.Glob(filepath.Join(sdfs.AdminSocketDir, "mount-*.sock"))
+}
+
+// findSocket returns the admin socket of the mount at mountPoint or, when
+// mountPoint is empty, of the only mount there is.
+func findSocket(mountPoint string) (string, error) {
+	if mountPoint != "" {
+		dir, err := filepath.Abs(mountPoint)
+		if err != nil {
+			return "", err
+		}
+		return sdfs.AdminSocket(dir), nil
+	}
+	sockets, err := adminSockets()
+	if err != nil {
+		return "", err
+	}
+	switch len(sockets) {
+	case 0:
+		return "", fmt.Errorf("no admin socket found in %s", sdfs.AdminSocketDir)
+	case 1:
+		return sockets[0], nil
+	}
+	return "", fmt.Errorf("%d mounts found, choose one with -m or -socket", len(sockets))
+}
+
+func printJSON(v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fatalf("%v", err)
+	}
+	fmt.Println(string(b))
+}
+
+func printStatus(st *sdfs.AdminStatus, asJSON bool) {
+	if asJSON {
+		printJSON(st)
+		return
+	}
+	fmt.Printf("Server:       %s\n", st.ServerURL)
+	fmt.Printf("Volume ID:    %d\n", st.VolumeID)
+	fmt.Printf("Mount Point:  %s\n", st.MountPoint)
+	fmt.Printf("Uptime:       %s\n", st.Uptime.Round(time.Second))
+	fmt.Printf("Open Handles: %d\n", st.OpenHandles)
+	fmt.Printf("Log Level:    %s\n", st.LogLevel)
+}
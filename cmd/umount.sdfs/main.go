@@ -0,0 +1,148 @@
+// umount.sdfs unmounts sdfs volumes. umount(8) calls it, as umount.fuse.sdfs,
+// with
+//
+//	umount.sdfs mountpoint [-flnrv] [-N namespace] [-t type]
+//
+// The volume is unmounted through the admin socket of its mount, so that
+// buffered data is written out first and a volume in use stays mounted. A
+// socket serving another mount point is refused.
+// When the mount does not answer there, or with -l or -f, the filesystem
+// is detached directly.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	sdfs "github.com/opendedup/gofuse-sdfs/fs"
+	"golang.org/x/sys/unix"
+)
+
+var Version = "development"
+var BuildDate = "NAN"
+
+func main() {
+	force := flag.Bool("f", false, "Force the unmount, aborting requests in progress")
+	lazy := flag.Bool("l", false, "Detach the volume now and clean up once it is no longer in use")
+	flag.Bool("n", false, "Do not write /etc/mtab. FUSE mounts never do")
+	flag.Bool("r", false, "Remount read-only when unmounting fails. Not supported, the volume stays mounted")
+	verbose := flag.Bool("v", false, "Describe what is done")
+	fsType := flag.String("t", "", "Type of the filesystem")
+	namespace := flag.String("N", "", "Mount namespace to unmount in")
+	socket := flag.String("socket", "", "Admin socket of the mount. Defaults to the one named after the mount point in "+sdfs.AdminSocketDir)
+	timeout := flag.Duration("timeout", 2*time.Minute, "How long to wait for the mount to write out buffered data")
+	version := flag.Bool("version", false, "The Version of this build")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s mountpoint [-flnrv] [-t type]\n\noptions:\n", path.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+
+	// umount(8) puts the flags after the mount point.
+	var args []string
+	rest := os.Args[1:]
+	for {
+		flag.CommandLine.Parse(rest)
+		if flag.NArg() == 0 {
+			break
+		}
+		args = append(args, flag.Arg(0))
+		rest = flag.Args()[1:]
+	}
+	if *version {
+		fmt.Printf("Version : %s\n", Version)
+		fmt.Printf("Build Date: %s\n", BuildDate)
+		os.Exit(0)
+	}
+	if len(args) != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *fsType != "" && *fsType != "sdfs" && *fsType != "fuse.sdfs" {
+		fatalf("-t %s: not an sdfs mount", *fsType)
+	}
+	if *namespace != "" {
+		fatalf("-N: unmounting in another namespace is not supported")
+	}
+	dir, err := filepath.Abs(args[0])
+	if err != nil {
+		fatalf("%s: %v", args[0], err)
+	}
+
+	if !*lazy && !*force {
+		sock := *socket
+		if sock == "" {
+			sock = sdfs.AdminSocket(dir)
+		}
+		c := &sdfs.AdminClient{Socket: sock, Timeout: *timeout}
+		var st sdfs.AdminStatus
+		err := c.Do(http.MethodGet, "/status", nil, &st)
+		if err == nil && filepath.Clean(st.MountPoint) != dir {
+			fatalf("%s: %s is the admin socket of %s", dir, sock, st.MountPoint)
+		}
+		if err == nil {
+			err = c.Do(http.MethodPost, "/unmount", nil, nil)
+		}
+		if err == nil {
+			if *verbose {
+				fmt.Printf("%s unmounted\n", dir)
+			}
+			return
+		}
+		if _, ok := err.(*sdfs.AdminError); ok {
+			fatalf("%s: %v", dir, err)
+		}
+		if *verbose {
+			fmt.Printf("%s does not answer on %s, detaching it\n", dir, sock)
+		}
+	}
+	if err := detach(dir, *lazy, *force); err != nil {
+		fatalf("%s: %v", dir, err)
+	}
+	if *verbose {
+		fmt.Printf("%s unmounted\n", dir)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "%s: "+format+"\n", append([]interface{}{path.Base(os.Args[0])}, args...)...)
+	os.Exit(1)
+}
+
+// detach unmounts dir without asking the mount, directly as root and
+// through fusermount otherwise.
+func detach(dir string, lazy, force bool) error {
+	if os.Geteuid() == 0 {
+		flags := 0
+		if lazy {
+			flags |= unix.MNT_DETACH
+		}
+		if force {
+			flags |= unix.MNT_FORCE
+		}
+		return unix.Unmount(dir, flags)
+	}
+	args := []string{"-u"}
+	if lazy {
+		args = append(args, "-z")
+	}
+	args = append(args, dir)
+	for _, prog := range []string{"fusermount", "fusermount3"} {
+		p, err := exec.LookPath(prog)
+		if err != nil {
+			continue
+		}
+		if out, err := exec.Command(p, args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %s", prog, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	return errors.New("neither fusermount nor fusermount3 found")
+}
@@ -0,0 +1,285 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	ffs "github.com/hanwen/go-fuse/v2/fs"
+	log "github.com/sirupsen/logrus"
+)
+
+// AdminSocketDir is where mounts keep their admin sockets by default,
+// next to their pid files.
+const AdminSocketDir = "/var/run/sdfs"
+
+// AdminSocket returns the default admin socket of the mount at
+// mountPoint. Its name is the whole mount point escaped the way systemd
+// names mount units, so that /mnt/a/data and /srv/data get different
+// sockets.
+func AdminSocket(mountPoint string) string {
+	return filepath.Join(AdminSocketDir, "mount-"+escapePath(mountPoint)+".sock")
+}
+
+// escapePath turns path into a file name. Slashes become dashes and
+// bytes other than letters, digits, underscores and dots not leading the
+// name become \xNN, so that different paths never get the same name.
+func escapePath(path string) string {
+	path = strings.Trim(filepath.Clean(path), "/")
+	if path == "" {
+		return "-"
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '.' && i > 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		}
+	}
+	return b.String()
+}
+
+// AdminStatus describes a mount on the admin socket.
+type AdminStatus struct {
+	ServerURL   string        `json:"server_url"`
+	VolumeID    int64         `json:"volume_id"`
+	MountPoint  string        `json:"mount_point"`
+	Started     time.Time     `json:"started"`
+	Uptime      time.Duration `json:"uptime"`
+	OpenHandles int64         `json:"open_handles"`
+	LogLevel    string        `json:"log_level"`
+}
+
+// CacheCounts are the lookups in one cache of a mount.
+type CacheCounts struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// AdminStats are the counters of a mount on the admin socket. They are
+// kept whether or not metrics are served.
+type AdminStats struct {
+	OpenHandles      int64                  `json:"open_handles"`
+	Caches           map[string]CacheCounts `json:"caches"`
+	BlockCacheBytes  int64                  `json:"block_cache_bytes"`
+	WriteBufferBytes int64                  `json:"write_buffer_bytes"`
+	Reconnects       uint64                 `json:"reconnects"`
+	UnexpectedErrors map[string]uint64      `json:"unexpected_errors"`
+}
+
+// handleCount counts the open file handles of a mount.
+type handleCount struct {
+	n int64
+}
+
+func (c *handleCount) add(d int64) {
+	if c != nil {
+		atomic.AddInt64(&c.n, d)
+	}
+}
+
+func (c *handleCount) load() int64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.n)
+}
+
+// reconnector is implemented by backends that can be made to replace
+// their connection to the volume.
+type reconnector interface {
+	reconnect(ctx context.Context) error
+}
+
+var errNoReconnect = errors.New("reconnecting is disabled for this mount")
+
+// adminShutdownTimeout is how long closing the admin socket waits for
+// requests being answered, such as the one that unmounted the volume.
+const adminShutdownTimeout = 5 * time.Second
+
+type adminServer struct {
+	r         *sdfsRoot
+	serverURL string
+	started   time.Time
+	unmount   func() error
+	srv       *http.Server
+}
+
+// ServeAdmin serves the admin requests of sdfsctl for root, a node
+// returned by NewsdfsRoot, on a unix socket at path that only its owner
+// may use. The requests are
+//
+//	GET  /status              server, volume, uptime and open handles
+//	GET  /stats               cache, handle and connection counters
+//	POST /flush               write out buffered data and empty the caches
+//	POST /log-level?level=L   change the log level
+//	POST /reconnect           replace the connection to the volume
+//	POST /unmount             unmount through unmount
+//
+// serverURL is the volume the mount was made from. Closing the returned
+// Closer stops serving once the requests in progress are answered.
+func ServeAdmin(root ffs.InodeEmbedder, path, serverURL string, unmount func() error) (io.Closer, error) {
+	a := &adminServer{
+		r:         root.(*sdfsRoot),
+		serverURL: serverURL,
+		started:   time.Now(),
+		unmount:   unmount,
+	}
+	l, err := listen("unix:" + path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", a.get(a.status))
+	mux.HandleFunc("/stats", a.get(a.stats))
+	mux.HandleFunc("/flush", a.post(a.flush))
+	mux.HandleFunc("/log-level", a.post(a.logLevel))
+	mux.HandleFunc("/reconnect", a.post(a.reconnect))
+	mux.HandleFunc("/unmount", a.post(a.doUnmount))
+	a.srv = &http.Server{Handler: mux}
+	go func() {
+		if err := a.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Debugf("admin socket %s stopped %v", path, err)
+		}
+	}()
+	return a, nil
+}
+
+func (a *adminServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+	defer cancel()
+	return a.srv.Shutdown(ctx)
+}
+
+// get and post turn a function answering with a value to encode as JSON,
+// or an error, into a handler for that method.
+func (a *adminServer) get(fn func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return a.handler(http.MethodGet, fn)
+}
+
+func (a *adminServer) post(fn func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return a.handler(http.MethodPost, fn)
+}
+
+func (a *adminServer) handler(method string, fn func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		v, err := fn(req)
+		if err != nil {
+			log.Warnf("admin request %s failed: %v", req.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			log.Debugf("unable to answer admin request %s %v", req.URL.Path, err)
+		}
+	}
+}
+
+func (a *adminServer) status(*http.Request) (interface{}, error) {
+	return &AdminStatus{
+		ServerURL:   a.serverURL,
+		VolumeID:    int64(a.r.rootDev),
+		MountPoint:  a.r.rootMount,
+		Started:     a.started,
+		Uptime:      time.Since(a.started),
+		OpenHandles: a.r.handles.load(),
+		LogLevel:    log.GetLevel().String(),
+	}, nil
+}
+
+func (a *adminServer) stats(*http.Request) (interface{}, error) {
+	r := a.r
+	st := &AdminStats{
+		OpenHandles:      r.handles.load(),
+		Caches:           map[string]CacheCounts{},
+		UnexpectedErrors: r.unexpected.load(),
+	}
+	for name, s := range r.cacheCounts() {
+		hits, misses := s.load()
+		st.Caches[name] = CacheCounts{Hits: hits, Misses: misses}
+	}
+	if r.blocks != nil {
+		r.blocks.mu.Lock()
+		st.BlockCacheBytes = r.blocks.used
+		r.blocks.mu.Unlock()
+	}
+	if r.writes != nil {
+		r.writes.mu.Lock()
+		st.WriteBufferBytes = r.writes.used
+		r.writes.mu.Unlock()
+	}
+	if rc, ok := r.con.(reconnectCounter); ok {
+		st.Reconnects = rc.reconnectCount()
+	}
+	return st, nil
+}
+
+// flush writes out what handles have buffered and drops cached
+// attributes, data read ahead and the block cache, so that changes made
+// to the volume elsewhere are seen. Data that cannot be written out fails
+// the request, after the caches are emptied all the same.
+func (a *adminServer) flush(req *http.Request) (interface{}, error) {
+	r := a.r
+	err := r.writes.flushAll(req.Context())
+	r.cache.purge()
+	r.reads.invalidateAll()
+	r.blocks.invalidateTree("/")
+	if err != nil {
+		return nil, fmt.Errorf("unable to write out buffered data: %v", err)
+	}
+	log.Infof("caches of %s flushed through the admin socket", r.rootMount)
+	return a.stats(req)
+}
+
+func (a *adminServer) logLevel(req *http.Request) (interface{}, error) {
+	level, err := log.ParseLevel(req.FormValue("level"))
+	if err != nil {
+		return nil, err
+	}
+	SetLogLevel(level)
+	log.Infof("log level set to %s through the admin socket", level)
+	return a.status(req)
+}
+
+func (a *adminServer) reconnect(req *http.Request) (interface{}, error) {
+	rc, ok := a.r.con.(reconnector)
+	if !ok {
+		return nil, errNoReconnect
+	}
+	log.Infof("reconnecting to the volume through the admin socket")
+	if err := rc.reconnect(req.Context()); err != nil {
+		return nil, err
+	}
+	return a.stats(req)
+}
+
+func (a *adminServer) doUnmount(req *http.Request) (interface{}, error) {
+	log.Infof("unmounting %s through the admin socket", a.r.rootMount)
+	if err := a.unmount(); err != nil {
+		return nil, err
+	}
+	return a.status(req)
+}
@@ -0,0 +1,300 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+)
+
+// adminRequest sends an admin request to the socket at path and decodes
+// the answer into v. It returns the HTTP status.
+func adminRequest(t *testing.T, path, method, req string, v interface{}) int {
+	t.Helper()
+	hr, err := http.NewRequest(method, "http://sdfs"+req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := unixClient(path).Do(hr)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, req, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading answer to %s %s: %v", method, req, err)
+	}
+	if resp.StatusCode == http.StatusOK && v != nil {
+		if err := json.Unmarshal(b, v); err != nil {
+			t.Fatalf("decoding answer to %s %s: %v", method, req, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// serveAdmin serves the admin socket of root in a new directory. The
+// returned function stops it and removes the directory.
+func serveAdmin(t *testing.T, root *sdfsRoot, unmount func() error) (string, func()) {
+	t.Helper()
+	dir := tempDir(t)
+	sock := filepath.Join(dir, "admin.sock")
+	c, err := ServeAdmin(root, sock, "sdfs://localhost:6442", unmount)
+	if err != nil {
+		t.Fatalf("ServeAdmin: %v", err)
+	}
+	return sock, func() {
+		c.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAdminStatus(t *testing.T) {
+	root, _ := newTestRoot(t)
+	sock, stop := serveAdmin(t, root, nil)
+	defer stop()
+	ctx := context.Background()
+	_, fh := create(t, &root.sdfsNode, "file")
+	defer fh.Release(ctx)
+
+	var st AdminStatus
+	if code := adminRequest(t, sock, http.MethodGet, "/status", &st); code != http.StatusOK {
+		t.Fatalf("status answered %d", code)
+	}
+	if st.ServerURL != "sdfs://localhost:6442" || st.MountPoint != "/mnt/sdfs-test" || st.OpenHandles != 1 {
+		t.Errorf("status %+v, want the server, the mount point and one handle", st)
+	}
+	if code := adminRequest(t, sock, http.MethodPost, "/status", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /status answered %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket has mode %o, want 0600", perm)
+	}
+}
+
+func TestAdminFlush(t *testing.T) {
+	root, mb := newTestRoot(t)
+	root.cache = newAttrCache(time.Minute, time.Minute)
+	root.writes = newWriteBuffers(64<<10, 1<<20)
+	sock, stop := serveAdmin(t, root, nil)
+	defer stop()
+	ctx := context.Background()
+	node, fh := create(t, &root.sdfsNode, "file")
+	defer fh.Release(ctx)
+	fh.Write(ctx, []byte("buffered"), 0)
+	fh.Flush(ctx)
+	fh.Write(ctx, []byte(" data"), 8)
+
+	// A change made to the volume elsewhere stays hidden by the cache.
+	var out fuse.AttrOut
+	node.Getattr(ctx, nil, &out)
+	if err := mb.Chmod(ctx, "/file", 0600); err != nil {
+		t.Fatal(err)
+	}
+	node.Getattr(ctx, nil, &out)
+	if out.Mode&0777 == 0600 {
+		t.Fatalf("the attribute cache is not in use")
+	}
+	var st AdminStats
+	if code := adminRequest(t, sock, http.MethodPost, "/flush", &st); code != http.StatusOK {
+		t.Fatalf("flush answered %d", code)
+	}
+	if st.WriteBufferBytes != 0 {
+		t.Errorf("%d bytes of write buffers held after the flush", st.WriteBufferBytes)
+	}
+	fi, err := mb.GetAttr(ctx, "/file")
+	if err != nil || fi.Size != int64(len("buffered data")) {
+		t.Errorf("after the flush the file has %v, %v, want the buffered data", fi, err)
+	}
+	node.Getattr(ctx, nil, &out)
+	if out.Mode&0777 != 0600 {
+		t.Errorf("after the flush the mode is %o, want the change made on the volume", out.Mode&0777)
+	}
+}
+
+func TestAdminFlushFailure(t *testing.T) {
+	root, mb := newTestRoot(t)
+	root.writes = newWriteBuffers(64<<10, 1<<20)
+	sock, stop := serveAdmin(t, root, nil)
+	defer stop()
+	ctx := context.Background()
+	_, fh := create(t, &root.sdfsNode, "file")
+	defer fh.Release(ctx)
+	fh.con = failingWrites{mb}
+	fh.Write(ctx, []byte("lost"), 0)
+
+	if code := adminRequest(t, sock, http.MethodPost, "/flush", nil); code != http.StatusConflict {
+		t.Errorf("flush losing data answered %d, want %d", code, http.StatusConflict)
+	}
+	if errno := fh.Flush(ctx); errno != syscall.EIO {
+		t.Errorf("Flush = %v, want the EIO to be reported to the handle too", errno)
+	}
+}
+
+func TestAdminSocketName(t *testing.T) {
+	for _, tc := range []struct {
+		mountPoint, want string
+	}{
+		{"/mnt/data", "mount-mnt-data.sock"},
+		{"/mnt/data/", "mount-mnt-data.sock"},
+		{"/srv/data", "mount-srv-data.sock"},
+		{"/mnt/my-data", `mount-mnt-my\x2ddata.sock`},
+		{"/mnt/my/data", "mount-mnt-my-data.sock"},
+		{"/mnt/.data", "mount-mnt-.data.sock"},
+		{"/", "mount--.sock"},
+	} {
+		if got := AdminSocket(tc.mountPoint); got != filepath.Join(AdminSocketDir, tc.want) {
+			t.Errorf("AdminSocket(%q) = %q, want %q", tc.mountPoint, got, tc.want)
+		}
+	}
+}
+
+func TestAdminSocketInUse(t *testing.T) {
+	root, _ := newTestRoot(t)
+	sock, stop := serveAdmin(t, root, nil)
+	defer stop()
+	if c, err := ServeAdmin(root, sock, "sdfs://other:6442", nil); err == nil {
+		c.Close()
+		t.Errorf("a second mount took over the admin socket in use")
+	}
+	var st AdminStatus
+	if code := adminRequest(t, sock, http.MethodGet, "/status", &st); code != http.StatusOK || st.ServerURL != "sdfs://localhost:6442" {
+		t.Errorf("status answered %d with %+v, want the first mount", code, st)
+	}
+
+	// A socket nobody listens on any more is replaced.
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	stale := filepath.Join(dir, "stale.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: stale, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetUnlinkOnClose(false)
+	l.Close()
+	c, err := ServeAdmin(root, stale, "sdfs://localhost:6442", nil)
+	if err != nil {
+		t.Fatalf("ServeAdmin over a stale socket: %v", err)
+	}
+	c.Close()
+
+	// Other files are not removed.
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := ServeAdmin(root, file, "sdfs://localhost:6442", nil); err == nil {
+		c.Close()
+		t.Errorf("ServeAdmin replaced a regular file")
+	}
+	if b, err := ioutil.ReadFile(file); err != nil || string(b) != "keep" {
+		t.Errorf("file holds %q, %v after ServeAdmin, want it kept", b, err)
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	root, _ := newTestRoot(t)
+	sock, stop := serveAdmin(t, root, nil)
+	defer stop()
+	defer SetLogLevel(log.GetLevel())
+
+	var st AdminStatus
+	if code := adminRequest(t, sock, http.MethodPost, "/log-level?level=debug", &st); code != http.StatusOK {
+		t.Fatalf("log-level answered %d", code)
+	}
+	if log.GetLevel() != log.DebugLevel || st.LogLevel != "debug" {
+		t.Errorf("log level %v, reported %q, want debug", log.GetLevel(), st.LogLevel)
+	}
+	if code := adminRequest(t, sock, http.MethodPost, "/log-level?level=chatty", nil); code != http.StatusConflict {
+		t.Errorf("unknown log level answered %d, want %d", code, http.StatusConflict)
+	}
+}
+
+func TestAdminReconnect(t *testing.T) {
+	root, o := newReconnectingRoot(t, 10*time.Second)
+	root.con = withTimeouts(root.con, time.Minute, time.Minute, time.Minute)
+	sock, stop := serveAdmin(t, root, nil)
+	defer stop()
+	ctx := context.Background()
+	_, fh := create(t, &root.sdfsNode, "file")
+	defer fh.Release(ctx)
+	fh.Write(ctx, []byte("hello"), 0)
+
+	var st AdminStats
+	if code := adminRequest(t, sock, http.MethodPost, "/reconnect", &st); code != http.StatusOK {
+		t.Fatalf("reconnect answered %d", code)
+	}
+	if st.Reconnects != 1 {
+		t.Errorf("%d reconnects reported, want 1", st.Reconnects)
+	}
+	o.mu.Lock()
+	dials, opens := o.dials, len(o.opens)
+	o.mu.Unlock()
+	if dials != 2 || opens != 2 {
+		t.Errorf("%d dials and %d opens, want a new connection with the handle reopened", dials, opens)
+	}
+	if got := readAll(t, fh, 0, 64); string(got) != "hello" {
+		t.Errorf("read %q after reconnecting, want %q", got, "hello")
+	}
+
+	plain, _ := newTestRoot(t)
+	sock, stop = serveAdmin(t, plain, nil)
+	defer stop()
+	if code := adminRequest(t, sock, http.MethodPost, "/reconnect", nil); code != http.StatusConflict {
+		t.Errorf("reconnect without reconnecting answered %d, want %d", code, http.StatusConflict)
+	}
+}
+
+func TestAdminUnmount(t *testing.T) {
+	root, _ := newTestRoot(t)
+	unmounted := 0
+	sock, stop := serveAdmin(t, root, func() error {
+		unmounted++
+		return nil
+	})
+	defer stop()
+	if code := adminRequest(t, sock, http.MethodGet, "/unmount", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /unmount answered %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+	if code := adminRequest(t, sock, http.MethodPost, "/unmount", nil); code != http.StatusOK {
+		t.Fatalf("unmount answered %d", code)
+	}
+	if unmounted != 1 {
+		t.Errorf("unmounted %d times, want once", unmounted)
+	}
+}
+
+func TestAdminClient(t *testing.T) {
+	root, _ := newTestRoot(t)
+	sock, stop := serveAdmin(t, root, nil)
+	defer stop()
+
+	c := &AdminClient{Socket: sock, Timeout: time.Minute}
+	var st AdminStatus
+	if err := c.Do(http.MethodGet, "/status", nil, &st); err != nil || st.MountPoint != "/mnt/sdfs-test" {
+		t.Errorf("status %+v, %v, want the mount point", st, err)
+	}
+	err := c.Do(http.MethodPost, "/reconnect", nil, nil)
+	if aerr, ok := err.(*AdminError); !ok || aerr.Status != http.StatusConflict || aerr.Message != errNoReconnect.Error() {
+		t.Errorf("refused reconnect = %#v, want an AdminError", err)
+	}
+	c.Socket = sock + ".missing"
+	if err := c.Do(http.MethodGet, "/status", nil, nil); err == nil {
+		t.Errorf("request to a missing socket succeeded")
+	} else if _, ok := err.(*AdminError); ok {
+		t.Errorf("request to a missing socket = %v, want a dial error", err)
+	}
+}
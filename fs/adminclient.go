@@ -0,0 +1,72 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// AdminClient sends admin requests to the socket of a mount, the requests
+// ServeAdmin answers.
+type AdminClient struct {
+	Socket  string
+	Timeout time.Duration
+}
+
+// AdminError is a request the mount answered but refused.
+type AdminError struct {
+	Status  int
+	Message string
+}
+
+func (e *AdminError) Error() string {
+	return e.Message
+}
+
+// Do sends a request, such as POST /flush, with the form values args and
+// decodes the answer into v, unless v is nil. Requests the mount refuses
+// fail with an *AdminError, any other error means it could not be asked.
+func (c *AdminClient) Do(method, req string, args url.Values, v interface{}) error {
+	hc := &http.Client{
+		Timeout: c.Timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", c.Socket)
+			},
+		},
+	}
+	u := "http://sdfs" + req
+	if len(args) > 0 {
+		u += "?" + args.Encode()
+	}
+	hr, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := hc.Do(hr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &AdminError{Status: resp.StatusCode, Message: strings.TrimSpace(string(b))}
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("unable to decode the answer to %s: %v", req, err)
+	}
+	return nil
+}
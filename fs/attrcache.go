@@ -0,0 +1,237 @@
+package fs
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	spb "github.com/opendedup/sdfs-client-go/api"
+	sapi "github.com/opendedup/sdfs-client-go/sdfs"
+)
+
+// maxCacheEntries bounds the number of paths an attrCache remembers.
+const maxCacheEntries = 1 << 17
+
+type statEntry struct {
+	fi      *sapi.Stat
+	expires time.Time
+}
+
+type infoEntry struct {
+	fi      *sapi.FileInfoResponse
+	expires time.Time
+}
+
+// attrCache is a per mount cache of GetAttr and Stat results keyed by
+// path. Entries that are missing on the server are cached for the
+// negative TTL. A nil *attrCache or a zero TTL caches nothing.
+type attrCache struct {
+	ttl    time.Duration
+	negTTL time.Duration
+
+	mu    sync.Mutex
+	stats map[string]statEntry
+	infos map[string]infoEntry
+	// gen changes on every invalidation, so that an answer that was in
+	// flight while a path changed is not cached.
+	gen uint64
+
+	counts cacheStats
+}
+
+func newAttrCache(ttl, negTTL time.Duration) *attrCache {
+	return &attrCache{
+		ttl:    ttl,
+		negTTL: negTTL,
+		stats:  make(map[string]statEntry),
+		infos:  make(map[string]infoEntry),
+	}
+}
+
+func (c *attrCache) enabled() bool {
+	return c != nil && (c.ttl > 0 || c.negTTL > 0)
+}
+
+// getAttr returns the attributes of path, from the cache when they have
+// not expired. When the server is asked, prev holds the attributes the
+// cache remembered from before, so callers can tell what changed.
+func (c *attrCache) getAttr(ctx context.Context, con Backend, path string) (fi *sapi.Stat, prev *sapi.Stat, err error) {
+	if !c.enabled() {
+		fi, err = con.GetAttr(ctx, path)
+		return fi, nil, err
+	}
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.stats[path]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		c.counts.hit()
+		if e.fi == nil {
+			return nil, nil, &spb.SdfsError{Err: "no such file " + path, ErrorCode: syscall.ENOENT}
+		}
+		return e.fi, nil, nil
+	}
+	c.counts.miss()
+	fi, err = c.fetchAttr(ctx, con, path)
+	return fi, e.fi, err
+}
+
+// fetchAttr asks the server for the attributes of path and caches the
+// answer.
+func (c *attrCache) fetchAttr(ctx context.Context, con Backend, path string) (*sapi.Stat, error) {
+	gen := c.generation()
+	fi, err := con.GetAttr(ctx, path)
+	if err != nil {
+		if ToErrno(err) == syscall.ENOENT {
+			c.putNegative(gen, path)
+		} else {
+			c.invalidate(path)
+		}
+		return nil, err
+	}
+	c.put(gen, path, fi)
+	return fi, nil
+}
+
+func (c *attrCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// stat returns the file info record of path, from the cache when it has
+// not expired.
+func (c *attrCache) stat(ctx context.Context, con Backend, path string) (*sapi.FileInfoResponse, error) {
+	if c == nil || c.ttl <= 0 {
+		return con.Stat(ctx, path)
+	}
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.infos[path]
+	gen := c.gen
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		c.counts.hit()
+		return e.fi, nil
+	}
+	c.counts.miss()
+	fi, err := con.Stat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.gen == gen {
+		c.trim()
+		c.infos[path] = infoEntry{fi: fi, expires: now.Add(c.ttl)}
+	}
+	c.mu.Unlock()
+	return fi, nil
+}
+
+// put stores attributes for path that were requested from the server
+// when the cache was at generation gen.
+func (c *attrCache) put(gen uint64, path string, fi *sapi.Stat) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return
+	}
+	c.trim()
+	c.stats[path] = statEntry{fi: fi, expires: time.Now().Add(c.ttl)}
+}
+
+// putNegative records that path did not exist at generation gen.
+func (c *attrCache) putNegative(gen uint64, path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.negTTL <= 0 || c.gen != gen {
+		delete(c.stats, path)
+		return
+	}
+	c.trim()
+	c.stats[path] = statEntry{expires: time.Now().Add(c.negTTL)}
+}
+
+// invalidate drops everything cached for paths.
+func (c *attrCache) invalidate(paths ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, p := range paths {
+		delete(c.stats, p)
+		delete(c.infos, p)
+	}
+}
+
+// invalidateTree drops everything cached for path and, when it is a
+// directory, for every path below it.
+func (c *attrCache) invalidateTree(path string) {
+	if c == nil {
+		return
+	}
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	delete(c.stats, path)
+	delete(c.infos, path)
+	for p := range c.stats {
+		if strings.HasPrefix(p, prefix) {
+			delete(c.stats, p)
+		}
+	}
+	for p := range c.infos {
+		if strings.HasPrefix(p, prefix) {
+			delete(c.infos, p)
+		}
+	}
+}
+
+// purge empties the cache.
+func (c *attrCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.stats = make(map[string]statEntry)
+	c.infos = make(map[string]infoEntry)
+}
+
+// trim keeps the cache below maxCacheEntries, first by dropping expired
+// entries and, failing that, by starting over. c.mu must be held.
+func (c *attrCache) trim() {
+	if len(c.stats)+len(c.infos) < maxCacheEntries {
+		return
+	}
+	now := time.Now()
+	for p, e := range c.stats {
+		if !now.Before(e.expires) {
+			delete(c.stats, p)
+		}
+	}
+	for p, e := range c.infos {
+		if !now.Before(e.expires) {
+			delete(c.infos, p)
+		}
+	}
+	if len(c.stats)+len(c.infos) >= maxCacheEntries {
+		c.stats = make(map[string]statEntry)
+		c.infos = make(map[string]infoEntry)
+	}
+}
@@ -0,0 +1,138 @@
+package fs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/opendedup/gofuse-sdfs/fs/sdfstest"
+	sapi "github.com/opendedup/sdfs-client-go/sdfs"
+)
+
+func TestAttrCacheTTL(t *testing.T) {
+	mb := sdfstest.NewMemBackend()
+	ctx := context.Background()
+	mb.MkNod(ctx, "/file", syscall.S_IFREG|0644, 0)
+	c := newAttrCache(50*time.Millisecond, 0)
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := c.getAttr(ctx, mb, "/file"); err != nil {
+			t.Fatalf("getAttr: %v", err)
+		}
+	}
+	if got := mb.Calls("GetAttr"); got != 1 {
+		t.Errorf("GetAttr called %d times, want 1", got)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	mb.Truncate(ctx, "/file", 10)
+	fi, prev, err := c.getAttr(ctx, mb, "/file")
+	if err != nil {
+		t.Fatalf("getAttr: %v", err)
+	}
+	if fi.Size != 10 || prev == nil || prev.Size != 0 {
+		t.Errorf("after expiry got size %d and previous %v", fi.Size, prev)
+	}
+}
+
+func TestAttrCacheDisabled(t *testing.T) {
+	mb := sdfstest.NewMemBackend()
+	ctx := context.Background()
+	c := newAttrCache(0, 0)
+	c.getAttr(ctx, mb, "/")
+	c.getAttr(ctx, mb, "/")
+	if got := mb.Calls("GetAttr"); got != 2 {
+		t.Errorf("GetAttr called %d times, want 2", got)
+	}
+}
+
+func TestAttrCacheNegative(t *testing.T) {
+	mb := sdfstest.NewMemBackend()
+	ctx := context.Background()
+	c := newAttrCache(time.Minute, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.getAttr(ctx, mb, "/missing"); ToErrno(err) != syscall.ENOENT {
+			t.Fatalf("getAttr(missing) = %v, want ENOENT", err)
+		}
+	}
+	if got := mb.Calls("GetAttr"); got != 1 {
+		t.Errorf("GetAttr called %d times, want 1", got)
+	}
+
+	mb.MkNod(ctx, "/missing", syscall.S_IFREG|0644, 0)
+	c.invalidate("/missing")
+	if _, _, err := c.getAttr(ctx, mb, "/missing"); err != nil {
+		t.Errorf("getAttr after invalidate: %v", err)
+	}
+}
+
+func TestAttrCacheInvalidateTree(t *testing.T) {
+	c := newAttrCache(time.Minute, 0)
+	gen := c.generation()
+	for _, p := range []string{"/a", "/a/b", "/a/b/c", "/ab"} {
+		c.put(gen, p, &sapi.Stat{})
+	}
+	c.invalidateTree("/a")
+	for p, want := range map[string]bool{"/a": false, "/a/b": false, "/a/b/c": false, "/ab": true} {
+		if _, ok := c.stats[p]; ok != want {
+			t.Errorf("%s cached = %v, want %v", p, ok, want)
+		}
+	}
+}
+
+func TestAttrCacheStaleAnswer(t *testing.T) {
+	c := newAttrCache(time.Minute, 0)
+	gen := c.generation()
+	c.invalidate("/file")
+	c.put(gen, "/file", &sapi.Stat{})
+	if _, ok := c.stats["/file"]; ok {
+		t.Errorf("answer requested before an invalidation was cached")
+	}
+}
+
+func TestNodeAttrCache(t *testing.T) {
+	root, mb := newTestRoot(t)
+	ctx := context.Background()
+	root.cache = newAttrCache(time.Minute, time.Minute)
+	n, fh := create(t, &root.sdfsNode, "file")
+	defer fh.Release(ctx)
+
+	mb.ResetCalls()
+	var out fuse.AttrOut
+	for i := 0; i < 3; i++ {
+		if errno := n.Getattr(ctx, nil, &out); errno != 0 {
+			t.Fatalf("Getattr: %v", errno)
+		}
+	}
+	if got := mb.Calls("GetAttr"); got != 0 {
+		t.Errorf("GetAttr called %d times after Create, want 0", got)
+	}
+
+	fh.Write(ctx, []byte("data"), 0)
+	if errno := n.Getattr(ctx, nil, &out); errno != 0 {
+		t.Fatalf("Getattr: %v", errno)
+	}
+	if out.Size != 4 {
+		t.Errorf("size after Write %d, want 4", out.Size)
+	}
+
+	var entry fuse.EntryOut
+	if _, errno := root.Lookup(ctx, "other", &entry); errno != syscall.ENOENT {
+		t.Fatalf("Lookup(other) = %v, want ENOENT", errno)
+	}
+	_, other := create(t, &root.sdfsNode, "other")
+	other.Release(ctx)
+	if _, errno := root.Lookup(ctx, "other", &entry); errno != 0 {
+		t.Errorf("Lookup after Create = %v", errno)
+	}
+
+	if errno := root.Unlink(ctx, "file"); errno != 0 {
+		t.Fatalf("Unlink: %v", errno)
+	}
+	if _, errno := root.Lookup(ctx, "file", &entry); errno != syscall.ENOENT {
+		t.Errorf("Lookup after Unlink = %v, want ENOENT", errno)
+	}
+}
@@ -0,0 +1,157 @@
+package fs
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	spb "github.com/opendedup/sdfs-client-go/api"
+	sapi "github.com/opendedup/sdfs-client-go/sdfs"
+)
+
+// Backend is the set of SDFS volume operations the filesystem relies on.
+// *spb.SdfsConnection implements it; other implementations can wrap,
+// fake or replace the transport.
+type Backend interface {
+	GetVolumeInfo(ctx context.Context) (*sapi.VolumeInfoResponse, error)
+	StatFS(ctx context.Context) (*sapi.StatFS, error)
+
+	GetAttr(ctx context.Context, path string) (*sapi.Stat, error)
+	Stat(ctx context.Context, path string) (*sapi.FileInfoResponse, error)
+	ListDir(ctx context.Context, path, marker string, compact bool, returnsize int32) (string, []*sapi.Stat, error)
+	ReadLink(ctx context.Context, path string) (string, error)
+
+	GetXAttr(ctx context.Context, name, path string) (string, error)
+	SetXAttr(ctx context.Context, name, value, path string) error
+	RemoveXAttr(ctx context.Context, name, path string) error
+
+	MkNod(ctx context.Context, path string, mode int32, rdev int32) error
+	MkDir(ctx context.Context, path string, mode int32) error
+	RmDir(ctx context.Context, path string) error
+	SymLink(ctx context.Context, src, dst string) error
+	DeleteFile(ctx context.Context, path string) error
+	Unlink(ctx context.Context, path string) error
+	Rename(ctx context.Context, src, dst string) error
+
+	Chown(ctx context.Context, path string, gid int32, uid int32) error
+	Chmod(ctx context.Context, path string, mode int32) error
+	Utime(ctx context.Context, path string, atime int64, mtime int64) error
+	Truncate(ctx context.Context, path string, length int64) error
+
+	Open(ctx context.Context, path string, flags int32) (int64, error)
+	Read(ctx context.Context, fd int64, offset int64, size int32) ([]byte, error)
+	Write(ctx context.Context, fd int64, data []byte, offset int64, length int32) error
+	Flush(ctx context.Context, path string, fd int64) error
+	Fsync(ctx context.Context, path string, fd int64) error
+	Release(ctx context.Context, fd int64) error
+	CopyExtent(ctx context.Context, src, dst string, srcStart, dstStart, len int64) (int64, error)
+}
+
+var _ = (Backend)((*spb.SdfsConnection)(nil))
+
+// FlagRenamer is implemented by backends that rename with renameat2(2)
+// flags. RENAME_NOREPLACE fails with EEXIST when dst exists and
+// RENAME_EXCHANGE atomically swaps src and dst, which must both exist.
+type FlagRenamer interface {
+	RenameWithFlags(ctx context.Context, src, dst string, flags uint32) error
+}
+
+// Locker is implemented by backends that keep fcntl and flock locks on
+// the server, so that every mount of a volume honors them. Owners are
+// only unique within a mount and the backend has to tell mounts apart.
+// GetLock returns the lock that conflicts with lk, or lk with Typ F_UNLCK
+// when there is none. SetLock fails with EAGAIN on a conflict, unless
+// wait is set, in which case it blocks until the lock is granted or ctx
+// is done.
+type Locker interface {
+	GetLock(ctx context.Context, path string, owner uint64, lk *fuse.FileLock, flock bool) (*fuse.FileLock, error)
+	SetLock(ctx context.Context, path string, owner uint64, lk *fuse.FileLock, flock, wait bool) error
+}
+
+// Allocator is implemented by backends that implement fallocate(2) on
+// the server. mode holds the FALLOC_FL flags. Punching a hole drops the
+// references the range held on deduplicated chunks.
+type Allocator interface {
+	Allocate(ctx context.Context, path string, offset, length int64, mode uint32) error
+}
+
+// Appender is implemented by backends that append on the server. Append
+// writes data at the end of the file open as fd in one step, whatever
+// other clients write at the same time, and returns the offset it landed
+// at.
+type Appender interface {
+	Append(ctx context.Context, fd int64, data []byte, length int32) (int64, error)
+}
+
+// wrapper is implemented by backends that add to a connection, such as
+// by tracing or bounding its requests. They implement every optional
+// interface by forwarding to the connection, which may lack it, so the
+// optional interfaces are looked up with asFlagRenamer and its siblings.
+type wrapper interface {
+	unwrap() Backend
+}
+
+// errNotSupported is returned by a wrapper asked for an optional operation
+// the connection underneath lacks.
+var errNotSupported = &spb.SdfsError{Err: "operation not supported by the volume", ErrorCode: syscall.EOPNOTSUPP}
+
+// innermost returns the connection under the wrappers of b.
+func innermost(b Backend) Backend {
+	for {
+		w, ok := b.(wrapper)
+		if !ok {
+			return b
+		}
+		b = w.unwrap()
+	}
+}
+
+// asFlagRenamer returns b as a FlagRenamer when the connection under its
+// wrappers is one.
+func asFlagRenamer(b Backend) (FlagRenamer, bool) {
+	if _, ok := innermost(b).(FlagRenamer); !ok {
+		return nil, false
+	}
+	fr, ok := b.(FlagRenamer)
+	return fr, ok
+}
+
+// asLocker returns b as a Locker when the connection under its wrappers
+// is one.
+func asLocker(b Backend) (Locker, bool) {
+	if _, ok := innermost(b).(Locker); !ok {
+		return nil, false
+	}
+	l, ok := b.(Locker)
+	return l, ok
+}
+
+// asAllocator returns b as an Allocator when the connection under its
+// wrappers is one.
+func asAllocator(b Backend) (Allocator, bool) {
+	if _, ok := innermost(b).(Allocator); !ok {
+		return nil, false
+	}
+	a, ok := b.(Allocator)
+	return a, ok
+}
+
+// asAppender returns b as an Appender when the connection under its
+// wrappers is one.
+func asAppender(b Backend) (Appender, bool) {
+	if _, ok := innermost(b).(Appender); !ok {
+		return nil, false
+	}
+	a, ok := b.(Appender)
+	return a, ok
+}
+
+// NewConnection dials the SDFS volume at root using the credentials and
+// client side dedupe settings in connectionInfo.
+func NewConnection(root string, connectionInfo ConnectionInfo) (*spb.SdfsConnection, error) {
+	spb.DisableTrust = connectionInfo.DisableTrust
+	spb.Password = connectionInfo.Pwd
+	spb.UserName = connectionInfo.User
+	return spb.NewConnection(root, connectionInfo.Dedupe, !connectionInfo.Nocompress,
+		connectionInfo.Volumeid, connectionInfo.Cachsize, connectionInfo.Cachage)
+}
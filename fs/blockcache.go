@@ -0,0 +1,523 @@
+package fs
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BlockCacheBlockSize is the unit file data is kept in by the block
+// cache and DefaultBlockCacheSize the default limit of a cache directory.
+const (
+	BlockCacheBlockSize   = 128 << 10
+	DefaultBlockCacheSize = 10 << 30
+)
+
+// blockMagic starts every block file, so that files of another format or
+// version are thrown away.
+var blockMagic = []byte("SDFSBLK1")
+
+// blockKey names a block of a file as it was at one modification time and
+// size. A file that changes on the server gets new keys, so stale blocks
+// are never found and age out.
+type blockKey struct {
+	path  string
+	mtime int64
+	size  int64
+	block int64
+}
+
+func (k blockKey) name() string {
+	h := sha256.New()
+	h.Write([]byte(k.path))
+	var b [24]byte
+	binary.LittleEndian.PutUint64(b[0:], uint64(k.mtime))
+	binary.LittleEndian.PutUint64(b[8:], uint64(k.size))
+	binary.LittleEndian.PutUint64(b[16:], uint64(k.block))
+	h.Write(b[:])
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type blockEntry struct {
+	name string
+	key  blockKey
+	size int64
+	elem *list.Element
+}
+
+// blockCache keeps file data blocks in a local directory, such as on an
+// SSD, across mounts. Each block is a file that carries its own key,
+// length and checksum. It is written under a temporary name and renamed
+// into place, and a block a crash cut short or damaged is discarded when
+// the cache is opened or the block is read. The index of the blocks is
+// rebuilt from the files when the cache is opened. The least recently
+// used blocks are evicted to stay below the size limit.
+type blockCache struct {
+	dir   string
+	limit int64
+
+	mu     sync.Mutex
+	used   int64
+	lru    *list.List
+	byName map[string]*blockEntry
+	byPath map[string]map[string]*blockEntry
+	// pending holds the paths blocks are being stored for, so that
+	// invalidating a path also drops the blocks still on their way.
+	pending map[string]*pendingBlocks
+
+	// writers bounds the runs of blocks stored at once and writing
+	// counts them.
+	writers chan struct{}
+	writing sync.WaitGroup
+
+	counts cacheStats
+}
+
+// blockWriters is the most runs of blocks a cache stores at once. Blocks
+// read while all are busy are not cached.
+const blockWriters = 4
+
+type pendingBlocks struct {
+	stores int
+	gen    uint64
+}
+
+// openBlockCache opens, creating it when needed, the cache in dir.
+func openBlockCache(dir string, limit int64) (*blockCache, error) {
+	if limit <= 0 {
+		limit = DefaultBlockCacheSize
+	}
+	c := &blockCache{
+		dir:     dir,
+		limit:   limit,
+		lru:     list.New(),
+		byName:  make(map[string]*blockEntry),
+		byPath:  make(map[string]map[string]*blockEntry),
+		pending: make(map[string]*pendingBlocks),
+		writers: make(chan struct{}, blockWriters),
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// load indexes the blocks in the cache directory, oldest first, and
+// removes what is left of interrupted writes and damaged blocks.
+func (c *blockCache) load() error {
+	type found struct {
+		name  string
+		key   blockKey
+		size  int64
+		mtime int64
+	}
+	var blocks []found
+	err := filepath.Walk(c.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name := filepath.Base(p)
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(p)
+			return nil
+		}
+		key, err := readBlockKey(p)
+		if err != nil || key.name() != name {
+			log.Debugf("removing damaged cache block %s %v", p, err)
+			os.Remove(p)
+			return nil
+		}
+		blocks = append(blocks, found{name: name, key: key, size: info.Size(), mtime: info.ModTime().UnixNano()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].mtime < blocks[j].mtime })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, b := range blocks {
+		c.add(b.name, b.key, b.size)
+	}
+	return nil
+}
+
+func (c *blockCache) file(name string) string {
+	return filepath.Join(c.dir, name[:2], name)
+}
+
+// add puts a block in the index as the most recently used one. c.mu must
+// be held.
+func (c *blockCache) add(name string, key blockKey, size int64) {
+	if e, ok := c.byName[name]; ok {
+		c.lru.MoveToFront(e.elem)
+		return
+	}
+	e := &blockEntry{name: name, key: key, size: size}
+	e.elem = c.lru.PushFront(e)
+	c.byName[name] = e
+	if c.byPath[key.path] == nil {
+		c.byPath[key.path] = make(map[string]*blockEntry)
+	}
+	c.byPath[key.path][name] = e
+	c.used += size
+}
+
+// remove drops a block from the index and the disk. c.mu must be held.
+func (c *blockCache) remove(e *blockEntry) {
+	c.lru.Remove(e.elem)
+	delete(c.byName, e.name)
+	delete(c.byPath[e.key.path], e.name)
+	if len(c.byPath[e.key.path]) == 0 {
+		delete(c.byPath, e.key.path)
+	}
+	c.used -= e.size
+	os.Remove(c.file(e.name))
+}
+
+// evict removes the least recently used blocks until the cache is below
+// its limit. c.mu must be held.
+func (c *blockCache) evict() {
+	for c.used > c.limit {
+		e := c.lru.Back().Value.(*blockEntry)
+		c.remove(e)
+	}
+}
+
+// get returns the data of the block, or false when it is not cached.
+func (c *blockCache) get(key blockKey) ([]byte, bool) {
+	name := key.name()
+	c.mu.Lock()
+	e, ok := c.byName[name]
+	if ok {
+		c.lru.MoveToFront(e.elem)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	b, err := ioutil.ReadFile(c.file(name))
+	if err == nil {
+		var data []byte
+		data, err = decodeBlock(b, key)
+		if err == nil {
+			return data, true
+		}
+	}
+	log.Debugf("dropping unreadable cache block %s %v", name, err)
+	c.mu.Lock()
+	if e, ok := c.byName[name]; ok {
+		c.remove(e)
+	}
+	c.mu.Unlock()
+	return nil, false
+}
+
+// put stores the data of a block. gen is what store got for the path of
+// the block, and the block is dropped when the path was invalidated
+// since.
+func (c *blockCache) put(key blockKey, data []byte, gen uint64) {
+	name := key.name()
+	p := c.file(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		log.Debugf("unable to cache block %s %v", name, err)
+		return
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), name+".*.tmp")
+	if err != nil {
+		log.Debugf("unable to cache block %s %v", name, err)
+		return
+	}
+	b := encodeBlock(key, data)
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		log.Debugf("unable to cache block %s %v", name, err)
+		os.Remove(f.Name())
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pb, ok := c.pending[key.path]; ok && pb.gen != gen {
+		// The rename may have replaced a block of the same name.
+		if e, ok := c.byName[name]; ok {
+			c.remove(e)
+		} else {
+			os.Remove(p)
+		}
+		return
+	}
+	c.add(name, key, int64(len(b)))
+	c.evict()
+}
+
+type cachedBlock struct {
+	key  blockKey
+	data []byte
+}
+
+// store puts blocks of the file path in the cache in the background, so
+// that reads do not wait for the disk. The blocks are dropped when the
+// cache is busy.
+func (c *blockCache) store(path string, blocks []cachedBlock) {
+	if len(blocks) == 0 {
+		return
+	}
+	select {
+	case c.writers <- struct{}{}:
+	default:
+		return
+	}
+	c.mu.Lock()
+	pb, ok := c.pending[path]
+	if !ok {
+		pb = &pendingBlocks{}
+		c.pending[path] = pb
+	}
+	pb.stores++
+	gen := pb.gen
+	c.mu.Unlock()
+
+	c.writing.Add(1)
+	go func() {
+		defer c.writing.Done()
+		for _, b := range blocks {
+			c.put(b.key, b.data, gen)
+		}
+		c.mu.Lock()
+		if pb.stores--; pb.stores == 0 {
+			delete(c.pending, path)
+		}
+		c.mu.Unlock()
+		<-c.writers
+	}()
+}
+
+// invalidate drops every block of the file path.
+func (c *blockCache) invalidate(path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pb, ok := c.pending[path]; ok {
+		pb.gen++
+	}
+	for _, e := range c.byPath[path] {
+		c.remove(e)
+	}
+}
+
+// invalidateTree drops every block of path and, when it is a directory,
+// of the files below it.
+func (c *blockCache) invalidateTree(path string) {
+	if c == nil {
+		return
+	}
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for p, pb := range c.pending {
+		if p == path || strings.HasPrefix(p, prefix) {
+			pb.gen++
+		}
+	}
+	for p, es := range c.byPath {
+		if p != path && !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		for _, e := range es {
+			c.remove(e)
+		}
+	}
+}
+
+// read returns size bytes of the file open as fd at off, which is at
+// modification time mtime and size fsize, taking whole blocks from the
+// cache or, in one read per run of missing blocks, from con.
+func (c *blockCache) read(ctx context.Context, con Backend, fd int64, path string, mtime, fsize, off int64, size int32) ([]byte, error) {
+	if off >= fsize {
+		return []byte{}, nil
+	}
+	end := off + int64(size)
+	if end > fsize {
+		end = fsize
+	}
+	first := off / BlockCacheBlockSize
+	last := (end - 1) / BlockCacheBlockSize
+	blocks := make([][]byte, last-first+1)
+	var fetched []cachedBlock
+	for b := first; b <= last; {
+		if data, ok := c.get(blockKey{path, mtime, fsize, b}); ok {
+			c.counts.hit()
+			blocks[b-first] = data
+			b++
+			continue
+		}
+		run := b + 1
+		for run <= last && !c.has(blockKey{path, mtime, fsize, run}) {
+			run++
+		}
+		for i := b; i < run; i++ {
+			c.counts.miss()
+		}
+		data, err := con.Read(ctx, fd, b*BlockCacheBlockSize, int32((run-b)*BlockCacheBlockSize))
+		if err != nil {
+			return nil, err
+		}
+		for i := b; i < run; i++ {
+			s := (i - b) * BlockCacheBlockSize
+			if s >= int64(len(data)) {
+				break
+			}
+			e := s + BlockCacheBlockSize
+			if e > int64(len(data)) {
+				e = int64(len(data))
+			}
+			blocks[i-first] = data[s:e]
+			// A short block is only complete at the end of the file.
+			if e-s == BlockCacheBlockSize || i*BlockCacheBlockSize+e-s == fsize {
+				fetched = append(fetched, cachedBlock{blockKey{path, mtime, fsize, i}, data[s:e]})
+			}
+		}
+		b = run
+	}
+	c.store(path, fetched)
+
+	out := make([]byte, 0, end-off)
+	for i, data := range blocks {
+		bstart := (first + int64(i)) * BlockCacheBlockSize
+		s := int64(0)
+		if off > bstart {
+			s = off - bstart
+		}
+		e := int64(len(data))
+		if end-bstart < e {
+			e = end - bstart
+		}
+		if s >= e {
+			break
+		}
+		out = append(out, data[s:e]...)
+		if int64(len(data)) < BlockCacheBlockSize {
+			break
+		}
+	}
+	return out, nil
+}
+
+// has reports whether the block is in the index.
+func (c *blockCache) has(key blockKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.byName[key.name()]
+	return ok
+}
+
+// encodeBlock lays out a block file: the magic, the key, the length and
+// checksum of the data, and the data.
+func encodeBlock(key blockKey, data []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(blockMagic)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(key.path)))
+	buf.WriteString(key.path)
+	binary.Write(&buf, binary.LittleEndian, []int64{key.mtime, key.size, key.block})
+	binary.Write(&buf, binary.LittleEndian, []uint32{uint32(len(data)), crc32.ChecksumIEEE(data)})
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+var errBadBlock = errors.New("bad cache block")
+
+// decodeHeader parses the start of a block file and returns the key and
+// the rest of the file after the checksum.
+func decodeHeader(b []byte) (blockKey, uint32, uint32, []byte, error) {
+	var key blockKey
+	if !bytes.HasPrefix(b, blockMagic) {
+		return key, 0, 0, nil, errBadBlock
+	}
+	b = b[len(blockMagic):]
+	if len(b) < 4 {
+		return key, 0, 0, nil, errBadBlock
+	}
+	n := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	if uint64(len(b)) < uint64(n)+32 {
+		return key, 0, 0, nil, errBadBlock
+	}
+	key.path = string(b[:n])
+	b = b[n:]
+	key.mtime = int64(binary.LittleEndian.Uint64(b))
+	key.size = int64(binary.LittleEndian.Uint64(b[8:]))
+	key.block = int64(binary.LittleEndian.Uint64(b[16:]))
+	length := binary.LittleEndian.Uint32(b[24:])
+	sum := binary.LittleEndian.Uint32(b[28:])
+	return key, length, sum, b[32:], nil
+}
+
+func decodeBlock(b []byte, want blockKey) ([]byte, error) {
+	key, length, sum, data, err := decodeHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	if key != want || uint32(len(data)) != length || crc32.ChecksumIEEE(data) != sum {
+		return nil, errBadBlock
+	}
+	return data, nil
+}
+
+// maxBlockHeader bounds the header of a block file, which holds a path.
+const maxBlockHeader = 8 + 4 + 4096 + 32
+
+// readBlockKey returns the key of the block file p after checking that it
+// has the length its header promises. The checksum is only checked when
+// the block is read.
+func readBlockKey(p string) (blockKey, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return blockKey{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return blockKey{}, err
+	}
+	b := make([]byte, maxBlockHeader)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return blockKey{}, err
+	}
+	key, length, _, data, err := decodeHeader(b[:n])
+	if err != nil {
+		return key, err
+	}
+	if info.Size() != int64(n-len(data))+int64(length) {
+		return key, errBadBlock
+	}
+	return key, nil
+}
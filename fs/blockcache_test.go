@@ -0,0 +1,185 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ffs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/opendedup/gofuse-sdfs/fs/sdfstest"
+)
+
+// newCachedRoot mounts mb again with a block cache in dir.
+func newCachedRoot(t *testing.T, mb *sdfstest.MemBackend, dir string, limit int64) *sdfsRoot {
+	t.Helper()
+	r, err := NewsdfsRoot(mb, ConnectionInfo{MountPath: "/mnt/sdfs-test", BlockCacheDir: dir, BlockCacheSize: limit})
+	if err != nil {
+		t.Fatalf("NewsdfsRoot: %v", err)
+	}
+	root := r.(*sdfsRoot)
+	ffs.NewNodeFS(root, &ffs.Options{})
+	return root
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "sdfs-blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestBlockCacheSurvivesRemount(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	root, mb := newTestRoot(t)
+	ctx := context.Background()
+	data, fh := newReadAheadFile(t, root, "file", 3*BlockCacheBlockSize+100)
+	fh.Release(ctx)
+
+	for i := 0; i < 2; i++ {
+		root := newCachedRoot(t, mb, dir, 0)
+		fh := lookupOpen(t, root, "file")
+		mb.ResetCalls()
+		if got := readAll(t, fh, 0, len(data)+10); !bytes.Equal(got, data) {
+			t.Fatalf("mount %d: read wrong data", i)
+		}
+		// Blocks are stored in the background.
+		root.blocks.writing.Wait()
+		if got := readAll(t, fh, BlockCacheBlockSize+10, 20); !bytes.Equal(got, data[BlockCacheBlockSize+10:BlockCacheBlockSize+30]) {
+			t.Errorf("mount %d: unaligned read returned wrong data", i)
+		}
+		want := 1
+		if i > 0 {
+			want = 0
+		}
+		if got := mb.Calls("Read"); got != want {
+			t.Errorf("mount %d: %d reads reached the server, want %d", i, got, want)
+		}
+		fh.Release(ctx)
+	}
+}
+
+func TestBlockCacheInvalidatedByWrite(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	_, mb := newTestRoot(t)
+	root := newCachedRoot(t, mb, dir, 0)
+	ctx := context.Background()
+	_, fh := newReadAheadFile(t, root, "file", BlockCacheBlockSize)
+	defer fh.Release(ctx)
+
+	readAll(t, fh, 0, 16)
+	fh.Write(ctx, []byte("changed"), 0)
+	if got := readAll(t, fh, 0, 7); string(got) != "changed" {
+		t.Errorf("read %q after a write, want changed", got)
+	}
+}
+
+func TestBlockCacheInvalidateTree(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c, err := openBlockCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]blockKey{}
+	for _, p := range []string{"/dir", "/dir/a", "/dir/sub/b", "/dirx/c"} {
+		keys[p] = blockKey{p, 1, 10, 0}
+		c.put(keys[p], []byte("0123456789"), 0)
+	}
+	cached := func(p string) bool {
+		_, ok := c.get(keys[p])
+		return ok
+	}
+
+	c.invalidate("/dir")
+	if cached("/dir") || !cached("/dir/a") {
+		t.Errorf("invalidating a file dropped %v, %v of /dir and /dir/a, want only /dir", !cached("/dir"), !cached("/dir/a"))
+	}
+	c.invalidateTree("/dir")
+	if cached("/dir/a") || cached("/dir/sub/b") {
+		t.Error("blocks below a renamed directory are still cached")
+	}
+	if !cached("/dirx/c") {
+		t.Error("block of a sibling sharing the prefix was dropped")
+	}
+}
+
+func TestBlockCacheDropsInvalidatedStores(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c, err := openBlockCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := blockKey{"/file", 1, 10, 0}
+	// A store read the block before a write invalidated the file.
+	c.pending["/file"] = &pendingBlocks{stores: 1}
+	c.invalidate("/file")
+	c.put(key, []byte("0123456789"), 0)
+	if _, ok := c.get(key); ok {
+		t.Error("block read before the invalidation was cached")
+	}
+	if _, err := os.Stat(c.file(key.name())); !os.IsNotExist(err) {
+		t.Errorf("block file left behind: %v", err)
+	}
+}
+
+func TestBlockCacheEviction(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c, err := openBlockCache(dir, 3*BlockCacheBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := bytes.Repeat([]byte{'x'}, BlockCacheBlockSize)
+	for i := int64(0); i < 8; i++ {
+		c.put(blockKey{"/file", 1, 8 * BlockCacheBlockSize, i}, block, 0)
+	}
+	if c.used > c.limit {
+		t.Errorf("cache holds %d bytes, limit %d", c.used, c.limit)
+	}
+	if _, ok := c.get(blockKey{"/file", 1, 8 * BlockCacheBlockSize, 0}); ok {
+		t.Error("least recently used block still cached")
+	}
+	if _, ok := c.get(blockKey{"/file", 1, 8 * BlockCacheBlockSize, 7}); !ok {
+		t.Error("most recent block evicted")
+	}
+}
+
+func TestBlockCacheDiscardsDamage(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c, err := openBlockCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := blockKey{"/a", 1, 10, 0}
+	torn := blockKey{"/b", 1, 10, 0}
+	c.put(good, []byte("0123456789"), 0)
+	c.put(torn, []byte("0123456789"), 0)
+	// A block cut short and a write that never got renamed into place.
+	p := c.file(torn.name())
+	b, _ := ioutil.ReadFile(p)
+	ioutil.WriteFile(p, b[:len(b)-3], 0600)
+	ioutil.WriteFile(filepath.Join(dir, "leftover.tmp"), []byte("x"), 0600)
+
+	c, err = openBlockCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := c.get(good); !ok || string(data) != "0123456789" {
+		t.Errorf("intact block = %q, %v", data, ok)
+	}
+	if _, ok := c.get(torn); ok {
+		t.Error("torn block was loaded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "leftover.tmp")); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
@@ -0,0 +1,298 @@
+package fs
+
+import (
+	"context"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	sapi "github.com/opendedup/sdfs-client-go/sdfs"
+)
+
+// DefaultMetadataTimeout, DefaultDataTimeout and DefaultFsyncTimeout bound
+// how long a single metadata, data or fsync request to the volume may
+// take.
+const (
+	DefaultMetadataTimeout = 30 * time.Second
+	DefaultDataTimeout     = 2 * time.Minute
+	DefaultFsyncTimeout    = 5 * time.Minute
+)
+
+// detached is a context that keeps the values of its parent but is never
+// done, for work that must finish even when the request that started it
+// is interrupted.
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+// uninterruptible returns ctx without its deadline and cancellation.
+// Data already acknowledged to an application is written with it, as is
+// the release of a descriptor on the server.
+func uninterruptible(ctx context.Context) context.Context {
+	return detached{ctx}
+}
+
+// timeoutBackend puts a deadline on every request to the volume, chosen by
+// the class of the request. A zero timeout leaves that class unbounded.
+type timeoutBackend struct {
+	con      Backend
+	metadata time.Duration
+	data     time.Duration
+	fsync    time.Duration
+}
+
+var _ = (Backend)((*timeoutBackend)(nil))
+var _ = (wrapper)((*timeoutBackend)(nil))
+
+// withTimeouts returns con with deadlines for metadata, data and fsync
+// requests, or con itself when none is set.
+func withTimeouts(con Backend, metadata, data, fsync time.Duration) Backend {
+	if metadata <= 0 && data <= 0 && fsync <= 0 {
+		return con
+	}
+	return &timeoutBackend{con: con, metadata: metadata, data: data, fsync: fsync}
+}
+
+func (t *timeoutBackend) unwrap() Backend {
+	return t.con
+}
+
+func (t *timeoutBackend) reconnectCount() uint64 {
+	if rc, ok := t.con.(reconnectCounter); ok {
+		return rc.reconnectCount()
+	}
+	return 0
+}
+
+func (t *timeoutBackend) reconnect(ctx context.Context) error {
+	if rc, ok := t.con.(reconnector); ok {
+		return rc.reconnect(ctx)
+	}
+	return errNoReconnect
+}
+
+func within(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+func (t *timeoutBackend) GetVolumeInfo(ctx context.Context) (*sapi.VolumeInfoResponse, error) {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.GetVolumeInfo(ctx)
+}
+
+func (t *timeoutBackend) StatFS(ctx context.Context) (*sapi.StatFS, error) {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.StatFS(ctx)
+}
+
+func (t *timeoutBackend) GetAttr(ctx context.Context, path string) (*sapi.Stat, error) {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.GetAttr(ctx, path)
+}
+
+func (t *timeoutBackend) Stat(ctx context.Context, path string) (*sapi.FileInfoResponse, error) {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.Stat(ctx, path)
+}
+
+func (t *timeoutBackend) ListDir(ctx context.Context, path, marker string, compact bool, returnsize int32) (string, []*sapi.Stat, error) {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.ListDir(ctx, path, marker, compact, returnsize)
+}
+
+func (t *timeoutBackend) ReadLink(ctx context.Context, path string) (string, error) {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.ReadLink(ctx, path)
+}
+
+func (t *timeoutBackend) GetXAttr(ctx context.Context, name, path string) (string, error) {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.GetXAttr(ctx, name, path)
+}
+
+func (t *timeoutBackend) SetXAttr(ctx context.Context, name, value, path string) error {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.SetXAttr(ctx, name, value, path)
+}
+
+func (t *timeoutBackend) RemoveXAttr(ctx context.Context, name, path string) error {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.RemoveXAttr(ctx, name, path)
+}
+
+func (t *timeoutBackend) MkNod(ctx context.Context, path string, mode int32, rdev int32) error {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.MkNod(ctx, path, mode, rdev)
+}
+
+func (t *timeoutBackend) MkDir(ctx context.Context, path string, mode int32) error {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.MkDir(ctx, path, mode)
+}
+
+func (t *timeoutBackend) RmDir(ctx context.Context, path string) error {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.RmDir(ctx, path)
+}
+
+func (t *timeoutBackend) SymLink(ctx context.Context, src, dst string) error {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.SymLink(ctx, src, dst)
+}
+
+func (t *timeoutBackend) DeleteFile(ctx context.Context, path string) error {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.DeleteFile(ctx, path)
+}
+
+func (t *timeoutBackend) Unlink(ctx context.Context, path string) error {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.Unlink(ctx, path)
+}
+
+func (t *timeoutBackend) Rename(ctx context.Context, src, dst string) error {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.Rename(ctx, src, dst)
+}
+
+func (t *timeoutBackend) Chown(ctx context.Context, path string, gid int32, uid int32) error {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.Chown(ctx, path, gid, uid)
+}
+
+func (t *timeoutBackend) Chmod(ctx context.Context, path string, mode int32) error {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.Chmod(ctx, path, mode)
+}
+
+func (t *timeoutBackend) Utime(ctx context.Context, path string, atime int64, mtime int64) error {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.Utime(ctx, path, atime, mtime)
+}
+
+func (t *timeoutBackend) Truncate(ctx context.Context, path string, length int64) error {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.Truncate(ctx, path, length)
+}
+
+func (t *timeoutBackend) Open(ctx context.Context, path string, flags int32) (int64, error) {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.Open(ctx, path, flags)
+}
+
+func (t *timeoutBackend) Read(ctx context.Context, fd int64, offset int64, size int32) ([]byte, error) {
+	ctx, cancel := within(ctx, t.data)
+	defer cancel()
+	return t.con.Read(ctx, fd, offset, size)
+}
+
+func (t *timeoutBackend) Write(ctx context.Context, fd int64, data []byte, offset int64, length int32) error {
+	ctx, cancel := within(ctx, t.data)
+	defer cancel()
+	return t.con.Write(ctx, fd, data, offset, length)
+}
+
+func (t *timeoutBackend) Flush(ctx context.Context, path string, fd int64) error {
+	ctx, cancel := within(ctx, t.fsync)
+	defer cancel()
+	return t.con.Flush(ctx, path, fd)
+}
+
+func (t *timeoutBackend) Fsync(ctx context.Context, path string, fd int64) error {
+	ctx, cancel := within(ctx, t.fsync)
+	defer cancel()
+	return t.con.Fsync(ctx, path, fd)
+}
+
+func (t *timeoutBackend) Release(ctx context.Context, fd int64) error {
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return t.con.Release(ctx, fd)
+}
+
+func (t *timeoutBackend) CopyExtent(ctx context.Context, src, dst string, srcStart, dstStart, length int64) (int64, error) {
+	ctx, cancel := within(ctx, t.data)
+	defer cancel()
+	return t.con.CopyExtent(ctx, src, dst, srcStart, dstStart, length)
+}
+
+func (t *timeoutBackend) RenameWithFlags(ctx context.Context, src, dst string, flags uint32) error {
+	fr, ok := t.con.(FlagRenamer)
+	if !ok {
+		return errNotSupported
+	}
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return fr.RenameWithFlags(ctx, src, dst, flags)
+}
+
+func (t *timeoutBackend) GetLock(ctx context.Context, path string, owner uint64, lk *fuse.FileLock, flock bool) (*fuse.FileLock, error) {
+	l, ok := t.con.(Locker)
+	if !ok {
+		return nil, errNotSupported
+	}
+	ctx, cancel := within(ctx, t.metadata)
+	defer cancel()
+	return l.GetLock(ctx, path, owner, lk, flock)
+}
+
+// SetLock waits for a lock for as long as the caller does.
+func (t *timeoutBackend) SetLock(ctx context.Context, path string, owner uint64, lk *fuse.FileLock, flock, wait bool) error {
+	l, ok := t.con.(Locker)
+	if !ok {
+		return errNotSupported
+	}
+	if !wait {
+		var cancel context.CancelFunc
+		ctx, cancel = within(ctx, t.metadata)
+		defer cancel()
+	}
+	return l.SetLock(ctx, path, owner, lk, flock, wait)
+}
+
+func (t *timeoutBackend) Allocate(ctx context.Context, path string, offset, length int64, mode uint32) error {
+	a, ok := t.con.(Allocator)
+	if !ok {
+		return errNotSupported
+	}
+	ctx, cancel := within(ctx, t.data)
+	defer cancel()
+	return a.Allocate(ctx, path, offset, length, mode)
+}
+
+func (t *timeoutBackend) Append(ctx context.Context, fd int64, data []byte, length int32) (int64, error) {
+	a, ok := t.con.(Appender)
+	if !ok {
+		return 0, errNotSupported
+	}
+	ctx, cancel := within(ctx, t.data)
+	defer cancel()
+	return a.Append(ctx, fd, data, length)
+}
@@ -0,0 +1,153 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/opendedup/gofuse-sdfs/fs/sdfstest"
+	sapi "github.com/opendedup/sdfs-client-go/sdfs"
+)
+
+// ctxBackend honors contexts as a remote volume does: requests fail once
+// their context is done, and with stall set they only end that way.
+type ctxBackend struct {
+	Backend
+	stall bool
+}
+
+func (b ctxBackend) wait(ctx context.Context) error {
+	if b.stall {
+		<-ctx.Done()
+	}
+	return ctx.Err()
+}
+
+func (b ctxBackend) GetAttr(ctx context.Context, path string) (*sapi.Stat, error) {
+	if err := b.wait(ctx); err != nil {
+		return nil, err
+	}
+	return b.Backend.GetAttr(ctx, path)
+}
+
+func (b ctxBackend) ListDir(ctx context.Context, path, marker string, compact bool, returnsize int32) (string, []*sapi.Stat, error) {
+	if err := b.wait(ctx); err != nil {
+		return "", nil, err
+	}
+	return b.Backend.ListDir(ctx, path, marker, compact, returnsize)
+}
+
+func (b ctxBackend) Read(ctx context.Context, fd int64, offset int64, size int32) ([]byte, error) {
+	if err := b.wait(ctx); err != nil {
+		return nil, err
+	}
+	return b.Backend.Read(ctx, fd, offset, size)
+}
+
+func (b ctxBackend) Write(ctx context.Context, fd int64, data []byte, offset int64, length int32) error {
+	if err := b.wait(ctx); err != nil {
+		return err
+	}
+	return b.Backend.Write(ctx, fd, data, offset, length)
+}
+
+func (b ctxBackend) Fsync(ctx context.Context, path string, fd int64) error {
+	if err := b.wait(ctx); err != nil {
+		return err
+	}
+	return b.Backend.Fsync(ctx, path, fd)
+}
+
+func TestTimeoutsByClass(t *testing.T) {
+	con := withTimeouts(ctxBackend{sdfstest.NewMemBackend(), true}, 20*time.Millisecond, 100*time.Millisecond, 300*time.Millisecond)
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name    string
+		op      func() error
+		timeout time.Duration
+	}{
+		{"GetAttr", func() error { _, err := con.GetAttr(ctx, "/"); return err }, 20 * time.Millisecond},
+		{"Read", func() error { _, err := con.Read(ctx, 1, 0, 10); return err }, 100 * time.Millisecond},
+		{"Fsync", func() error { return con.Fsync(ctx, "/", 1) }, 300 * time.Millisecond},
+	} {
+		start := time.Now()
+		err := tc.op()
+		d := time.Since(start)
+		if ToErrno(err) != syscall.ETIMEDOUT {
+			t.Errorf("%s = %v, want ETIMEDOUT", tc.name, err)
+		}
+		if d < tc.timeout || d > tc.timeout+time.Second {
+			t.Errorf("%s timed out after %v, want %v", tc.name, d, tc.timeout)
+		}
+	}
+
+	mb := sdfstest.NewMemBackend()
+	if got := withTimeouts(mb, 0, 0, 0); got != Backend(mb) {
+		t.Errorf("withTimeouts without timeouts wrapped the backend")
+	}
+}
+
+func TestReadInterrupted(t *testing.T) {
+	root, mb := newTestRoot(t)
+	_, fh := create(t, &root.sdfsNode, "file")
+	defer fh.Release(context.Background())
+	fh.con = ctxBackend{mb, true}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, errno := fh.Read(ctx, make([]byte, 10), 0); errno != syscall.EINTR {
+		t.Errorf("interrupted Read = %v, want EINTR", errno)
+	}
+}
+
+func TestInterruptedFlushKeepsBufferedWrites(t *testing.T) {
+	root, mb := newTestRoot(t)
+	root.writes = newWriteBuffers(64<<10, 1<<20)
+	_, fh := create(t, &root.sdfsNode, "file")
+	fh.con = ctxBackend{mb, false}
+	if _, errno := fh.Write(context.Background(), []byte("acknowledged"), 0); errno != 0 {
+		t.Fatalf("Write: %v", errno)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	fh.Flush(ctx)
+	if errno := fh.Release(ctx); errno != 0 {
+		t.Errorf("interrupted Release = %v, want the descriptor closed", errno)
+	}
+	fi, err := mb.GetAttr(context.Background(), "/file")
+	if err != nil || fi.Size != int64(len("acknowledged")) {
+		t.Errorf("after an interrupted flush the file has %v, %v, want the buffered data", fi, err)
+	}
+}
+
+func TestDirStreamOutlivesReaddir(t *testing.T) {
+	root, mb := newTestRoot(t)
+	root.dirPageSize = 2
+	for i := 0; i < 5; i++ {
+		_, fh := create(t, &root.sdfsNode, fmt.Sprintf("file%d", i))
+		fh.Release(context.Background())
+	}
+	root.con = ctxBackend{mb, false}
+
+	// The context of the Readdir request ends when it is answered.
+	ctx, cancel := context.WithCancel(context.Background())
+	ds, errno := root.Readdir(ctx)
+	cancel()
+	if errno != 0 {
+		t.Fatalf("Readdir: %v", errno)
+	}
+	n := 0
+	for ds.HasNext() {
+		if _, errno := ds.Next(); errno != 0 {
+			t.Fatalf("Next after the Readdir context ended: %v", errno)
+		}
+		n++
+	}
+	ds.Close()
+	if n != 5 {
+		t.Errorf("listed %d entries, want 5", n)
+	}
+}
@@ -8,79 +8,159 @@ import (
 
 	ffs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
+	sapi "github.com/opendedup/sdfs-client-go/sdfs"
 	log "github.com/sirupsen/logrus"
 )
 
+// DefaultDirPageSize is the number of entries fetched per ListDir call
+// when ConnectionInfo.DirPageSize is not set.
+const DefaultDirPageSize = 1000
+
 type sdfsDirStream struct {
-	marker    string
-	path      string
-	ctx       context.Context
-	mu        sync.Mutex
-	nextEntry string
+	con      Backend
+	cache    *attrCache
+	path     string
+	pageSize int32
+	mu       sync.Mutex
+	entries  []*sapi.Stat
+	pos      int
+	done     bool
+	errno    syscall.Errno
+	next     chan dirPage
+	// ctx is used for the pages after the first. It outlives the Readdir
+	// request that opened the stream, whose context ends with it, and is
+	// canceled by Close.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// metrics is set once the stream is open. unexpected counts the
+	// errors of later pages, which are read outside of any operation.
+	metrics    *opMetrics
+	unexpected *errorCounts
+}
+
+// dirPage is one ListDir result, fetched ahead of time while the kernel
+// drains the previous page.
+type dirPage struct {
+	marker  string
+	entries []*sapi.Stat
+	err     error
 }
 
-// NewsdfsDirStream open a directory for reading as a DirStream
-func NewsdfsDirStream(ctx context.Context, name string) (ffs.DirStream, syscall.Errno) {
+// NewsdfsDirStream open a directory for reading as a DirStream. Entries
+// are fetched pageSize at a time and the following page is requested in
+// the background.
+func NewsdfsDirStream(ctx context.Context, con Backend, name string, pageSize int32) (ffs.DirStream, syscall.Errno) {
+	ds, errno := openDirStream(ctx, con, name, pageSize, nil)
+	if errno != 0 {
+		return nil, errno
+	}
+	return ds, ffs.OK
+}
+
+// openDirStream opens a stream on name. When dir is the node of name,
+// listed entries are put in the mount's attribute cache, where Lookup
+// finds them.
+func openDirStream(ctx context.Context, con Backend, name string, pageSize int32, dir *sdfsNode) (*sdfsDirStream, syscall.Errno) {
 	_, err := con.Stat(ctx, name)
 	if err != nil {
 		log.Debugf("error creating new lister for %s %v", name, err)
-		return nil, ToErrno(err)
+		return nil, errnoOf(ctx, err)
+	}
+	if pageSize <= 0 {
+		pageSize = DefaultDirPageSize
 	}
 
 	ds := &sdfsDirStream{
-		path:   name,
-		marker: "",
-		ctx:    ctx,
+		con:      con,
+		path:     name,
+		pageSize: pageSize,
+		next:     make(chan dirPage, 1),
+	}
+	ds.ctx, ds.cancel = context.WithCancel(uninterruptible(ctx))
+
+	if dir != nil {
+		ds.cache = dir.cache()
 	}
 
-	if err := ds.load(); err != 0 {
+	ds.load(ctx, "")
+	if err := ds.advance(); err != nil {
 		ds.Close()
-		return nil, err
+		return nil, errnoOf(ctx, err)
+	}
+	if dir != nil {
+		ds.metrics = dir.root().metrics
+		ds.metrics.dirStreamOpened()
+		ds.unexpected = dir.root().unexpected
 	}
 	return ds, ffs.OK
 }
 
 func (ds *sdfsDirStream) Close() {
-
+	ds.cancel()
+	ds.metrics.dirStreamClosed()
 }
 
 func (ds *sdfsDirStream) HasNext() bool {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
-	return len(ds.marker) > 0
+	for ds.pos >= len(ds.entries) && !ds.done && ds.errno == 0 {
+		if err := ds.advance(); err != nil {
+			ds.errno = ToErrno(err)
+			ds.unexpected.add(err)
+		}
+	}
+	return ds.pos < len(ds.entries) || ds.errno != 0
 }
 
 func (ds *sdfsDirStream) Next() (fuse.DirEntry, syscall.Errno) {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
-	fi, err := con.GetAttr(ds.ctx, filepath.Join(ds.path, ds.nextEntry))
-	if err != nil {
-		log.Debugf("error getting list next %v", err)
-		return fuse.DirEntry{}, ToErrno(err)
+	if ds.errno != 0 {
+		return fuse.DirEntry{}, ds.errno
 	}
+	if ds.pos >= len(ds.entries) {
+		return fuse.DirEntry{}, syscall.ENOENT
+	}
+	fi := ds.entries[ds.pos]
+	ds.pos++
 	result := fuse.DirEntry{
 		Ino: uint64(fi.Dev),
 
 		Mode: uint32(fi.Mode),
 
-		Name: ds.nextEntry,
+		Name: fi.FileName,
 	}
-	return result, ds.load()
+	return result, ffs.OK
 }
 
-func (ds *sdfsDirStream) load() syscall.Errno {
-	marker, fi, err := con.ListDir(ds.ctx, ds.path, ds.marker, true, 1)
-	if err != nil {
-		log.Debugf("error getting loading list %v", err)
-		return ToErrno(err)
+// load requests the page following marker in the background.
+func (ds *sdfsDirStream) load(ctx context.Context, marker string) {
+	go func() {
+		gen := ds.cache.generation()
+		marker, fi, err := ds.con.ListDir(ctx, ds.path, marker, true, ds.pageSize)
+		if err != nil {
+			log.Debugf("error getting loading list %v", err)
+		}
+		for _, e := range fi {
+			ds.cache.put(gen, filepath.Join(ds.path, e.FileName), e)
+		}
+		ds.next <- dirPage{marker: marker, entries: fi, err: err}
+	}()
+}
+
+// advance replaces the drained page with the prefetched one and starts
+// fetching the page after it. An empty page ends the listing.
+func (ds *sdfsDirStream) advance() error {
+	page := <-ds.next
+	if page.err != nil {
+		return page.err
 	}
-	ds.marker = marker
-	if len(fi) == 0 {
-		ds.marker = ""
-		ds.nextEntry = ""
+	ds.entries = page.entries
+	ds.pos = 0
+	if len(page.entries) == 0 || len(page.marker) == 0 {
+		ds.done = true
 	} else {
-		ds.marker = marker
-		ds.nextEntry = fi[0].FileName
+		ds.load(ds.ctx, page.marker)
 	}
-	return ffs.OK
+	return nil
 }
@@ -0,0 +1,153 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func readDir(t *testing.T, n *sdfsNode) []fuse.DirEntry {
+	t.Helper()
+	ds, errno := n.Readdir(context.Background())
+	if errno != 0 {
+		t.Fatalf("Readdir: %v", errno)
+	}
+	defer ds.Close()
+	var entries []fuse.DirEntry
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno != 0 {
+			t.Fatalf("Next: %v", errno)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestReaddirEmpty(t *testing.T) {
+	root, _ := newTestRoot(t)
+	if entries := readDir(t, &root.sdfsNode); len(entries) != 0 {
+		t.Errorf("Readdir of empty root = %v", entries)
+	}
+}
+
+func TestReaddir(t *testing.T) {
+	root, _ := newTestRoot(t)
+	ctx := context.Background()
+	mkdir(t, &root.sdfsNode, "dir")
+	for i := 0; i < 5; i++ {
+		_, fh := create(t, &root.sdfsNode, fmt.Sprintf("file%d", i))
+		fh.Release(ctx)
+	}
+
+	entries := readDir(t, &root.sdfsNode)
+	if len(entries) != 6 {
+		t.Fatalf("got %d entries, want 6: %v", len(entries), entries)
+	}
+	seen := map[uint64]bool{}
+	for _, e := range entries {
+		want := uint32(syscall.S_IFREG)
+		if e.Name == "dir" {
+			want = syscall.S_IFDIR
+		}
+		if e.Mode&syscall.S_IFMT != want {
+			t.Errorf("%s: mode %o, want type %o", e.Name, e.Mode, want)
+		}
+		if e.Ino == 0 || seen[e.Ino] {
+			t.Errorf("%s: ino %d is zero or repeated", e.Name, e.Ino)
+		}
+		seen[e.Ino] = true
+	}
+}
+
+func TestReaddirMissing(t *testing.T) {
+	root, mb := newTestRoot(t)
+	dir := mkdir(t, &root.sdfsNode, "dir")
+	mb.RmDir(context.Background(), "/dir")
+	if _, errno := dir.Readdir(context.Background()); errno != syscall.ENOENT {
+		t.Errorf("Readdir of removed dir = %v, want ENOENT", errno)
+	}
+}
+
+func TestReaddirPaging(t *testing.T) {
+	root, mb := newTestRoot(t)
+	ctx := context.Background()
+	root.dirPageSize = 2
+	for i := 0; i < 5; i++ {
+		_, fh := create(t, &root.sdfsNode, fmt.Sprintf("file%d", i))
+		fh.Release(ctx)
+	}
+
+	mb.ResetCalls()
+	entries := readDir(t, &root.sdfsNode)
+	if len(entries) != 5 {
+		t.Fatalf("got %d entries, want 5: %v", len(entries), entries)
+	}
+	for i, e := range entries {
+		if want := fmt.Sprintf("file%d", i); e.Name != want {
+			t.Errorf("entry %d = %q, want %q", i, e.Name, want)
+		}
+	}
+	// Three full or partial pages and the empty page that ends the listing.
+	if got := mb.Calls("ListDir"); got != 4 {
+		t.Errorf("ListDir called %d times, want 4", got)
+	}
+	if got := mb.Calls("GetAttr"); got != 0 {
+		t.Errorf("GetAttr called %d times, want 0", got)
+	}
+}
+
+// TestReaddirPlus mimics the READDIRPLUS loop of the FUSE bridge, which
+// looks up every entry right after reading it.
+func TestReaddirPlus(t *testing.T) {
+	root, mb := newTestRoot(t)
+	root.cache = newAttrCache(time.Minute, time.Minute)
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		_, fh := create(t, &root.sdfsNode, fmt.Sprintf("file%d", i))
+		fh.Write(ctx, make([]byte, i*10), 0)
+		fh.Release(ctx)
+	}
+
+	mb.ResetCalls()
+	ds, errno := root.Readdir(ctx)
+	if errno != 0 {
+		t.Fatalf("Readdir: %v", errno)
+	}
+	defer ds.Close()
+	n := 0
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno != 0 {
+			t.Fatalf("Next: %v", errno)
+		}
+		var out fuse.EntryOut
+		ch, errno := root.Lookup(ctx, e.Name, &out)
+		if errno != 0 {
+			t.Fatalf("Lookup(%q): %v", e.Name, errno)
+		}
+		if ch.StableAttr().Ino != e.Ino {
+			t.Errorf("%s: Lookup ino %d, Readdir ino %d", e.Name, ch.StableAttr().Ino, e.Ino)
+		}
+		if out.Size != uint64(n*10) {
+			t.Errorf("%s: size %d, want %d", e.Name, out.Size, n*10)
+		}
+		n++
+	}
+	if got := mb.Calls("GetAttr"); got != 0 {
+		t.Errorf("GetAttr called %d times, want 0", got)
+	}
+
+	// What is listed does not outlive changes to the directory.
+	if errno := root.Unlink(ctx, "file4"); errno != 0 {
+		t.Fatalf("Unlink: %v", errno)
+	}
+	var out fuse.EntryOut
+	if _, errno := root.Lookup(ctx, "file4", &out); errno != syscall.ENOENT {
+		t.Errorf("Lookup of the removed last entry = %v, want ENOENT", errno)
+	}
+}
@@ -6,26 +6,55 @@ package fs
 
 import (
 	"context"
-	"time"
 
 	//	"time"
 
+	"sync"
 	"syscall"
 
 	ffs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
 // NewsdfsFile creates a FileHandle out of a file descriptor. All
 // operations are implemented.
-func NewsdfsFile(fd int64, path string) ffs.FileHandle {
-	return &sdfsFile{fd: fd, path: path}
+func NewsdfsFile(con Backend, fd int64, path string) ffs.FileHandle {
+	return &sdfsFile{con: con, fd: fd, path: path}
 }
 
 type sdfsFile struct {
-	fd   int64
-	path string
+	con   Backend
+	cache *attrCache
+	locks *lockTable
+	ino   uint64
+	fd    int64
+	path  string
+	// append is set for handles opened with O_APPEND. Their writes go to
+	// the end of the file on the server, not to the offset asked for.
+	append  bool
+	appends *appendLocks
+	writes  *writeBuffers
+	reads   *readAheads
+	blocks  *blockCache
+	metrics *opMetrics
+	handles *handleCount
+	// unexpected counts the errors of operations on the handle that
+	// did not come from the volume.
+	unexpected *errorCounts
+	ra         readAhead
+
+	// flockOwners are the owners that took flock locks through this
+	// handle. Those locks go away with the handle.
+	mu          sync.Mutex
+	flockOwners map[uint64]bool
+	// wbuf holds writes starting at woff that have not been sent to the
+	// server yet and werr the first failure to send them, until a Flush
+	// or Fsync reports it.
+	wbuf []byte
+	woff int64
+	werr error
 }
 
 var _ = (ffs.FileHandle)((*sdfsFile)(nil))
@@ -36,62 +65,212 @@ var _ = (ffs.FileWriter)((*sdfsFile)(nil))
 var _ = (ffs.FileFlusher)((*sdfsFile)(nil))
 var _ = (ffs.FileFsyncer)((*sdfsFile)(nil))
 var _ = (ffs.FileSetattrer)((*sdfsFile)(nil))
+var _ = (ffs.FileGetlker)((*sdfsFile)(nil))
+var _ = (ffs.FileSetlker)((*sdfsFile)(nil))
+var _ = (ffs.FileSetlkwer)((*sdfsFile)(nil))
+var _ = (ffs.FileAllocater)((*sdfsFile)(nil))
 
 func (f *sdfsFile) Read(ctx context.Context, buf []byte, off int64) (res fuse.ReadResult, errno syscall.Errno) {
-
-	rs, err := con.Read(ctx, f.fd, off, int32(len(buf)))
+	ctx, op := f.begin(ctx, "read")
+	defer op.end(&errno)
+	f.writes.flushIno(ctx, f.ino)
+	if n, ok := f.readAhead(ctx, off, buf); ok {
+		f.reads.counts.hit()
+		op.transferred("read", n)
+		return fuse.ReadResultData(buf[:n]), ffs.OK
+	}
+	if f.reads.enabled() {
+		f.reads.counts.miss()
+	}
+	rs, err := f.readAt(ctx, off, int32(len(buf)))
 	copy(buf, rs)
 	if err != nil {
 		log.Debugf("read error %v \n", err)
-		return nil, ToErrno(err)
+		return nil, errnoOf(ctx, err)
 	}
+	op.transferred("read", len(rs))
 	r := fuse.ReadResultData(rs)
 	return r, ffs.OK
 }
 
-func (f *sdfsFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
-	err := con.Write(ctx, f.fd, data, off, int32(len(data)))
+func (f *sdfsFile) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
+	ctx, op := f.begin(ctx, "write")
+	defer op.end(&errno)
+	defer func() { op.transferred("write", int(written)) }()
+	if f.append {
+		return f.appendData(ctx, data)
+	}
+	// Data other handles buffered earlier must not land over this.
+	f.writes.flushOthers(ctx, f.ino, f)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.bufferWrite(ctx, data, off) {
+		return uint32(len(data)), ffs.OK
+	}
+	err := f.con.Write(ctx, f.fd, data, off, int32(len(data)))
+	f.changed()
 	if err != nil {
 		log.Debugf("write error %v \n", err)
-		return 0, ToErrno(err)
+		return 0, errnoOf(ctx, err)
 	}
 	return uint32(len(data)), ffs.OK
 }
 
-func (f *sdfsFile) Release(ctx context.Context) syscall.Errno {
+// appendLocks hands out a mutex per inode, under which appends are
+// written when the backend cannot append. An inode's mutex is dropped
+// once no append waits for it.
+type appendLocks struct {
+	mu   sync.Mutex
+	inos map[uint64]*appendLock
+}
+
+type appendLock struct {
+	sync.Mutex
+	users int
+}
+
+func newAppendLocks() *appendLocks {
+	return &appendLocks{inos: make(map[uint64]*appendLock)}
+}
+
+// lock locks the mutex of ino and returns it for unlock.
+func (a *appendLocks) lock(ino uint64) *appendLock {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	l, ok := a.inos[ino]
+	if !ok {
+		l = &appendLock{}
+		a.inos[ino] = l
+	}
+	l.users++
+	a.mu.Unlock()
+	l.Lock()
+	return l
+}
+
+func (a *appendLocks) unlock(ino uint64, l *appendLock) {
+	if a == nil {
+		return
+	}
+	l.Unlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	l.users--
+	if l.users == 0 {
+		delete(a.inos, ino)
+	}
+}
+
+// appendData writes data at the end of the file. Backends that are not
+// an Appender are asked for the size and written to under the inode's
+// append lock, so appends through one mount never overwrite each other.
+func (f *sdfsFile) appendData(ctx context.Context, data []byte) (uint32, syscall.Errno) {
+	defer f.changed()
+	if a, ok := asAppender(f.con); ok {
+		f.writes.flushIno(ctx, f.ino)
+		if _, err := a.Append(ctx, f.fd, data, int32(len(data))); err != nil {
+			log.Debugf("append error %v \n", err)
+			return 0, errnoOf(ctx, err)
+		}
+		return uint32(len(data)), ffs.OK
+	}
+	l := f.appends.lock(f.ino)
+	defer f.appends.unlock(f.ino, l)
+	// Data other handles buffered must land before the size is read.
+	f.writes.flushIno(ctx, f.ino)
+	fi, err := f.con.GetAttr(ctx, f.path)
+	if err != nil {
+		return 0, errnoOf(ctx, err)
+	}
+	if err := f.con.Write(ctx, f.fd, data, fi.Size, int32(len(data))); err != nil {
+		log.Debugf("append error %v \n", err)
+		return 0, errnoOf(ctx, err)
+	}
+	return uint32(len(data)), ffs.OK
+}
+
+// readAt reads from the server, or through the block cache when the
+// mount has one.
+func (f *sdfsFile) readAt(ctx context.Context, off int64, size int32) ([]byte, error) {
+	if f.blocks == nil {
+		return f.con.Read(ctx, f.fd, off, size)
+	}
+	fi, _, err := f.cache.getAttr(ctx, f.con, f.path)
+	if err != nil {
+		return nil, err
+	}
+	return f.blocks.read(ctx, f.con, f.fd, f.path, fi.Mtim, fi.Size, off, size)
+}
+
+// changed drops what the mount remembers about the data of f after it
+// was modified.
+func (f *sdfsFile) changed() {
+	f.cache.invalidate(f.path)
+	f.reads.invalidate(f.ino)
+	f.blocks.invalidate(f.path)
+}
+
+// Release closes the descriptor on the server even when the request is
+// interrupted, so that it is not leaked.
+func (f *sdfsFile) Release(ctx context.Context) (errno syscall.Errno) {
+	ctx, op := f.begin(ctx, "release")
+	defer op.end(&errno)
+	ctx = uninterruptible(ctx)
+	f.flush(ctx)
+	f.releaseFlocks(ctx)
+	f.dropReadAhead()
 	if f.fd != -1 {
-		err := con.Release(ctx, f.fd)
+		f.reads.close(f.ino)
+		f.metrics.handleClosed()
+		f.handles.add(-1)
+		err := f.con.Release(ctx, f.fd)
 		f.fd = -1
 		if err != nil {
 			log.Debugf("error during close %v", err)
 		}
-		return ToErrno(err)
+		return errnoOf(ctx, err)
 	}
 	return syscall.EBADF
 }
 
-func (f *sdfsFile) Flush(ctx context.Context) syscall.Errno {
-	err := con.Flush(ctx, f.path, f.fd)
+// Flush sends buffered writes to the server and reports the first write
+// that failed since the last Flush or Fsync.
+func (f *sdfsFile) Flush(ctx context.Context) (errno syscall.Errno) {
+	ctx, op := f.begin(ctx, "flush")
+	defer op.end(&errno)
+	if err := f.flush(ctx); err != nil {
+		return errnoOf(ctx, err)
+	}
+	err := f.con.Flush(ctx, f.path, f.fd)
 	if err != nil {
 		log.Debugf("error during flush %v", err)
 	}
-	return ToErrno(err)
+	return errnoOf(ctx, err)
 }
 
 func (f *sdfsFile) Fsync(ctx context.Context, flags uint32) (errno syscall.Errno) {
-
-	r := ffs.ToErrno(con.Fsync(ctx, f.path, f.fd))
+	ctx, op := f.begin(ctx, "fsync")
+	defer op.end(&errno)
+	if err := f.flush(ctx); err != nil {
+		return errnoOf(ctx, err)
+	}
+	r := errnoOf(ctx, f.con.Fsync(ctx, f.path, f.fd))
 
 	return r
 }
 
-func (f *sdfsFile) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+func (f *sdfsFile) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) (errno syscall.Errno) {
+	ctx, op := f.begin(ctx, "setattr")
+	defer op.end(&errno)
+	f.writes.flushIno(ctx, f.ino)
 	if m, ok := in.GetMode(); ok {
-		if err := con.Chmod(ctx, f.path, int32(m)); err != nil {
+		if err := f.con.Chmod(ctx, f.path, int32(m)); err != nil {
 			if err != nil {
 				log.Debugf("error during setattr %v", err)
 			}
-			return ToErrno(err)
+			return errnoOf(ctx, err)
 		}
 	}
 
@@ -106,8 +285,8 @@ func (f *sdfsFile) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.At
 		if gok {
 			sgid = int(gid)
 		}
-		if err := con.Chown(ctx, f.path, int32(sgid), int32(suid)); err != nil {
-			return ToErrno(err)
+		if err := f.con.Chown(ctx, f.path, int32(sgid), int32(suid)); err != nil {
+			return errnoOf(ctx, err)
 		}
 	}
 
@@ -127,56 +306,162 @@ func (f *sdfsFile) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.At
 		at := fuse.UtimeToTimespec(ap).Sec
 		mt := fuse.UtimeToTimespec(mp).Sec
 
-		if err := con.Utime(ctx, f.path, at, mt); err != nil {
+		if err := f.con.Utime(ctx, f.path, at, mt); err != nil {
 			log.Debugf("error setting utime for %s %v", f.path, err)
-			return ffs.ToErrno(err)
+			return errnoOf(ctx, err)
 		}
 	}
 
 	if sz, ok := in.GetSize(); ok {
-		if err := con.Truncate(ctx, f.path, int64(sz)); err != nil {
+		if err := f.con.Truncate(ctx, f.path, int64(sz)); err != nil {
 			log.Debugf("error truncate for %s %v", f.path, err)
-			return ffs.ToErrno(err)
+			return errnoOf(ctx, err)
 		}
 	}
 
-	fi, err := con.GetAttr(ctx, f.path)
+	f.changed()
+	fi, err := f.cache.fetchAttr(ctx, f.con, f.path)
 	if err != nil {
 		log.Debugf("error getattr for %s %v", f.path, err)
-		return ToErrno(err)
+		return errnoOf(ctx, err)
 	}
 
-	atim := time.Unix(0, fi.Atime*int64(time.Millisecond))
-	ctim := time.Unix(0, fi.Ctim*int64(time.Millisecond))
-	mtim := time.Unix(0, fi.Mtim*int64(time.Millisecond))
-	out.SetTimes(&atim, &mtim, &ctim)
-	out.Size = uint64(fi.Size)
-	out.Blocks = uint64(fi.Size / 512)
-	out.Owner.Uid = uint32(fi.Uid)
-	out.Owner.Gid = uint32(fi.Gid)
-	out.Mode = uint32(fi.Mode)
-	out.Blksize = 512
+	ToAttr(fi, &out.Attr)
 
 	return ffs.OK
 }
 
-func (f *sdfsFile) Getattr(ctx context.Context, a *fuse.AttrOut) syscall.Errno {
-	fi, err := con.GetAttr(ctx, f.path)
+func (f *sdfsFile) Getattr(ctx context.Context, a *fuse.AttrOut) (errno syscall.Errno) {
+	ctx, op := f.begin(ctx, "getattr")
+	defer op.end(&errno)
+	f.writes.flushIno(ctx, f.ino)
+	fi, _, err := f.cache.getAttr(ctx, f.con, f.path)
 	if err != nil {
 		if err != nil {
 			log.Debugf("error during getattr %v", err)
 		}
-		return ToErrno(err)
-	}
-	atime := time.Unix(0, fi.Atime*int64(time.Millisecond))
-	ctime := time.Unix(0, fi.Ctim*int64(time.Millisecond))
-	mtime := time.Unix(0, fi.Mtim*int64(time.Millisecond))
-	a.SetTimes(&atime, &mtime, &ctime)
-	a.Size = uint64(fi.Size)
-	a.Blocks = uint64(fi.Size / 512)
-	a.Owner.Uid = uint32(fi.Uid)
-	a.Owner.Gid = uint32(fi.Gid)
-	a.Mode = uint32(fi.Mode)
-	a.Blksize = 512
+		return errnoOf(ctx, err)
+	}
+	ToAttr(fi, &a.Attr)
+	return ffs.OK
+}
+
+func (f *sdfsFile) Getlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) (errno syscall.Errno) {
+	ctx, op := f.begin(ctx, "getlk")
+	defer op.end(&errno)
+	flock := flags&fuse.FUSE_LK_FLOCK != 0
+	if lkr, ok := asLocker(f.con); ok {
+		conflict, err := lkr.GetLock(ctx, f.path, owner, lk, flock)
+		if err != nil {
+			log.Debugf("error during getlk for %s %v", f.path, err)
+			return errnoOf(ctx, err)
+		}
+		*out = *conflict
+		return ffs.OK
+	}
+	if f.locks == nil {
+		return syscall.ENOLCK
+	}
+	f.locks.getlk(lockKey{ino: f.ino, flock: flock}, owner, lk, out)
 	return ffs.OK
 }
+
+func (f *sdfsFile) Setlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) (errno syscall.Errno) {
+	ctx, op := f.begin(ctx, "setlk")
+	defer op.end(&errno)
+	return f.setlk(ctx, owner, lk, flags, false)
+}
+
+func (f *sdfsFile) Setlkw(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) (errno syscall.Errno) {
+	ctx, op := f.begin(ctx, "setlkw")
+	defer op.end(&errno)
+	return f.setlk(ctx, owner, lk, flags, true)
+}
+
+// setlk takes or releases lk on the server when the backend is a Locker
+// and in the mount's lock table otherwise. A waiting lock gives up with
+// EINTR when the request is interrupted.
+func (f *sdfsFile) setlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32, wait bool) syscall.Errno {
+	flock := flags&fuse.FUSE_LK_FLOCK != 0
+	var errno syscall.Errno
+	if lkr, ok := asLocker(f.con); ok {
+		err := lkr.SetLock(ctx, f.path, owner, lk, flock, wait)
+		if err != nil {
+			log.Debugf("error during setlk for %s %v", f.path, err)
+			if wait && ctx.Err() != nil {
+				return syscall.EINTR
+			}
+		}
+		errno = errnoOf(ctx, err)
+	} else if f.locks == nil {
+		return syscall.ENOLCK
+	} else if wait {
+		errno = f.locks.setlkw(ctx, lockKey{ino: f.ino, flock: flock}, owner, lk)
+	} else {
+		errno = f.locks.setlk(lockKey{ino: f.ino, flock: flock}, owner, lk)
+	}
+	if flock && errno == 0 {
+		f.mu.Lock()
+		if lk.Typ == syscall.F_UNLCK {
+			delete(f.flockOwners, owner)
+		} else {
+			if f.flockOwners == nil {
+				f.flockOwners = make(map[uint64]bool)
+			}
+			f.flockOwners[owner] = true
+		}
+		f.mu.Unlock()
+	}
+	return errno
+}
+
+// releaseFlocks drops the flock locks taken through f, as closing the
+// last descriptor of an open file does.
+func (f *sdfsFile) releaseFlocks(ctx context.Context) {
+	f.mu.Lock()
+	owners := f.flockOwners
+	f.flockOwners = nil
+	f.mu.Unlock()
+	for owner := range owners {
+		unlock := &fuse.FileLock{Start: 0, End: maxLockOffset, Typ: syscall.F_UNLCK}
+		if lkr, ok := asLocker(f.con); ok {
+			if err := lkr.SetLock(ctx, f.path, owner, unlock, true, false); err != nil {
+				log.Debugf("error releasing flock on %s %v", f.path, err)
+			}
+		} else if f.locks != nil {
+			f.locks.releaseOwner(lockKey{ino: f.ino, flock: true}, owner)
+		}
+	}
+}
+
+// Allocate implements fallocate through backends that are Allocators.
+// Others cannot reserve space or drop the chunks of a range, so only
+// preallocating what the file already holds succeeds. Anything else fails
+// with EOPNOTSUPP, so that callers such as posix_fallocate(3) fall back
+// on their own emulation.
+func (f *sdfsFile) Allocate(ctx context.Context, off uint64, size uint64, mode uint32) (errno syscall.Errno) {
+	ctx, op := f.begin(ctx, "allocate")
+	defer op.end(&errno)
+	a, ok := asAllocator(f.con)
+	if !ok {
+		if mode&^unix.FALLOC_FL_KEEP_SIZE != 0 {
+			return syscall.EOPNOTSUPP
+		}
+		f.writes.flushIno(ctx, f.ino)
+		fi, _, err := f.cache.getAttr(ctx, f.con, f.path)
+		if err != nil {
+			return errnoOf(ctx, err)
+		}
+		if int64(off+size) > fi.Size {
+			return syscall.EOPNOTSUPP
+		}
+		return ffs.OK
+	}
+	defer f.changed()
+	f.writes.flushIno(ctx, f.ino)
+	err := a.Allocate(ctx, f.path, int64(off), int64(size), mode)
+	if err != nil {
+		log.Debugf("error during fallocate for %s %v", f.path, err)
+	}
+	return errnoOf(ctx, err)
+}
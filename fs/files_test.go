@@ -0,0 +1,320 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+func readAll(t *testing.T, f *sdfsFile, off int64, size int) []byte {
+	t.Helper()
+	buf := make([]byte, size)
+	res, errno := f.Read(context.Background(), buf, off)
+	if errno != 0 {
+		t.Fatalf("Read(%d, %d): %v", off, size, errno)
+	}
+	data, status := res.Bytes(buf)
+	if !status.Ok() {
+		t.Fatalf("ReadResult.Bytes: %v", status)
+	}
+	return data
+}
+
+func TestReadWrite(t *testing.T) {
+	root, _ := newTestRoot(t)
+	ctx := context.Background()
+	_, fh := create(t, &root.sdfsNode, "file")
+	defer fh.Release(ctx)
+
+	if n, errno := fh.Write(ctx, []byte("hello world"), 0); errno != 0 || n != 11 {
+		t.Fatalf("Write = %d, %v", n, errno)
+	}
+	if _, errno := fh.Write(ctx, []byte("WORLD"), 6); errno != 0 {
+		t.Fatalf("Write: %v", errno)
+	}
+	if got := readAll(t, fh, 0, 64); string(got) != "hello WORLD" {
+		t.Errorf("Read = %q, want %q", got, "hello WORLD")
+	}
+	if got := readAll(t, fh, 6, 3); string(got) != "WOR" {
+		t.Errorf("Read(6, 3) = %q, want WOR", got)
+	}
+	if got := readAll(t, fh, 100, 8); len(got) != 0 {
+		t.Errorf("Read past EOF = %q, want nothing", got)
+	}
+	if errno := fh.Flush(ctx); errno != 0 {
+		t.Errorf("Flush: %v", errno)
+	}
+	if errno := fh.Fsync(ctx, 0); errno != 0 {
+		t.Errorf("Fsync: %v", errno)
+	}
+
+	var out fuse.AttrOut
+	if errno := fh.Getattr(ctx, &out); errno != 0 {
+		t.Fatalf("Getattr: %v", errno)
+	}
+	if out.Size != 11 {
+		t.Errorf("size %d, want 11", out.Size)
+	}
+}
+
+func TestOpenExisting(t *testing.T) {
+	root, mb := newTestRoot(t)
+	ctx := context.Background()
+	_, fh := create(t, &root.sdfsNode, "file")
+	fh.Write(ctx, []byte("contents"), 0)
+	fh.Release(ctx)
+
+	n := lookup(t, &root.sdfsNode, "file")
+	h, _, errno := n.Open(ctx, syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatalf("Open: %v", errno)
+	}
+	f := h.(*sdfsFile)
+	if got := readAll(t, f, 0, 64); string(got) != "contents" {
+		t.Errorf("Read = %q, want contents", got)
+	}
+	if errno := f.Release(ctx); errno != 0 {
+		t.Errorf("Release: %v", errno)
+	}
+	if errno := f.Release(ctx); errno != syscall.EBADF {
+		t.Errorf("second Release = %v, want EBADF", errno)
+	}
+	if mb.OpenHandles() != 0 {
+		t.Errorf("%d handles still open", mb.OpenHandles())
+	}
+}
+
+func TestFileSetattrTruncate(t *testing.T) {
+	root, _ := newTestRoot(t)
+	ctx := context.Background()
+	_, fh := create(t, &root.sdfsNode, "file")
+	defer fh.Release(ctx)
+	fh.Write(ctx, []byte("0123456789"), 0)
+
+	in := &fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_SIZE
+	in.Size = 4
+	var out fuse.AttrOut
+	if errno := fh.Setattr(ctx, in, &out); errno != 0 {
+		t.Fatalf("Setattr: %v", errno)
+	}
+	if out.Size != 4 {
+		t.Errorf("size %d, want 4", out.Size)
+	}
+	if got := readAll(t, fh, 0, 64); string(got) != "0123" {
+		t.Errorf("Read = %q, want 0123", got)
+	}
+}
+
+func TestCopyFileRange(t *testing.T) {
+	root, _ := newTestRoot(t)
+	ctx := context.Background()
+	src, in := create(t, &root.sdfsNode, "src")
+	defer in.Release(ctx)
+	dst, out := create(t, &root.sdfsNode, "dst")
+	defer out.Release(ctx)
+
+	data := bytes.Repeat([]byte("abcd"), 1024)
+	in.Write(ctx, data, 0)
+	n, errno := src.CopyFileRange(ctx, in, 4, &dst.Inode, out, 0, 8, 0)
+	if errno != 0 {
+		t.Fatalf("CopyFileRange: %v", errno)
+	}
+	if n != 8 {
+		t.Errorf("copied %d bytes, want 8", n)
+	}
+	if got := readAll(t, out, 0, 64); string(got) != "abcdabcd" {
+		t.Errorf("Read = %q, want abcdabcd", got)
+	}
+}
+
+func TestGetattrBlocks(t *testing.T) {
+	root, _ := newTestRoot(t)
+	ctx := context.Background()
+	_, fh := create(t, &root.sdfsNode, "file")
+	defer fh.Release(ctx)
+
+	// Data in blocks 1 and 3 of a five block file.
+	block := bytes.Repeat([]byte{'x'}, 4096)
+	fh.Write(ctx, block, 4096)
+	fh.Write(ctx, block, 3*4096)
+	fh.Setattr(ctx, &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE, Size: 5 * 4096}}, &fuse.AttrOut{})
+
+	var out fuse.AttrOut
+	if errno := fh.Getattr(ctx, &out); errno != 0 {
+		t.Fatalf("Getattr: %v", errno)
+	}
+	if out.Blocks != 2*4096/512 {
+		t.Errorf("Blocks = %d, want %d", out.Blocks, 2*4096/512)
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	root, mb := newTestRoot(t)
+	ctx := context.Background()
+	_, fh := create(t, &root.sdfsNode, "file")
+	defer fh.Release(ctx)
+	block := bytes.Repeat([]byte{'x'}, 4096)
+	for i := int64(0); i < 4; i++ {
+		fh.Write(ctx, block, i*4096)
+	}
+
+	size := func() uint64 {
+		var out fuse.AttrOut
+		if errno := fh.Getattr(ctx, &out); errno != 0 {
+			t.Fatalf("Getattr: %v", errno)
+		}
+		return out.Size
+	}
+	if errno := fh.Allocate(ctx, 0, 8*4096, 0); errno != 0 {
+		t.Fatalf("Allocate: %v", errno)
+	}
+	if got := size(); got != 8*4096 {
+		t.Errorf("size after preallocation %d, want %d", got, 8*4096)
+	}
+	if errno := fh.Allocate(ctx, 0, 16*4096, unix.FALLOC_FL_KEEP_SIZE); errno != 0 {
+		t.Fatalf("Allocate(KEEP_SIZE): %v", errno)
+	}
+	if got := size(); got != 8*4096 {
+		t.Errorf("KEEP_SIZE changed the size to %d", got)
+	}
+
+	if errno := fh.Allocate(ctx, 4096, 2*4096, unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE); errno != 0 {
+		t.Fatalf("Allocate(PUNCH_HOLE): %v", errno)
+	}
+	if got := readAll(t, fh, 4096, 2*4096); !bytes.Equal(got, make([]byte, 2*4096)) {
+		t.Errorf("punched range still holds data")
+	}
+	if got := readAll(t, fh, 3*4096, 4096); !bytes.Equal(got, block) {
+		t.Errorf("data after the hole changed")
+	}
+	fi, _ := mb.GetAttr(ctx, "/file")
+	if fi.Blocks != 2*4096/512 {
+		t.Errorf("%d blocks after punching, want %d", fi.Blocks, 2*4096/512)
+	}
+
+	if errno := fh.Allocate(ctx, 7*4096, 2*4096, unix.FALLOC_FL_ZERO_RANGE); errno != 0 {
+		t.Fatalf("Allocate(ZERO_RANGE): %v", errno)
+	}
+	if got := size(); got != 9*4096 {
+		t.Errorf("size after zeroing past EOF %d, want %d", got, 9*4096)
+	}
+}
+
+func TestAllocateUnsupported(t *testing.T) {
+	root, mb := newTestRoot(t)
+	ctx := context.Background()
+	_, fh := create(t, &root.sdfsNode, "file")
+	defer fh.Release(ctx)
+	fh.con = plainBackend{mb}
+	block := bytes.Repeat([]byte{'x'}, 4096)
+	for i := int64(0); i < 4; i++ {
+		fh.Write(ctx, block, i*4096)
+	}
+
+	if errno := fh.Allocate(ctx, 0, 4*4096, 0); errno != 0 {
+		t.Errorf("Allocate within the file: %v", errno)
+	}
+	for _, tc := range []struct {
+		name      string
+		off, size uint64
+		mode      uint32
+	}{
+		{"past EOF", 0, 8 * 4096, 0},
+		{"KEEP_SIZE", 0, 8 * 4096, unix.FALLOC_FL_KEEP_SIZE},
+		{"PUNCH_HOLE", 4096, 4096, unix.FALLOC_FL_PUNCH_HOLE | unix.FALLOC_FL_KEEP_SIZE},
+		{"ZERO_RANGE", 4096, 4096, unix.FALLOC_FL_ZERO_RANGE},
+		{"COLLAPSE_RANGE", 0, 4096, unix.FALLOC_FL_COLLAPSE_RANGE},
+	} {
+		if errno := fh.Allocate(ctx, tc.off, tc.size, tc.mode); errno != syscall.EOPNOTSUPP {
+			t.Errorf("Allocate(%s) = %v, want EOPNOTSUPP", tc.name, errno)
+		}
+	}
+
+	var out fuse.AttrOut
+	if errno := fh.Getattr(ctx, &out); errno != 0 {
+		t.Fatalf("Getattr: %v", errno)
+	}
+	if out.Size != 4*4096 {
+		t.Errorf("size %d, want %d", out.Size, 4*4096)
+	}
+	if got := readAll(t, fh, 0, 4*4096); !bytes.Equal(got, bytes.Repeat(block, 4)) {
+		t.Errorf("file contents changed")
+	}
+}
+
+func TestAppend(t *testing.T) {
+	root, mb := newTestRoot(t)
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name string
+		con  Backend
+	}{
+		{"backend", mb},
+		{"emulated", plainBackend{mb}},
+	} {
+		var out fuse.EntryOut
+		ch, fh, _, errno := root.Create(ctx, tc.name, syscall.O_WRONLY|syscall.O_APPEND, syscall.S_IFREG|0644, &out)
+		if errno != 0 {
+			t.Fatalf("%s: Create: %v", tc.name, errno)
+		}
+		root.AddChild(tc.name, ch, true)
+		a1 := fh.(*sdfsFile)
+		a1.con = tc.con
+		fh2, _, errno := lookup(t, &root.sdfsNode, tc.name).Open(ctx, syscall.O_WRONLY|syscall.O_APPEND)
+		if errno != 0 {
+			t.Fatalf("%s: Open(O_APPEND): %v", tc.name, errno)
+		}
+		a2 := fh2.(*sdfsFile)
+		a2.con = tc.con
+
+		// Both appenders think they write at offset 0.
+		a1.Write(ctx, []byte("one\n"), 0)
+		a2.Write(ctx, []byte("two\n"), 0)
+		a1.Write(ctx, []byte("three\n"), 4)
+		a1.Release(ctx)
+
+		if got := readAll(t, a2, 0, 64); string(got) != "one\ntwo\nthree\n" {
+			t.Errorf("%s: file holds %q, want every line appended", tc.name, got)
+		}
+		a2.Release(ctx)
+	}
+}
+
+func TestAppendLocks(t *testing.T) {
+	a := newAppendLocks()
+	l1 := a.lock(1)
+
+	other := make(chan struct{})
+	go func() {
+		a.unlock(2, a.lock(2))
+		close(other)
+	}()
+	select {
+	case <-other:
+	case <-time.After(5 * time.Second):
+		t.Fatal("append to inode 2 waited for inode 1")
+	}
+
+	same := make(chan struct{})
+	go func() {
+		a.unlock(1, a.lock(1))
+		close(same)
+	}()
+	select {
+	case <-same:
+		t.Fatal("second append to inode 1 did not wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	a.unlock(1, l1)
+	<-same
+
+	if len(a.inos) != 0 {
+		t.Errorf("%d inodes left with append locks", len(a.inos))
+	}
+}
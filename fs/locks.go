@@ -0,0 +1,243 @@
+package fs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+
+	ffs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// lockKey names the locks of one file. fcntl and flock locks live side
+// by side and never conflict with each other, as on Linux.
+type lockKey struct {
+	ino   uint64
+	flock bool
+}
+
+type heldLock struct {
+	owner uint64
+	start uint64
+	end   uint64
+	typ   uint32
+	pid   uint32
+}
+
+// lockTable holds the byte range and flock locks taken through a mount
+// when the backend cannot keep them on the server.
+type lockTable struct {
+	mu    sync.Mutex
+	locks map[lockKey][]heldLock
+	// released is closed, and replaced, whenever locks are given up, so
+	// waiters can try again.
+	released chan struct{}
+}
+
+func newLockTable() *lockTable {
+	return &lockTable{
+		locks:    make(map[lockKey][]heldLock),
+		released: make(chan struct{}),
+	}
+}
+
+// conflict returns a lock held by another owner that keeps owner from
+// taking lk. t.mu must be held.
+func (t *lockTable) conflict(key lockKey, owner uint64, lk *fuse.FileLock) (heldLock, bool) {
+	for _, h := range t.locks[key] {
+		if h.owner == owner || h.end < lk.Start || lk.End < h.start {
+			continue
+		}
+		if h.typ == syscall.F_WRLCK || lk.Typ == syscall.F_WRLCK {
+			return h, true
+		}
+	}
+	return heldLock{}, false
+}
+
+// getlk reports in out the first lock that conflicts with lk, or F_UNLCK
+// when lk could be taken.
+func (t *lockTable) getlk(key lockKey, owner uint64, lk *fuse.FileLock, out *fuse.FileLock) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if h, ok := t.conflict(key, owner, lk); ok {
+		*out = fuse.FileLock{Start: h.start, End: h.end, Typ: h.typ, Pid: h.pid}
+		return
+	}
+	*out = *lk
+	out.Typ = syscall.F_UNLCK
+}
+
+// setlk takes, converts or releases lk for owner. It fails with EAGAIN
+// when another owner holds a conflicting lock.
+func (t *lockTable) setlk(key lockKey, owner uint64, lk *fuse.FileLock) syscall.Errno {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch lk.Typ {
+	case syscall.F_UNLCK:
+	case syscall.F_RDLCK, syscall.F_WRLCK:
+		if _, ok := t.conflict(key, owner, lk); ok {
+			return syscall.EAGAIN
+		}
+	default:
+		return syscall.EINVAL
+	}
+
+	// Cut the range out of what owner already holds, then add the new
+	// lock. Giving up part of a lock may unblock a waiter.
+	var kept []heldLock
+	for _, h := range t.locks[key] {
+		if h.owner != owner || h.end < lk.Start || lk.End < h.start {
+			kept = append(kept, h)
+			continue
+		}
+		if h.start < lk.Start {
+			l := h
+			l.end = lk.Start - 1
+			kept = append(kept, l)
+		}
+		if h.end > lk.End {
+			r := h
+			r.start = lk.End + 1
+			kept = append(kept, r)
+		}
+	}
+	if lk.Typ != syscall.F_UNLCK {
+		kept = append(kept, heldLock{owner: owner, start: lk.Start, end: lk.End, typ: lk.Typ, pid: lk.Pid})
+	}
+	if len(kept) == 0 {
+		delete(t.locks, key)
+	} else {
+		t.locks[key] = kept
+	}
+	close(t.released)
+	t.released = make(chan struct{})
+	return 0
+}
+
+// setlkw is setlk that waits for conflicting locks to go away. It gives
+// up with EINTR when ctx is done, which is how FUSE interrupts arrive.
+func (t *lockTable) setlkw(ctx context.Context, key lockKey, owner uint64, lk *fuse.FileLock) syscall.Errno {
+	for {
+		t.mu.Lock()
+		released := t.released
+		t.mu.Unlock()
+		errno := t.setlk(key, owner, lk)
+		if errno != syscall.EAGAIN {
+			return errno
+		}
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return syscall.EINTR
+		}
+	}
+}
+
+// releaseOwner drops every lock owner holds on key.
+func (t *lockTable) releaseOwner(key lockKey, owner uint64) {
+	t.setlk(key, owner, &fuse.FileLock{Start: 0, End: maxLockOffset, Typ: syscall.F_UNLCK})
+}
+
+// maxLockOffset is the End of a lock that runs to the end of the file.
+const maxLockOffset = 1<<63 - 1
+
+// Getlk, Setlk and Setlkw pass lock requests on to the handle they are
+// made through. go-fuse bridges before v2.2 only look for them on the
+// node.
+func (n *sdfsNode) Getlk(ctx context.Context, f ffs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) syscall.Errno {
+	if fh, ok := f.(*sdfsFile); ok {
+		return fh.Getlk(ctx, owner, lk, flags, out)
+	}
+	return syscall.EBADF
+}
+
+func (n *sdfsNode) Setlk(ctx context.Context, f ffs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	if fh, ok := f.(*sdfsFile); ok {
+		return fh.Setlk(ctx, owner, lk, flags)
+	}
+	return syscall.EBADF
+}
+
+func (n *sdfsNode) Setlkw(ctx context.Context, f ffs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	if fh, ok := f.(*sdfsFile); ok {
+		return fh.Setlkw(ctx, owner, lk, flags)
+	}
+	return syscall.EBADF
+}
+
+// lockReleaser is the FUSE filesystem of the node bridge, except that it
+// drops the fcntl locks of the lock owner a FLUSH comes with. The kernel
+// sends a FLUSH whenever a process closes a descriptor, and POSIX has the
+// process lose every lock it holds on the file then, through whichever
+// descriptor it took them. go-fuse does not hand the owner to the handle,
+// so the locks are released through the bridge as an unlock of the whole
+// file. Only owners that took fcntl locks on the node get one, so closing
+// a file costs nothing extra otherwise.
+type lockReleaser struct {
+	fuse.RawFileSystem
+
+	mu sync.Mutex
+	// held are the nodes and owners fcntl locks were taken for since
+	// their last FLUSH.
+	held map[lockHolder]bool
+}
+
+// lockHolder is a lock owner on a node, by its kernel node ID.
+type lockHolder struct {
+	node  uint64
+	owner uint64
+}
+
+func (l *lockReleaser) SetLk(cancel <-chan struct{}, in *fuse.LkIn) fuse.Status {
+	status := l.RawFileSystem.SetLk(cancel, in)
+	l.taken(in, status)
+	return status
+}
+
+func (l *lockReleaser) SetLkw(cancel <-chan struct{}, in *fuse.LkIn) fuse.Status {
+	status := l.RawFileSystem.SetLkw(cancel, in)
+	l.taken(in, status)
+	return status
+}
+
+// taken remembers the owner of a granted fcntl lock for the next FLUSH.
+func (l *lockReleaser) taken(in *fuse.LkIn, status fuse.Status) {
+	if !status.Ok() || in.LkFlags&fuse.FUSE_LK_FLOCK != 0 || in.Lk.Typ == syscall.F_UNLCK {
+		return
+	}
+	l.mu.Lock()
+	l.held[lockHolder{node: in.NodeId, owner: in.Owner}] = true
+	l.mu.Unlock()
+}
+
+func (l *lockReleaser) Flush(cancel <-chan struct{}, in *fuse.FlushIn) fuse.Status {
+	status := l.RawFileSystem.Flush(cancel, in)
+	holder := lockHolder{node: in.NodeId, owner: in.LockOwner}
+	l.mu.Lock()
+	held := l.held[holder]
+	delete(l.held, holder)
+	l.mu.Unlock()
+	if !held {
+		return status
+	}
+	// The unlock must happen even when the FLUSH was interrupted.
+	l.RawFileSystem.SetLk(nil, &fuse.LkIn{
+		InHeader: in.InHeader,
+		Fh:       in.Fh,
+		Owner:    in.LockOwner,
+		Lk:       fuse.FileLock{Start: 0, End: maxLockOffset, Typ: syscall.F_UNLCK},
+	})
+	return status
+}
+
+// NewRawFS returns the FUSE filesystem for the node tree of root, as
+// ffs.NewNodeFS does, with the locks of a process released when it closes
+// the file.
+func NewRawFS(root ffs.InodeEmbedder, opts *ffs.Options) fuse.RawFileSystem {
+	return newLockReleaser(ffs.NewNodeFS(root, opts))
+}
+
+func newLockReleaser(raw fuse.RawFileSystem) *lockReleaser {
+	return &lockReleaser{RawFileSystem: raw, held: make(map[lockHolder]bool)}
+}
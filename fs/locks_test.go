@@ -0,0 +1,245 @@
+package fs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	ffs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/opendedup/gofuse-sdfs/fs/sdfstest"
+)
+
+func TestLockConflicts(t *testing.T) {
+	root, _ := newTestRoot(t)
+	ctx := context.Background()
+	_, f1 := create(t, &root.sdfsNode, "file")
+	f2 := lookupOpen(t, root, "file")
+
+	rd := &fuse.FileLock{Start: 0, End: 99, Typ: syscall.F_RDLCK}
+	if errno := f1.Setlk(ctx, 1, rd, 0); errno != 0 {
+		t.Fatalf("Setlk(read): %v", errno)
+	}
+	if errno := f2.Setlk(ctx, 2, rd, 0); errno != 0 {
+		t.Errorf("second read lock: %v", errno)
+	}
+	wr := &fuse.FileLock{Start: 50, End: 149, Typ: syscall.F_WRLCK}
+	if errno := f2.Setlk(ctx, 2, wr, 0); errno != syscall.EAGAIN {
+		t.Errorf("write lock over a foreign read lock = %v, want EAGAIN", errno)
+	}
+
+	var out fuse.FileLock
+	if errno := f2.Getlk(ctx, 2, wr, 0, &out); errno != 0 {
+		t.Fatalf("Getlk: %v", errno)
+	}
+	if out.Typ != syscall.F_RDLCK || out.Start != 0 || out.End != 99 {
+		t.Errorf("Getlk = %+v, want owner 1's read lock", out)
+	}
+
+	// Unlocking the middle of a lock leaves both ends locked.
+	if errno := f1.Setlk(ctx, 1, &fuse.FileLock{Start: 40, End: 59, Typ: syscall.F_UNLCK}, 0); errno != 0 {
+		t.Fatalf("Setlk(unlock): %v", errno)
+	}
+	if errno := f2.Setlk(ctx, 2, &fuse.FileLock{Start: 0, End: 99, Typ: syscall.F_UNLCK}, 0); errno != 0 {
+		t.Fatalf("Setlk(unlock): %v", errno)
+	}
+	for _, tc := range []struct {
+		start, end uint64
+		want       syscall.Errno
+	}{
+		{40, 59, 0},
+		{30, 45, syscall.EAGAIN},
+		{55, 70, syscall.EAGAIN},
+	} {
+		lk := &fuse.FileLock{Start: tc.start, End: tc.end, Typ: syscall.F_WRLCK}
+		if errno := f2.Setlk(ctx, 2, lk, 0); errno != tc.want {
+			t.Errorf("write lock [%d,%d] = %v, want %v", tc.start, tc.end, errno, tc.want)
+		}
+	}
+
+	// fcntl and flock locks do not conflict.
+	whole := &fuse.FileLock{Start: 0, End: maxLockOffset, Typ: syscall.F_WRLCK}
+	if errno := f2.Setlk(ctx, 2, whole, fuse.FUSE_LK_FLOCK); errno != 0 {
+		t.Errorf("flock next to fcntl locks: %v", errno)
+	}
+}
+
+func TestSetlkwWaits(t *testing.T) {
+	root, _ := newTestRoot(t)
+	ctx := context.Background()
+	_, f1 := create(t, &root.sdfsNode, "file")
+	f2 := lookupOpen(t, root, "file")
+
+	wr := &fuse.FileLock{Start: 0, End: maxLockOffset, Typ: syscall.F_WRLCK}
+	if errno := f1.Setlk(ctx, 1, wr, 0); errno != 0 {
+		t.Fatalf("Setlk: %v", errno)
+	}
+	done := make(chan syscall.Errno)
+	go func() {
+		done <- f2.Setlkw(ctx, 2, wr, 0)
+	}()
+	select {
+	case errno := <-done:
+		t.Fatalf("Setlkw returned %v while the lock was held", errno)
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock := &fuse.FileLock{Start: 0, End: maxLockOffset, Typ: syscall.F_UNLCK}
+	if errno := f1.Setlk(ctx, 1, unlock, 0); errno != 0 {
+		t.Fatalf("Setlk(unlock): %v", errno)
+	}
+	select {
+	case errno := <-done:
+		if errno != 0 {
+			t.Errorf("Setlkw: %v", errno)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Setlkw still waiting after the lock was released")
+	}
+}
+
+func TestSetlkwInterrupted(t *testing.T) {
+	root, _ := newTestRoot(t)
+	_, f1 := create(t, &root.sdfsNode, "file")
+	f2 := lookupOpen(t, root, "file")
+
+	wr := &fuse.FileLock{Start: 0, End: maxLockOffset, Typ: syscall.F_WRLCK}
+	if errno := f1.Setlk(context.Background(), 1, wr, fuse.FUSE_LK_FLOCK); errno != 0 {
+		t.Fatalf("Setlk: %v", errno)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan syscall.Errno)
+	go func() {
+		done <- f2.Setlkw(ctx, 2, wr, fuse.FUSE_LK_FLOCK)
+	}()
+	cancel()
+	select {
+	case errno := <-done:
+		if errno != syscall.EINTR {
+			t.Errorf("interrupted Setlkw = %v, want EINTR", errno)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Setlkw ignored the interrupt")
+	}
+}
+
+func TestFlockReleasedWithHandle(t *testing.T) {
+	root, _ := newTestRoot(t)
+	ctx := context.Background()
+	_, f1 := create(t, &root.sdfsNode, "file")
+	f2 := lookupOpen(t, root, "file")
+
+	wr := &fuse.FileLock{Start: 0, End: maxLockOffset, Typ: syscall.F_WRLCK}
+	if errno := f1.Setlk(ctx, 1, wr, fuse.FUSE_LK_FLOCK); errno != 0 {
+		t.Fatalf("Setlk: %v", errno)
+	}
+	if errno := f2.Setlk(ctx, 2, wr, fuse.FUSE_LK_FLOCK); errno != syscall.EAGAIN {
+		t.Errorf("second flock = %v, want EAGAIN", errno)
+	}
+	f1.Release(ctx)
+	if errno := f2.Setlk(ctx, 2, wr, fuse.FUSE_LK_FLOCK); errno != 0 {
+		t.Errorf("flock after the holder was released: %v", errno)
+	}
+}
+
+// lookupOpen opens another handle on the file name below root.
+func lookupOpen(t *testing.T, root *sdfsRoot, name string) *sdfsFile {
+	t.Helper()
+	fh, _, errno := lookup(t, &root.sdfsNode, name).Open(context.Background(), syscall.O_RDWR)
+	if errno != 0 {
+		t.Fatalf("Open(%q): %v", name, errno)
+	}
+	return fh.(*sdfsFile)
+}
+
+// TestCloseReleasesLocks closes a descriptor the way the kernel does, with
+// a FLUSH carrying the lock owner, and expects its fcntl locks to be gone.
+func TestCloseReleasesLocks(t *testing.T) {
+	mb := sdfstest.NewMemBackend()
+	mb.MkNod(context.Background(), "/file", syscall.S_IFREG|0644, 0)
+	root, err := NewsdfsRoot(mb, ConnectionInfo{MountPath: "/mnt/sdfs-test"})
+	if err != nil {
+		t.Fatalf("NewsdfsRoot: %v", err)
+	}
+	raw := NewRawFS(root, &ffs.Options{})
+
+	var entry fuse.EntryOut
+	if st := raw.Lookup(nil, &fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "file", &entry); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	header := fuse.InHeader{NodeId: entry.NodeId}
+	open := func() uint64 {
+		var out fuse.OpenOut
+		if st := raw.Open(nil, &fuse.OpenIn{InHeader: header, Flags: syscall.O_RDWR}, &out); !st.Ok() {
+			t.Fatalf("Open: %v", st)
+		}
+		return out.Fh
+	}
+	lock := func(fh, owner uint64) fuse.Status {
+		return raw.SetLk(nil, &fuse.LkIn{InHeader: header, Fh: fh, Owner: owner,
+			Lk: fuse.FileLock{Start: 10, End: 19, Typ: syscall.F_WRLCK}})
+	}
+
+	fh1, fh2 := open(), open()
+	if st := lock(fh1, 1); !st.Ok() {
+		t.Fatalf("SetLk: %v", st)
+	}
+	if st := lock(fh2, 2); st != fuse.Status(syscall.EAGAIN) {
+		t.Fatalf("SetLk over a held lock = %v, want EAGAIN", st)
+	}
+	// Another process closing the file leaves the lock alone.
+	raw.Flush(nil, &fuse.FlushIn{InHeader: header, Fh: fh2, LockOwner: 2})
+	if st := lock(fh2, 2); st != fuse.Status(syscall.EAGAIN) {
+		t.Fatalf("SetLk after a foreign close = %v, want EAGAIN", st)
+	}
+	raw.Flush(nil, &fuse.FlushIn{InHeader: header, Fh: fh1, LockOwner: 1})
+	if st := lock(fh2, 2); !st.Ok() {
+		t.Errorf("SetLk after the holder closed the file: %v", st)
+	}
+}
+
+// countingRawFS counts the lock requests that reach it.
+type countingRawFS struct {
+	fuse.RawFileSystem
+	setlks int
+}
+
+func (c *countingRawFS) SetLk(cancel <-chan struct{}, in *fuse.LkIn) fuse.Status {
+	c.setlks++
+	return fuse.OK
+}
+
+// TestCloseWithoutLocks expects a FLUSH to unlock only for owners that
+// took fcntl locks on the node.
+func TestCloseWithoutLocks(t *testing.T) {
+	raw := &countingRawFS{RawFileSystem: fuse.NewDefaultRawFileSystem()}
+	l := newLockReleaser(raw)
+	header := fuse.InHeader{NodeId: 2}
+	flush := func(node, owner uint64) {
+		l.Flush(nil, &fuse.FlushIn{InHeader: fuse.InHeader{NodeId: node}, LockOwner: owner})
+	}
+	lock := func(owner uint64, typ, flags uint32) {
+		l.SetLk(nil, &fuse.LkIn{InHeader: header, Owner: owner, LkFlags: flags,
+			Lk: fuse.FileLock{Start: 0, End: 9, Typ: typ}})
+	}
+
+	flush(2, 1)
+	lock(1, syscall.F_WRLCK, fuse.FUSE_LK_FLOCK)
+	lock(2, syscall.F_UNLCK, 0)
+	flush(2, 1)
+	flush(2, 2)
+	if raw.setlks != 2 {
+		t.Errorf("%d lock requests, want only the two made", raw.setlks)
+	}
+	lock(1, syscall.F_RDLCK, 0)
+	flush(3, 1)
+	flush(2, 2)
+	if raw.setlks != 3 {
+		t.Errorf("%d lock requests, want no unlock for other nodes and owners", raw.setlks)
+	}
+	flush(2, 1)
+	flush(2, 1)
+	if raw.setlks != 4 {
+		t.Errorf("%d lock requests, want one unlock for the owner of the lock", raw.setlks)
+	}
+}
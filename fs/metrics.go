@@ -0,0 +1,231 @@
+package fs
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	ffs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// opMetrics holds the Prometheus metrics of a mount. A nil *opMetrics
+// records nothing, which is the case unless ServeMetrics was called.
+type opMetrics struct {
+	registry   *prometheus.Registry
+	ops        *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+	latency    *prometheus.HistogramVec
+	bytes      *prometheus.CounterVec
+	handles    prometheus.Gauge
+	dirStreams prometheus.Gauge
+}
+
+func newOpMetrics(r *sdfsRoot) *opMetrics {
+	m := &opMetrics{
+		registry: prometheus.NewRegistry(),
+		ops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sdfs_fuse_ops_total",
+			Help: "FUSE operations handled, by operation.",
+		}, []string{"op"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sdfs_fuse_errors_total",
+			Help: "FUSE operations that failed, by operation and errno.",
+		}, []string{"op", "errno"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "sdfs_fuse_op_duration_seconds",
+			Help:    "Time taken to handle FUSE operations, by operation.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 18),
+		}, []string{"op"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sdfs_bytes_total",
+			Help: "File data read and written through the mount.",
+		}, []string{"direction"}),
+		handles: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "sdfs_open_handles",
+			Help: "Open file handles.",
+		}),
+		dirStreams: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "sdfs_dir_streams",
+			Help: "Open directory streams.",
+		}),
+	}
+	m.registry.MustRegister(m.ops, m.errors, m.latency, m.bytes, m.handles, m.dirStreams, rootCollector{r})
+	return m
+}
+
+// observe records an operation that started at start and ended with
+// *errno. It is meant to be deferred on entry.
+func (m *opMetrics) observe(op string, start time.Time, errno *syscall.Errno) {
+	if m == nil {
+		return
+	}
+	m.ops.WithLabelValues(op).Inc()
+	m.latency.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if *errno != 0 {
+		m.errors.WithLabelValues(op, errnoName(*errno)).Inc()
+	}
+}
+
+func errnoName(errno syscall.Errno) string {
+	if name := unix.ErrnoName(errno); name != "" {
+		return name
+	}
+	return errno.Error()
+}
+
+func (m *opMetrics) transferred(direction string, n int) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.bytes.WithLabelValues(direction).Add(float64(n))
+}
+
+func (m *opMetrics) handleOpened() {
+	if m != nil {
+		m.handles.Inc()
+	}
+}
+
+func (m *opMetrics) handleClosed() {
+	if m != nil {
+		m.handles.Dec()
+	}
+}
+
+func (m *opMetrics) dirStreamOpened() {
+	if m != nil {
+		m.dirStreams.Inc()
+	}
+}
+
+func (m *opMetrics) dirStreamClosed() {
+	if m != nil {
+		m.dirStreams.Dec()
+	}
+}
+
+// cacheStats counts the hits and misses of a cache.
+type cacheStats struct {
+	hits, misses uint64
+}
+
+func (s *cacheStats) hit() {
+	atomic.AddUint64(&s.hits, 1)
+}
+
+func (s *cacheStats) miss() {
+	atomic.AddUint64(&s.misses, 1)
+}
+
+func (s *cacheStats) load() (hits, misses uint64) {
+	return atomic.LoadUint64(&s.hits), atomic.LoadUint64(&s.misses)
+}
+
+// reconnectCounter is implemented by backends that re-establish their
+// connection to the volume.
+type reconnectCounter interface {
+	reconnectCount() uint64
+}
+
+var (
+	cacheDesc = prometheus.NewDesc("sdfs_cache_requests_total",
+		"Lookups in the caches of the mount, by cache and result.", []string{"cache", "result"}, nil)
+	reconnectsDesc = prometheus.NewDesc("sdfs_reconnects_total",
+		"Connections to the volume made after the first one.", nil, nil)
+	unexpectedDesc = prometheus.NewDesc("sdfs_unexpected_errors_total",
+		"Errors that did not come from the volume, by class.", []string{"class"}, nil)
+)
+
+// cacheCounts returns the counters of the caches of r by name.
+func (r *sdfsRoot) cacheCounts() map[string]*cacheStats {
+	caches := map[string]*cacheStats{}
+	if r.cache != nil {
+		caches["attr"] = &r.cache.counts
+	}
+	if r.blocks != nil {
+		caches["block"] = &r.blocks.counts
+	}
+	if r.reads != nil {
+		caches["readahead"] = &r.reads.counts
+	}
+	return caches
+}
+
+// rootCollector reports the counters the mount keeps for itself when
+// metrics are scraped.
+type rootCollector struct {
+	r *sdfsRoot
+}
+
+func (c rootCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheDesc
+	ch <- reconnectsDesc
+	ch <- unexpectedDesc
+}
+
+func (c rootCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, s := range c.r.cacheCounts() {
+		hits, misses := s.load()
+		ch <- prometheus.MustNewConstMetric(cacheDesc, prometheus.CounterValue, float64(hits), name, "hit")
+		ch <- prometheus.MustNewConstMetric(cacheDesc, prometheus.CounterValue, float64(misses), name, "miss")
+	}
+	if rc, ok := c.r.con.(reconnectCounter); ok {
+		ch <- prometheus.MustNewConstMetric(reconnectsDesc, prometheus.CounterValue, float64(rc.reconnectCount()))
+	}
+	for class, n := range c.r.unexpected.load() {
+		ch <- prometheus.MustNewConstMetric(unexpectedDesc, prometheus.CounterValue, float64(n), class)
+	}
+}
+
+// ServeMetrics records metrics for root, a node returned by NewsdfsRoot,
+// and serves them for Prometheus at /metrics on addr, which is host:port
+// or unix:path. It has to be called before root is mounted. Closing the
+// returned listener stops serving.
+func ServeMetrics(root ffs.InodeEmbedder, addr string) (net.Listener, error) {
+	r := root.(*sdfsRoot)
+	if r.metrics == nil {
+		r.metrics = newOpMetrics(r)
+	}
+	l, err := listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(r.metrics.registry, promhttp.HandlerOpts{}))
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Debugf("metrics listener on %s stopped %v", addr, err)
+		}
+	}()
+	return l, nil
+}
+
+// listen listens on a unix socket for addresses starting with unix: and
+// on TCP otherwise. A socket left behind by an earlier run is replaced,
+// but one that is still answered is in use and a file that is not a
+// socket is kept.
+func listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if c, err := net.Dial("unix", path); err == nil {
+				c.Close()
+				return nil, fmt.Errorf("%s is in use by another process", path)
+			}
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
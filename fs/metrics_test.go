@@ -0,0 +1,88 @@
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// unixClient returns an HTTP client that sends every request to the unix
+// socket at path.
+func unixClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+// scrape fetches the metrics served on the unix socket at path.
+func scrape(t *testing.T, path string) string {
+	t.Helper()
+	resp, err := unixClient(path).Get("http://sdfs/metrics")
+	if err != nil {
+		t.Fatalf("scraping metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading metrics: %v", err)
+	}
+	return string(b)
+}
+
+func TestMetrics(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	root, _ := newTestRoot(t)
+	ctx := context.Background()
+	root.cache = newAttrCache(time.Minute, 0)
+	sock := filepath.Join(dir, "metrics.sock")
+	l, err := ServeMetrics(root, "unix:"+sock)
+	if err != nil {
+		t.Fatalf("ServeMetrics: %v", err)
+	}
+	defer l.Close()
+
+	node, fh := create(t, &root.sdfsNode, "file")
+	defer fh.Release(ctx)
+	fh.Write(ctx, []byte("hello"), 0)
+	var out fuse.AttrOut
+	node.Getattr(ctx, nil, &out)
+	node.Getattr(ctx, nil, &out)
+	var eout fuse.EntryOut
+	if _, errno := root.Lookup(ctx, "missing", &eout); errno != syscall.ENOENT {
+		t.Fatalf("Lookup(missing) = %v", errno)
+	}
+	readDir(t, &root.sdfsNode)
+
+	text := scrape(t, sock)
+	for _, want := range []string{
+		`sdfs_fuse_ops_total{op="create"} 1`,
+		`sdfs_fuse_ops_total{op="getattr"} 2`,
+		`sdfs_fuse_op_duration_seconds_count{op="write"} 1`,
+		`sdfs_fuse_errors_total{errno="ENOENT",op="lookup"} 1`,
+		`sdfs_bytes_total{direction="write"} 5`,
+		`sdfs_open_handles 1`,
+		`sdfs_dir_streams 0`,
+		`sdfs_cache_requests_total{cache="attr",result="hit"}`,
+		`sdfs_cache_requests_total{cache="attr",result="miss"}`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+	if strings.Contains(text, `sdfs_fuse_errors_total{errno="ENOENT",op="getattr"}`) {
+		t.Errorf("successful operations counted as errors")
+	}
+}
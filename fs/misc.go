@@ -1,19 +1,133 @@
 package fs
 
 import (
+	"context"
+	"errors"
+	"sync"
 	"syscall"
 
-	"github.com/hanwen/go-fuse/fuse"
 	spb "github.com/opendedup/sdfs-client-go/api"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// grpcErrnos maps the status codes of failed RPCs to the errno reported
+// to applications.
+var grpcErrnos = map[codes.Code]syscall.Errno{
+	codes.Canceled:           syscall.EINTR,
+	codes.Unknown:            syscall.EIO,
+	codes.InvalidArgument:    syscall.EINVAL,
+	codes.DeadlineExceeded:   syscall.ETIMEDOUT,
+	codes.NotFound:           syscall.ENOENT,
+	codes.AlreadyExists:      syscall.EEXIST,
+	codes.PermissionDenied:   syscall.EACCES,
+	codes.ResourceExhausted:  syscall.ENOSPC,
+	codes.FailedPrecondition: syscall.EPERM,
+	codes.Aborted:            syscall.EAGAIN,
+	codes.OutOfRange:         syscall.ERANGE,
+	codes.Unimplemented:      syscall.ENOSYS,
+	codes.Internal:           syscall.EIO,
+	codes.Unavailable:        syscall.ENOTCONN,
+	codes.DataLoss:           syscall.EIO,
+	codes.Unauthenticated:    syscall.EACCES,
+}
+
+// errorCounts counts the errors that did not come from the volume, by
+// class.
+type errorCounts struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func newErrorCounts() *errorCounts {
+	return &errorCounts{counts: make(map[string]uint64)}
+}
+
+// add counts err when it did not come from the volume.
+func (c *errorCounts) add(err error) {
+	class := unexpectedClass(err)
+	if c == nil || class == "" {
+		return
+	}
+	log.Debugf("unexpected %s error %v", class, err)
+	c.mu.Lock()
+	c.counts[class]++
+	c.mu.Unlock()
+}
+
+// load returns how often each class of error was counted.
+func (c *errorCounts) load() map[string]uint64 {
+	counts := make(map[string]uint64)
+	if c == nil {
+		return counts
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for class, n := range c.counts {
+		counts[class] = n
+	}
+	return counts
+}
+
+// unexpectedClass returns the class of an error that did not come from
+// the volume itself: "canceled", "deadline", "grpc:<code>" for failed RPCs
+// and "other". Errors of the volume and errnos have none.
+func unexpectedClass(err error) string {
+	var serr *spb.SdfsError
+	var errno syscall.Errno
+	switch {
+	case err == nil, errors.As(err, &serr), errors.As(err, &errno):
+		return ""
+	}
+	if st, ok := grpcStatus(err); ok {
+		return "grpc:" + st.Code().String()
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "deadline"
+	}
+	return "other"
+}
+
+// grpcStatus returns the status of the failed RPC somewhere in the chain
+// of err.
+func grpcStatus(err error) (*status.Status, bool) {
+	var se interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &se) {
+		return se.GRPCStatus(), true
+	}
+	return nil, false
+}
+
 // ToErrno exhumes the syscall.Errno error from wrapped error values.
+// Errors of the volume carry their errno. Cancellations, timeouts and
+// failed RPCs are mapped to the closest errno and anything else is EIO.
 func ToErrno(err error) syscall.Errno {
 	if err == nil {
 		return syscall.Errno(0)
 	}
-	if e, ok := err.(*spb.SdfsError); ok {
-		return syscall.Errno(e.ErrorCode)
+	var serr *spb.SdfsError
+	if errors.As(err, &serr) {
+		return syscall.Errno(serr.ErrorCode)
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno
+	}
+	if st, ok := grpcStatus(err); ok {
+		if errno, ok := grpcErrnos[st.Code()]; ok {
+			return errno
+		}
+		return syscall.EIO
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return syscall.EINTR
+	case errors.Is(err, context.DeadlineExceeded):
+		return syscall.ETIMEDOUT
 	}
-	return syscall.Errno(fuse.ENOSYS)
+	return syscall.EIO
 }
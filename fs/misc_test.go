@@ -0,0 +1,80 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	spb "github.com/opendedup/sdfs-client-go/api"
+	sapi "github.com/opendedup/sdfs-client-go/sdfs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestToErrno(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want syscall.Errno
+	}{
+		{nil, 0},
+		{&spb.SdfsError{Err: "missing", ErrorCode: syscall.ENOENT}, syscall.ENOENT},
+		{fmt.Errorf("stat /a: %w", &spb.SdfsError{Err: "full", ErrorCode: syscall.ENOSPC}), syscall.ENOSPC},
+		{syscall.EROFS, syscall.EROFS},
+		{fmt.Errorf("open: %w", syscall.EBADF), syscall.EBADF},
+		{context.Canceled, syscall.EINTR},
+		{fmt.Errorf("read: %w", context.DeadlineExceeded), syscall.ETIMEDOUT},
+		{status.Error(codes.Unavailable, "connection refused"), syscall.ENOTCONN},
+		{status.Error(codes.DeadlineExceeded, "deadline"), syscall.ETIMEDOUT},
+		{status.Error(codes.PermissionDenied, "denied"), syscall.EACCES},
+		{status.Error(codes.Unauthenticated, "bad token"), syscall.EACCES},
+		{status.Error(codes.NotFound, "gone"), syscall.ENOENT},
+		{status.Error(codes.Canceled, "canceled"), syscall.EINTR},
+		{status.Error(codes.ResourceExhausted, "too large"), syscall.ENOSPC},
+		{fmt.Errorf("write: %w", status.Error(codes.Internal, "oops")), syscall.EIO},
+		{errors.New("something else"), syscall.EIO},
+	} {
+		if got := ToErrno(tc.err); got != tc.want {
+			t.Errorf("ToErrno(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+// unreachableFile fails GetAttr of /file as a volume that cannot be
+// reached does.
+type unreachableFile struct {
+	Backend
+}
+
+func (b unreachableFile) GetAttr(ctx context.Context, path string) (*sapi.Stat, error) {
+	if path == "/file" {
+		return nil, status.Error(codes.Unavailable, "down")
+	}
+	return b.Backend.GetAttr(ctx, path)
+}
+
+func TestUnexpectedErrorCounts(t *testing.T) {
+	root, mb := newTestRoot(t)
+	ctx := context.Background()
+	if err := mb.MkNod(ctx, "/file", syscall.S_IFREG|0644, 0); err != nil {
+		t.Fatal(err)
+	}
+	// The traced request and the attribute cache look at the error too.
+	root.con = withTracing(unreachableFile{mb})
+
+	var out fuse.EntryOut
+	if _, errno := root.Lookup(ctx, "file", &out); errno != syscall.ENOTCONN {
+		t.Fatalf("Lookup = %v, want ENOTCONN", errno)
+	}
+	if _, errno := root.Lookup(ctx, "missing", &out); errno != syscall.ENOENT {
+		t.Fatalf("Lookup of a missing file = %v, want ENOENT", errno)
+	}
+	ToErrno(errors.New("converted outside of an operation"))
+	want := map[string]uint64{"grpc:Unavailable": 1}
+	if got := root.unexpected.load(); !reflect.DeepEqual(got, want) {
+		t.Errorf("counted %v, want %v: the failed lookup once, volume errors not at all", got, want)
+	}
+}
@@ -0,0 +1,102 @@
+package fs
+
+import (
+	"context"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	sapi "github.com/opendedup/sdfs-client-go/sdfs"
+)
+
+// ownerBackend reports every file as owned by uid and gid, where set,
+// whatever the volume records, as the uid and gid mount options ask for.
+type ownerBackend struct {
+	Backend
+	uid *uint32
+	gid *uint32
+}
+
+// withOwner returns con with the owner and group of its files replaced,
+// or con itself when neither is set.
+func withOwner(con Backend, uid, gid *uint32) Backend {
+	if uid == nil && gid == nil {
+		return con
+	}
+	return &ownerBackend{Backend: con, uid: uid, gid: gid}
+}
+
+// own returns a copy of fi with the owner and group replaced.
+func (o *ownerBackend) own(fi *sapi.Stat) *sapi.Stat {
+	if fi == nil {
+		return nil
+	}
+	c := *fi
+	if o.uid != nil {
+		c.Uid = int32(*o.uid)
+	}
+	if o.gid != nil {
+		c.Gid = int32(*o.gid)
+	}
+	return &c
+}
+
+var _ = (wrapper)((*ownerBackend)(nil))
+
+func (o *ownerBackend) unwrap() Backend {
+	return o.Backend
+}
+
+// CloseConnection closes the connection underneath, so that a reconnecting
+// backend can still let go of a connection it replaced.
+func (o *ownerBackend) CloseConnection(ctx context.Context) {
+	if c, ok := o.Backend.(interface{ CloseConnection(context.Context) }); ok {
+		c.CloseConnection(ctx)
+	}
+}
+
+func (o *ownerBackend) GetAttr(ctx context.Context, path string) (*sapi.Stat, error) {
+	fi, err := o.Backend.GetAttr(ctx, path)
+	return o.own(fi), err
+}
+
+func (o *ownerBackend) ListDir(ctx context.Context, path, marker string, compact bool, returnsize int32) (string, []*sapi.Stat, error) {
+	marker, fis, err := o.Backend.ListDir(ctx, path, marker, compact, returnsize)
+	for i, fi := range fis {
+		fis[i] = o.own(fi)
+	}
+	return marker, fis, err
+}
+
+func (o *ownerBackend) RenameWithFlags(ctx context.Context, src, dst string, flags uint32) error {
+	if fr, ok := o.Backend.(FlagRenamer); ok {
+		return fr.RenameWithFlags(ctx, src, dst, flags)
+	}
+	return errNotSupported
+}
+
+func (o *ownerBackend) GetLock(ctx context.Context, path string, owner uint64, lk *fuse.FileLock, flock bool) (*fuse.FileLock, error) {
+	if l, ok := o.Backend.(Locker); ok {
+		return l.GetLock(ctx, path, owner, lk, flock)
+	}
+	return nil, errNotSupported
+}
+
+func (o *ownerBackend) SetLock(ctx context.Context, path string, owner uint64, lk *fuse.FileLock, flock, wait bool) error {
+	if l, ok := o.Backend.(Locker); ok {
+		return l.SetLock(ctx, path, owner, lk, flock, wait)
+	}
+	return errNotSupported
+}
+
+func (o *ownerBackend) Allocate(ctx context.Context, path string, offset, length int64, mode uint32) error {
+	if a, ok := o.Backend.(Allocator); ok {
+		return a.Allocate(ctx, path, offset, length, mode)
+	}
+	return errNotSupported
+}
+
+func (o *ownerBackend) Append(ctx context.Context, fd int64, data []byte, length int32) (int64, error) {
+	if a, ok := o.Backend.(Appender); ok {
+		return a.Append(ctx, fd, data, length)
+	}
+	return 0, errNotSupported
+}
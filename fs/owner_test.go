@@ -0,0 +1,47 @@
+package fs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestOwnerOverride(t *testing.T) {
+	root, mb := newTestRoot(t)
+	ctx := context.Background()
+	_, fh := create(t, &root.sdfsNode, "file")
+	fh.Release(ctx)
+	if err := mb.Chown(ctx, "/file", 20, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if con := withOwner(mb, nil, nil); con != Backend(mb) {
+		t.Errorf("withOwner without uid and gid wrapped the backend")
+	}
+	uid := uint32(1000)
+	root.con = withOwner(mb, &uid, nil)
+
+	var out fuse.AttrOut
+	if errno := lookup(t, &root.sdfsNode, "file").Getattr(ctx, nil, &out); errno != 0 {
+		t.Fatalf("Getattr: %v", errno)
+	}
+	if out.Uid != 1000 || out.Gid != 20 {
+		t.Errorf("owner %d:%d, want 1000 and the group of the volume", out.Uid, out.Gid)
+	}
+
+	// Entries come from the listing when the directory is read first.
+	readDir(t, &root.sdfsNode)
+	var entry fuse.EntryOut
+	if _, errno := root.Lookup(ctx, "file", &entry); errno != 0 {
+		t.Fatalf("Lookup: %v", errno)
+	}
+	if entry.Uid != 1000 || entry.Gid != 20 {
+		t.Errorf("listed owner %d:%d, want 1000 and the group of the volume", entry.Uid, entry.Gid)
+	}
+
+	fi, err := mb.GetAttr(ctx, "/file")
+	if err != nil || fi.Uid != 10 {
+		t.Errorf("the volume records %v, %v, want the owner left alone", fi, err)
+	}
+}
@@ -0,0 +1,243 @@
+package fs
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultReadAheadSize is the largest window a handle reads ahead and
+// DefaultReadAheadParallel the number of reads that fill it concurrently.
+const (
+	DefaultReadAheadSize     = 4 << 20
+	DefaultReadAheadParallel = 4
+)
+
+// minReadAheadChunk is the smallest read issued to fill the window.
+const minReadAheadChunk = 64 << 10
+
+// readAheads holds the read-ahead settings of a mount and a version per
+// open inode that changes whenever data of the inode is written, so that
+// prefetched data of every handle can be checked against it.
+type readAheads struct {
+	chunk    int
+	parallel int
+
+	mu    sync.Mutex
+	files map[uint64]*inoVersion
+
+	counts cacheStats
+}
+
+type inoVersion struct {
+	handles int
+	version uint64
+}
+
+func newReadAheads(size, parallel int) *readAheads {
+	if parallel <= 0 {
+		parallel = 1
+	}
+	chunk := 0
+	if size > 0 {
+		chunk = size / parallel
+		if chunk < minReadAheadChunk {
+			chunk = minReadAheadChunk
+		}
+	}
+	return &readAheads{
+		chunk:    chunk,
+		parallel: parallel,
+		files:    make(map[uint64]*inoVersion),
+	}
+}
+
+func (r *readAheads) enabled() bool {
+	return r != nil && r.chunk > 0
+}
+
+// open and close track the handles of ino.
+func (r *readAheads) open(ino uint64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v, ok := r.files[ino]
+	if !ok {
+		v = &inoVersion{}
+		r.files[ino] = v
+	}
+	v.handles++
+}
+
+func (r *readAheads) close(ino uint64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if v, ok := r.files[ino]; ok {
+		v.handles--
+		if v.handles <= 0 {
+			delete(r.files, ino)
+		}
+	}
+}
+
+// version returns the current data version of ino.
+func (r *readAheads) version(ino uint64) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if v, ok := r.files[ino]; ok {
+		return v.version
+	}
+	return 0
+}
+
+// invalidate makes data read ahead for ino so far stale. It is called
+// after the data of ino changed on the server.
+func (r *readAheads) invalidate(ino uint64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if v, ok := r.files[ino]; ok {
+		v.version++
+	}
+}
+
+// invalidateAll makes all data read ahead so far stale.
+func (r *readAheads) invalidateAll() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range r.files {
+		v.version++
+	}
+}
+
+// readChunk is one read issued ahead of the kernel asking for it.
+type readChunk struct {
+	off     int64
+	version uint64
+	done    chan struct{}
+	data    []byte
+	err     error
+}
+
+// readAhead is the read-ahead state of a handle. The window grows while
+// reads are sequential and is dropped by the first read elsewhere.
+type readAhead struct {
+	mu     sync.Mutex
+	next   int64
+	window int
+	chunks []*readChunk
+	// fetching counts reads in flight, including those of chunks that
+	// were dropped before they completed.
+	fetching sync.WaitGroup
+}
+
+// readAhead serves a read of len(buf) bytes at off from data read ahead,
+// copying it to buf. It returns false when the read should go straight
+// to the server, such as for random access, after the data changed or
+// when ctx is done while waiting for a chunk.
+func (f *sdfsFile) readAhead(ctx context.Context, off int64, buf []byte) (int, bool) {
+	if !f.reads.enabled() {
+		return 0, false
+	}
+	ra := &f.ra
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	end := off + int64(len(buf))
+	if off != ra.next {
+		ra.chunks = nil
+		ra.window = 0
+		ra.next = end
+		return 0, false
+	}
+	// The window is counted in chunks and doubles with every sequential
+	// read until all parallel reads are in use.
+	if ra.window == 0 {
+		ra.window = 1
+	} else if ra.window < f.reads.parallel {
+		ra.window *= 2
+		if ra.window > f.reads.parallel {
+			ra.window = f.reads.parallel
+		}
+	}
+
+	chunk := int64(f.reads.chunk)
+	for len(ra.chunks) > 0 && ra.chunks[0].off+chunk <= off {
+		ra.chunks = ra.chunks[1:]
+	}
+	if len(ra.chunks) > 0 && ra.chunks[0].off > off {
+		ra.chunks = nil
+	}
+	start := off
+	if len(ra.chunks) > 0 {
+		start = ra.chunks[len(ra.chunks)-1].off + chunk
+	}
+	version := f.reads.version(f.ino)
+	for len(ra.chunks) < ra.window || start < end {
+		c := &readChunk{off: start, version: version, done: make(chan struct{})}
+		ra.fetching.Add(1)
+		go f.fetch(c, int32(chunk))
+		ra.chunks = append(ra.chunks, c)
+		start += chunk
+	}
+
+	n := 0
+	for _, c := range ra.chunks {
+		if c.off >= end {
+			break
+		}
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			// The chunks stay for the next read.
+			return 0, false
+		}
+		if c.err != nil || c.version != f.reads.version(f.ino) {
+			ra.chunks = nil
+			ra.window = 0
+			ra.next = end
+			return 0, false
+		}
+		pos := off + int64(n) - c.off
+		if pos < int64(len(c.data)) {
+			n += copy(buf[n:], c.data[pos:])
+		}
+		if len(c.data) < int(chunk) {
+			// End of file.
+			break
+		}
+	}
+	ra.next = off + int64(n)
+	return n, true
+}
+
+// fetch fills c. It runs on its own and outlives the read that started
+// it, so it does not use the context of that read.
+func (f *sdfsFile) fetch(c *readChunk, size int32) {
+	defer f.ra.fetching.Done()
+	defer close(c.done)
+	c.data, c.err = f.readAt(context.Background(), c.off, size)
+	if c.err != nil {
+		log.Debugf("read ahead error for %s at %d %v", f.path, c.off, c.err)
+	}
+}
+
+// dropReadAhead forgets what f read ahead, waiting for reads in flight
+// so none of them is using the descriptor once it is released.
+func (f *sdfsFile) dropReadAhead() {
+	ra := &f.ra
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.fetching.Wait()
+	ra.chunks = nil
+}
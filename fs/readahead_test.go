@@ -0,0 +1,95 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+)
+
+// newReadAheadFile writes size bytes of a known pattern to name and
+// returns a fresh handle on it.
+func newReadAheadFile(t *testing.T, root *sdfsRoot, name string, size int) ([]byte, *sdfsFile) {
+	t.Helper()
+	ctx := context.Background()
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7 / 4096)
+	}
+	_, fh := create(t, &root.sdfsNode, name)
+	fh.Write(ctx, data, 0)
+	fh.Release(ctx)
+	return data, lookupOpen(t, root, name)
+}
+
+func TestReadAheadSequential(t *testing.T) {
+	root, mb := newTestRoot(t)
+	ctx := context.Background()
+	root.reads = newReadAheads(512<<10, 4)
+	data, fh := newReadAheadFile(t, root, "file", 2<<20+1000)
+	defer fh.Release(ctx)
+	mb.ResetCalls()
+
+	var got []byte
+	for off := 0; ; off += 128 << 10 {
+		b := readAll(t, fh, int64(off), 128<<10)
+		if len(b) == 0 {
+			break
+		}
+		got = append(got, b...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes that differ from the %d written", len(got), len(data))
+	}
+	// 17 chunks hold the file; the window may run a few past the end.
+	if n := mb.Calls("Read"); n < 17 || n > 17+4 {
+		t.Errorf("%d reads reached the server, want one per chunk", n)
+	}
+}
+
+func TestReadAheadRandom(t *testing.T) {
+	root, _ := newTestRoot(t)
+	ctx := context.Background()
+	root.reads = newReadAheads(512<<10, 4)
+	data, fh := newReadAheadFile(t, root, "file", 1<<20)
+	defer fh.Release(ctx)
+
+	rnd := rand.New(rand.NewSource(1))
+	off := 0
+	for i := 0; i < 200; i++ {
+		// Mix runs of sequential reads with jumps.
+		if rnd.Intn(3) == 0 {
+			off = rnd.Intn(len(data))
+		}
+		size := 1 + rnd.Intn(64<<10)
+		want := data[off:]
+		if len(want) > size {
+			want = want[:size]
+		}
+		if got := readAll(t, fh, int64(off), size); !bytes.Equal(got, want) {
+			t.Fatalf("read %d at %d returned wrong data", size, off)
+		}
+		off += len(want)
+		if off >= len(data) {
+			off = 0
+		}
+	}
+}
+
+func TestReadAheadInvalidatedByWrite(t *testing.T) {
+	root, _ := newTestRoot(t)
+	ctx := context.Background()
+	root.reads = newReadAheads(512<<10, 4)
+	_, fh := newReadAheadFile(t, root, "file", 1<<20)
+	defer fh.Release(ctx)
+
+	readAll(t, fh, 0, 4096)
+	readAll(t, fh, 4096, 4096)
+	w := lookupOpen(t, root, "file")
+	w.Write(ctx, []byte("changed"), 3*4096)
+	w.Release(ctx)
+	readAll(t, fh, 8192, 4096)
+	if got := readAll(t, fh, 3*4096, 7); string(got) != "changed" {
+		t.Errorf("read %q after another handle wrote, want changed", got)
+	}
+}
@@ -0,0 +1,669 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	spb "github.com/opendedup/sdfs-client-go/api"
+	sapi "github.com/opendedup/sdfs-client-go/sdfs"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+)
+
+// DefaultReconnectTimeout is how long operations wait for the volume to
+// come back before failing.
+const DefaultReconnectTimeout = time.Minute
+
+const (
+	minReconnectBackoff = 100 * time.Millisecond
+	maxReconnectBackoff = 10 * time.Second
+)
+
+// Dialer opens a new connection to a volume.
+type Dialer func() (Backend, error)
+
+// connState is one connection to the volume and the descriptors that
+// handed out file descriptors stand for on it.
+type connState struct {
+	con Backend
+	gen uint64
+	fds map[int64]int64
+}
+
+type trackedFile struct {
+	path  string
+	flags int32
+}
+
+// reconnectingBackend is a Backend that survives restarts of the volume
+// service. When an operation finds the volume unreachable, the connection
+// is dialed again with exponential backoff and every open file is
+// reopened with the flags it was opened with. Reads and lookups, which
+// can safely run twice, are then retried. Operations that change the
+// volume fail instead, since they may have been carried out before the
+// connection broke, but wait for a reconnect that is already under way
+// before they are sent. Operations wait up to timeout for the volume to
+// come back before they fail.
+//
+// File descriptors handed out stay the same across connections.
+type reconnectingBackend struct {
+	dial    Dialer
+	timeout time.Duration
+
+	mu      sync.Mutex
+	state   *connState
+	files   map[int64]*trackedFile
+	nextFd  int64
+	pending chan struct{}
+	// reconnects counts the connections made after the first one.
+	reconnects uint64
+}
+
+var _ = (Backend)((*reconnectingBackend)(nil))
+var _ = (wrapper)((*reconnectingBackend)(nil))
+
+var errStaleConnection = errors.New("connection replaced")
+
+// NewReconnectingBackend returns con wrapped so that it is replaced by a
+// connection from dial whenever it breaks.
+func NewReconnectingBackend(con Backend, dial Dialer, timeout time.Duration) Backend {
+	return &reconnectingBackend{
+		dial:    dial,
+		timeout: timeout,
+		state:   &connState{con: con, fds: make(map[int64]int64)},
+		files:   make(map[int64]*trackedFile),
+		nextFd:  1,
+	}
+}
+
+// Dial connects to the volume at root. Unless ReconnectTimeout is zero the
+// connection is re-established when it breaks. Requests are bounded by
+// the timeouts of their class, which include waiting for a reconnect.
+func Dial(root string, connectionInfo ConnectionInfo) (Backend, error) {
+	return dialWrapped(func() (Backend, error) {
+		con, err := NewConnection(root, connectionInfo)
+		if err != nil {
+			return nil, err
+		}
+		return con, nil
+	}, connectionInfo)
+}
+
+// dialWrapped connects with connect and wraps the connection as Dial
+// does.
+func dialWrapped(connect Dialer, connectionInfo ConnectionInfo) (Backend, error) {
+	dial := func() (Backend, error) {
+		con, err := connect()
+		if err != nil {
+			return nil, err
+		}
+		if connectionInfo.Trace {
+			con = withTracing(con)
+		}
+		return withOwner(con, connectionInfo.UID, connectionInfo.GID), nil
+	}
+	con, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	if connectionInfo.ReconnectTimeout > 0 {
+		con = NewReconnectingBackend(con, dial, connectionInfo.ReconnectTimeout)
+	}
+	return withTimeouts(con, connectionInfo.MetadataTimeout, connectionInfo.DataTimeout, connectionInfo.FsyncTimeout), nil
+}
+
+// isTransportError reports whether err means the volume could not be
+// reached, as opposed to the volume refusing the operation: gRPC has no
+// working connection to it, or the network failed underneath.
+func isTransportError(err error) bool {
+	var serr *spb.SdfsError
+	if err == nil || errors.As(err, &serr) {
+		return false
+	}
+	if st, ok := grpcStatus(err); ok {
+		return st.Code() == codes.Unavailable
+	}
+	// Context errors are net.Errors too.
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// unwrap returns the connection in use. Every connection comes from the
+// same dialer, so it offers what the others do.
+func (r *reconnectingBackend) unwrap() Backend {
+	return r.current().con
+}
+
+func (r *reconnectingBackend) reconnectCount() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reconnects
+}
+
+// reconnect replaces the connection even when it still works and waits
+// for the new one to be in use.
+func (r *reconnectingBackend) reconnect(ctx context.Context) error {
+	r.mu.Lock()
+	if r.pending == nil {
+		r.pending = make(chan struct{})
+		go r.redial()
+	}
+	pending := r.pending
+	r.mu.Unlock()
+	select {
+	case <-pending:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *reconnectingBackend) current() *connState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
+// do runs op, which must be safe to repeat, until it succeeds, fails for
+// a reason other than the connection, or the timeout passes.
+func (r *reconnectingBackend) do(ctx context.Context, op func(s *connState) error) error {
+	deadline := time.Now().Add(r.timeout)
+	for {
+		s := r.current()
+		err := op(s)
+		if err == errStaleConnection {
+			continue
+		}
+		if err != nil && r.current() != s {
+			// The connection was replaced under op.
+			continue
+		}
+		if !isTransportError(err) || ctx.Err() != nil || !time.Now().Before(deadline) {
+			return err
+		}
+		log.Warnf("lost connection to the volume: %v", err)
+		if werr := r.wait(ctx, r.redialFrom(s.gen), deadline); werr != nil {
+			return err
+		}
+	}
+}
+
+// once runs op, which changes the volume, a single time. A transport
+// error is returned, as whether op was carried out is unknown, and starts
+// a reconnect for the operations that follow. op is only run again when
+// it failed before anything was sent.
+func (r *reconnectingBackend) once(ctx context.Context, op func(s *connState) error) error {
+	deadline := time.Now().Add(r.timeout)
+	for {
+		r.mu.Lock()
+		s, pending := r.state, r.pending
+		r.mu.Unlock()
+		if pending != nil {
+			if err := r.wait(ctx, pending, deadline); err != nil {
+				return err
+			}
+			continue
+		}
+		err := op(s)
+		if err == errStaleConnection {
+			continue
+		}
+		if isTransportError(err) {
+			log.Warnf("lost connection to the volume: %v", err)
+			r.redialFrom(s.gen)
+		}
+		return err
+	}
+}
+
+// redialFrom starts reconnecting, unless the connection of generation gen
+// was already replaced or that is under way, and returns what to wait on
+// for the new connection.
+func (r *reconnectingBackend) redialFrom(gen uint64) chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state.gen != gen {
+		return nil
+	}
+	if r.pending == nil {
+		r.pending = make(chan struct{})
+		go r.redial()
+	}
+	return r.pending
+}
+
+// wait waits until pending is closed, which is at once when it is nil.
+func (r *reconnectingBackend) wait(ctx context.Context, pending chan struct{}, deadline time.Time) error {
+	if pending == nil {
+		return nil
+	}
+
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	select {
+	case <-pending:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return syscall.ETIMEDOUT
+	}
+}
+
+// redial connects again, backing off exponentially, and reopens the
+// tracked files before the new connection is put to use.
+func (r *reconnectingBackend) redial() {
+	backoff := minReconnectBackoff
+	for {
+		con, err := r.dial()
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), maxReconnectBackoff)
+			_, err = con.GetVolumeInfo(ctx)
+			cancel()
+		}
+		if err == nil {
+			if r.swap(con) {
+				return
+			}
+			continue
+		}
+		log.Warnf("reconnecting to the volume failed, retrying in %v: %v", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// swap reopens the tracked files on con and makes it the connection in
+// use. It returns false when con broke while doing so.
+func (r *reconnectingBackend) swap(con Backend) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), maxReconnectBackoff)
+	defer cancel()
+	fds := make(map[int64]int64)
+	tried := make(map[int64]bool)
+	r.mu.Lock()
+	// Files opened on the old connection while others are reopened
+	// are reopened in the next round, until none are left.
+	for {
+		files := make(map[int64]trackedFile)
+		for fd, tf := range r.files {
+			if !tried[fd] {
+				files[fd] = *tf
+			}
+		}
+		if len(files) == 0 {
+			break
+		}
+		r.mu.Unlock()
+		for fd, tf := range files {
+			tried[fd] = true
+			// Reopening must not truncate or create the file again.
+			flags := tf.flags &^ (syscall.O_TRUNC | syscall.O_CREAT | syscall.O_EXCL)
+			real, err := con.Open(ctx, tf.path, flags)
+			if isTransportError(err) {
+				for _, real := range fds {
+					con.Release(ctx, real)
+				}
+				return false
+			}
+			if err != nil {
+				log.Warnf("unable to reopen %s after reconnecting: %v", tf.path, err)
+				continue
+			}
+			fds[fd] = real
+		}
+		r.mu.Lock()
+	}
+	// Files released meanwhile need no descriptor on con.
+	var released []int64
+	for fd, real := range fds {
+		if _, ok := r.files[fd]; !ok {
+			released = append(released, real)
+			delete(fds, fd)
+		}
+	}
+	old := r.state
+	r.state = &connState{con: con, gen: old.gen + 1, fds: fds}
+	r.reconnects++
+	close(r.pending)
+	r.pending = nil
+	log.Infof("reconnected to the volume, reopened %d of %d files", len(fds), len(r.files))
+	r.mu.Unlock()
+
+	for _, real := range released {
+		con.Release(ctx, real)
+	}
+	if c, ok := old.con.(interface{ CloseConnection(context.Context) }); ok {
+		go c.CloseConnection(context.Background())
+	}
+	return true
+}
+
+// fd returns the descriptor that fd stands for on s. Files that could
+// not be reopened fail with EBADF.
+func (r *reconnectingBackend) fd(s *connState, fd int64) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state != s {
+		return 0, errStaleConnection
+	}
+	real, ok := s.fds[fd]
+	if !ok {
+		return 0, &spb.SdfsError{Err: "file was not reopened after reconnecting", ErrorCode: syscall.EBADF}
+	}
+	return real, nil
+}
+
+func (r *reconnectingBackend) GetVolumeInfo(ctx context.Context) (fi *sapi.VolumeInfoResponse, err error) {
+	err = r.do(ctx, func(s *connState) (err error) { fi, err = s.con.GetVolumeInfo(ctx); return })
+	return
+}
+
+func (r *reconnectingBackend) StatFS(ctx context.Context) (fi *sapi.StatFS, err error) {
+	err = r.do(ctx, func(s *connState) (err error) { fi, err = s.con.StatFS(ctx); return })
+	return
+}
+
+func (r *reconnectingBackend) GetAttr(ctx context.Context, path string) (fi *sapi.Stat, err error) {
+	err = r.do(ctx, func(s *connState) (err error) { fi, err = s.con.GetAttr(ctx, path); return })
+	return
+}
+
+func (r *reconnectingBackend) Stat(ctx context.Context, path string) (fi *sapi.FileInfoResponse, err error) {
+	err = r.do(ctx, func(s *connState) (err error) { fi, err = s.con.Stat(ctx, path); return })
+	return
+}
+
+func (r *reconnectingBackend) ListDir(ctx context.Context, path, marker string, compact bool, returnsize int32) (next string, fi []*sapi.Stat, err error) {
+	err = r.do(ctx, func(s *connState) (err error) {
+		next, fi, err = s.con.ListDir(ctx, path, marker, compact, returnsize)
+		return
+	})
+	return
+}
+
+func (r *reconnectingBackend) ReadLink(ctx context.Context, path string) (target string, err error) {
+	err = r.do(ctx, func(s *connState) (err error) { target, err = s.con.ReadLink(ctx, path); return })
+	return
+}
+
+func (r *reconnectingBackend) GetXAttr(ctx context.Context, name, path string) (value string, err error) {
+	err = r.do(ctx, func(s *connState) (err error) { value, err = s.con.GetXAttr(ctx, name, path); return })
+	return
+}
+
+func (r *reconnectingBackend) SetXAttr(ctx context.Context, name, value, path string) error {
+	return r.once(ctx, func(s *connState) error { return s.con.SetXAttr(ctx, name, value, path) })
+}
+
+func (r *reconnectingBackend) RemoveXAttr(ctx context.Context, name, path string) error {
+	return r.once(ctx, func(s *connState) error { return s.con.RemoveXAttr(ctx, name, path) })
+}
+
+func (r *reconnectingBackend) MkNod(ctx context.Context, path string, mode int32, rdev int32) error {
+	return r.once(ctx, func(s *connState) error { return s.con.MkNod(ctx, path, mode, rdev) })
+}
+
+func (r *reconnectingBackend) MkDir(ctx context.Context, path string, mode int32) error {
+	return r.once(ctx, func(s *connState) error { return s.con.MkDir(ctx, path, mode) })
+}
+
+func (r *reconnectingBackend) RmDir(ctx context.Context, path string) error {
+	return r.once(ctx, func(s *connState) error { return s.con.RmDir(ctx, path) })
+}
+
+func (r *reconnectingBackend) SymLink(ctx context.Context, src, dst string) error {
+	return r.once(ctx, func(s *connState) error { return s.con.SymLink(ctx, src, dst) })
+}
+
+func (r *reconnectingBackend) DeleteFile(ctx context.Context, path string) error {
+	return r.once(ctx, func(s *connState) error { return s.con.DeleteFile(ctx, path) })
+}
+
+func (r *reconnectingBackend) Unlink(ctx context.Context, path string) error {
+	return r.once(ctx, func(s *connState) error { return s.con.Unlink(ctx, path) })
+}
+
+// Rename also moves the tracked files at or below src, so they are
+// reopened by their new name.
+func (r *reconnectingBackend) Rename(ctx context.Context, src, dst string) error {
+	err := r.once(ctx, func(s *connState) error { return s.con.Rename(ctx, src, dst) })
+	if err != nil {
+		return err
+	}
+	r.moved(src, dst, false)
+	return nil
+}
+
+// moved renames the tracked files at or below src to below dst and, when
+// src and dst were exchanged, those below dst to below src.
+func (r *reconnectingBackend) moved(src, dst string, exchange bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rebase := func(p, from, to string) (string, bool) {
+		if p == from {
+			return to, true
+		}
+		if strings.HasPrefix(p, from+"/") {
+			return to + p[len(from):], true
+		}
+		return p, false
+	}
+	for _, tf := range r.files {
+		if p, ok := rebase(tf.path, src, dst); ok {
+			tf.path = p
+		} else if exchange {
+			tf.path, _ = rebase(tf.path, dst, src)
+		}
+	}
+}
+
+func (r *reconnectingBackend) Chown(ctx context.Context, path string, gid int32, uid int32) error {
+	return r.once(ctx, func(s *connState) error { return s.con.Chown(ctx, path, gid, uid) })
+}
+
+func (r *reconnectingBackend) Chmod(ctx context.Context, path string, mode int32) error {
+	return r.once(ctx, func(s *connState) error { return s.con.Chmod(ctx, path, mode) })
+}
+
+func (r *reconnectingBackend) Utime(ctx context.Context, path string, atime int64, mtime int64) error {
+	return r.once(ctx, func(s *connState) error { return s.con.Utime(ctx, path, atime, mtime) })
+}
+
+func (r *reconnectingBackend) Truncate(ctx context.Context, path string, length int64) error {
+	return r.once(ctx, func(s *connState) error { return s.con.Truncate(ctx, path, length) })
+}
+
+// Open hands out a descriptor of its own, which is tracked until it is
+// released. Opens that truncate or create exclusively are not retried
+// after a transport error.
+func (r *reconnectingBackend) Open(ctx context.Context, path string, flags int32) (int64, error) {
+	run := r.do
+	if flags&(syscall.O_TRUNC|syscall.O_EXCL) != 0 {
+		run = r.once
+	}
+	var fd int64
+	open := flags
+	err := run(ctx, func(s *connState) error {
+		real, err := s.con.Open(ctx, path, open)
+		if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.state != s {
+			// Opened on a connection that was just replaced, which
+			// already created or truncated the file.
+			open &^= syscall.O_TRUNC | syscall.O_CREAT | syscall.O_EXCL
+			return errStaleConnection
+		}
+		fd = r.nextFd
+		r.nextFd++
+		s.fds[fd] = real
+		r.files[fd] = &trackedFile{path: path, flags: flags}
+		return nil
+	})
+	if err != nil {
+		return -1, err
+	}
+	return fd, nil
+}
+
+func (r *reconnectingBackend) Read(ctx context.Context, fd int64, offset int64, size int32) (data []byte, err error) {
+	err = r.do(ctx, func(s *connState) error {
+		real, err := r.fd(s, fd)
+		if err != nil {
+			return err
+		}
+		data, err = s.con.Read(ctx, real, offset, size)
+		return err
+	})
+	return
+}
+
+func (r *reconnectingBackend) Write(ctx context.Context, fd int64, data []byte, offset int64, length int32) error {
+	return r.once(ctx, func(s *connState) error {
+		real, err := r.fd(s, fd)
+		if err != nil {
+			return err
+		}
+		return s.con.Write(ctx, real, data, offset, length)
+	})
+}
+
+func (r *reconnectingBackend) Flush(ctx context.Context, path string, fd int64) error {
+	return r.once(ctx, func(s *connState) error {
+		real, err := r.fd(s, fd)
+		if err != nil {
+			return err
+		}
+		return s.con.Flush(ctx, path, real)
+	})
+}
+
+func (r *reconnectingBackend) Fsync(ctx context.Context, path string, fd int64) error {
+	return r.once(ctx, func(s *connState) error {
+		real, err := r.fd(s, fd)
+		if err != nil {
+			return err
+		}
+		return s.con.Fsync(ctx, path, real)
+	})
+}
+
+// Release stops tracking fd. It is never retried: a descriptor that was
+// lost with its connection needs no release.
+func (r *reconnectingBackend) Release(ctx context.Context, fd int64) error {
+	var rerr error
+	for {
+		s := r.current()
+		real, err := r.fd(s, fd)
+		if err == errStaleConnection {
+			continue
+		}
+		if err == nil {
+			err = s.con.Release(ctx, real)
+			if isTransportError(err) {
+				r.redialFrom(s.gen)
+				err = nil
+			}
+			if rerr == nil {
+				rerr = err
+			}
+		}
+		r.mu.Lock()
+		delete(r.files, fd)
+		delete(s.fds, fd)
+		replaced := r.state != s
+		r.mu.Unlock()
+		if !replaced {
+			return rerr
+		}
+		// fd may have been reopened on the new connection meanwhile.
+	}
+}
+
+func (r *reconnectingBackend) CopyExtent(ctx context.Context, src, dst string, srcStart, dstStart, length int64) (n int64, err error) {
+	err = r.once(ctx, func(s *connState) (err error) {
+		n, err = s.con.CopyExtent(ctx, src, dst, srcStart, dstStart, length)
+		return
+	})
+	return
+}
+
+// RenameWithFlags moves the tracked files as Rename does.
+func (r *reconnectingBackend) RenameWithFlags(ctx context.Context, src, dst string, flags uint32) error {
+	err := r.once(ctx, func(s *connState) error {
+		fr, ok := s.con.(FlagRenamer)
+		if !ok {
+			return errNotSupported
+		}
+		return fr.RenameWithFlags(ctx, src, dst, flags)
+	})
+	if err != nil {
+		return err
+	}
+	r.moved(src, dst, flags&unix.RENAME_EXCHANGE != 0)
+	return nil
+}
+
+func (r *reconnectingBackend) GetLock(ctx context.Context, path string, owner uint64, lk *fuse.FileLock, flock bool) (out *fuse.FileLock, err error) {
+	err = r.do(ctx, func(s *connState) (err error) {
+		l, ok := s.con.(Locker)
+		if !ok {
+			return errNotSupported
+		}
+		out, err = l.GetLock(ctx, path, owner, lk, flock)
+		return
+	})
+	return
+}
+
+func (r *reconnectingBackend) SetLock(ctx context.Context, path string, owner uint64, lk *fuse.FileLock, flock, wait bool) error {
+	return r.once(ctx, func(s *connState) error {
+		l, ok := s.con.(Locker)
+		if !ok {
+			return errNotSupported
+		}
+		return l.SetLock(ctx, path, owner, lk, flock, wait)
+	})
+}
+
+func (r *reconnectingBackend) Allocate(ctx context.Context, path string, offset, length int64, mode uint32) error {
+	return r.once(ctx, func(s *connState) error {
+		a, ok := s.con.(Allocator)
+		if !ok {
+			return errNotSupported
+		}
+		return a.Allocate(ctx, path, offset, length, mode)
+	})
+}
+
+func (r *reconnectingBackend) Append(ctx context.Context, fd int64, data []byte, length int32) (off int64, err error) {
+	err = r.once(ctx, func(s *connState) error {
+		a, ok := s.con.(Appender)
+		if !ok {
+			return errNotSupported
+		}
+		real, err := r.fd(s, fd)
+		if err != nil {
+			return err
+		}
+		off, err = a.Append(ctx, real, data, length)
+		return err
+	})
+	return
+}
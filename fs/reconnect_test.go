@@ -0,0 +1,355 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	ffs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/opendedup/gofuse-sdfs/fs/sdfstest"
+	spb "github.com/opendedup/sdfs-client-go/api"
+	sapi "github.com/opendedup/sdfs-client-go/sdfs"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errUnavailable = status.Error(codes.Unavailable, "connection refused")
+
+// outage stands for the volume service going away. While it is down every
+// connection fails, and connections made before it went down never work
+// again.
+type outage struct {
+	mu    sync.Mutex
+	down  bool
+	gen   int
+	dials int
+	opens []int32
+}
+
+func (o *outage) set(down bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if down && !o.down {
+		o.gen++
+	}
+	o.down = down
+}
+
+func (o *outage) check(gen int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.down || gen != o.gen {
+		return errUnavailable
+	}
+	return nil
+}
+
+// dialer returns connections to mb that fail during the outage.
+func (o *outage) dialer(mb Backend) Dialer {
+	return func() (Backend, error) {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		o.dials++
+		if o.down {
+			return nil, errUnavailable
+		}
+		return flakyBackend{mb, o, o.gen}, nil
+	}
+}
+
+type flakyBackend struct {
+	Backend
+	o   *outage
+	gen int
+}
+
+func (b flakyBackend) GetVolumeInfo(ctx context.Context) (*sapi.VolumeInfoResponse, error) {
+	if err := b.o.check(b.gen); err != nil {
+		return nil, err
+	}
+	return b.Backend.GetVolumeInfo(ctx)
+}
+
+func (b flakyBackend) GetAttr(ctx context.Context, path string) (*sapi.Stat, error) {
+	if err := b.o.check(b.gen); err != nil {
+		return nil, err
+	}
+	return b.Backend.GetAttr(ctx, path)
+}
+
+func (b flakyBackend) Open(ctx context.Context, path string, flags int32) (int64, error) {
+	if err := b.o.check(b.gen); err != nil {
+		return -1, err
+	}
+	b.o.mu.Lock()
+	b.o.opens = append(b.o.opens, flags)
+	b.o.mu.Unlock()
+	return b.Backend.Open(ctx, path, flags)
+}
+
+func (b flakyBackend) Read(ctx context.Context, fd int64, offset int64, size int32) ([]byte, error) {
+	if err := b.o.check(b.gen); err != nil {
+		return nil, err
+	}
+	return b.Backend.Read(ctx, fd, offset, size)
+}
+
+func (b flakyBackend) Write(ctx context.Context, fd int64, data []byte, offset int64, length int32) error {
+	if err := b.o.check(b.gen); err != nil {
+		return err
+	}
+	return b.Backend.Write(ctx, fd, data, offset, length)
+}
+
+func newReconnectingRoot(t *testing.T, timeout time.Duration) (*sdfsRoot, *outage) {
+	t.Helper()
+	root, mb := newTestRoot(t)
+	o := &outage{}
+	dial := o.dialer(mb)
+	con, _ := dial()
+	root.con = NewReconnectingBackend(con, dial, timeout)
+	return root, o
+}
+
+func TestReconnectReopensHandles(t *testing.T) {
+	root, o := newReconnectingRoot(t, 10*time.Second)
+	ctx := context.Background()
+	_, fh := create(t, &root.sdfsNode, "file")
+	defer fh.Release(ctx)
+	if _, errno := fh.Write(ctx, []byte("hello"), 0); errno != 0 {
+		t.Fatalf("Write: %v", errno)
+	}
+
+	// Whether a write that met the outage reached the volume is unknown,
+	// so it fails rather than being sent again.
+	o.set(true)
+	if _, errno := fh.Write(ctx, []byte(" world"), 5); errno != syscall.ENOTCONN {
+		t.Fatalf("Write during the outage = %v, want ENOTCONN", errno)
+	}
+	time.AfterFunc(300*time.Millisecond, func() { o.set(false) })
+	start := time.Now()
+	if got := readAll(t, fh, 0, 64); string(got) != "hello" {
+		t.Errorf("read %q after reconnecting, want %q", got, "hello")
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("Read returned after %v, before the volume came back", d)
+	}
+	if _, errno := fh.Write(ctx, []byte(" world"), 5); errno != 0 {
+		t.Fatalf("Write after reconnecting: %v", errno)
+	}
+	if got := readAll(t, fh, 0, 64); string(got) != "hello world" {
+		t.Errorf("read %q after writing again, want %q", got, "hello world")
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.dials < 2 {
+		t.Errorf("dialed %d times, want retries while the volume was down", o.dials)
+	}
+	if n := len(o.opens); n != 2 {
+		t.Fatalf("%d opens, want the handle reopened once", n)
+	}
+	want := o.opens[0] &^ (syscall.O_TRUNC | syscall.O_CREAT | syscall.O_EXCL)
+	if o.opens[1] != want {
+		t.Errorf("reopened with flags %#o, want %#o", o.opens[1], want)
+	}
+	if o.opens[1]&syscall.O_ACCMODE != syscall.O_RDWR {
+		t.Errorf("reopened with access mode %#o, want O_RDWR", o.opens[1]&syscall.O_ACCMODE)
+	}
+}
+
+// TestReconnectWaitsToChange checks that a change made while a reconnect
+// is under way waits for it and is sent once, on the new connection.
+func TestReconnectWaitsToChange(t *testing.T) {
+	root, o := newReconnectingRoot(t, 10*time.Second)
+	ctx := context.Background()
+	_, fh := create(t, &root.sdfsNode, "file")
+	defer fh.Release(ctx)
+
+	o.set(true)
+	fh.Write(ctx, []byte("lost"), 0)
+	time.AfterFunc(300*time.Millisecond, func() { o.set(false) })
+	if _, errno := fh.Write(ctx, []byte("sent"), 0); errno != 0 {
+		t.Fatalf("Write while reconnecting: %v", errno)
+	}
+	if got := readAll(t, fh, 0, 64); string(got) != "sent" {
+		t.Errorf("read %q, want %q", got, "sent")
+	}
+}
+
+func TestReconnectTimeout(t *testing.T) {
+	root, o := newReconnectingRoot(t, 200*time.Millisecond)
+	ctx := context.Background()
+	o.set(true)
+
+	start := time.Now()
+	if _, err := root.con.GetAttr(ctx, "/"); !errors.Is(err, errUnavailable) {
+		t.Errorf("GetAttr = %v, want the transport error after the timeout", err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond || d > 5*time.Second {
+		t.Errorf("GetAttr failed after %v, want about the 200ms timeout", d)
+	}
+
+	// The operation gives up when its context is done.
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	root.con.(*reconnectingBackend).timeout = time.Minute
+	start = time.Now()
+	if _, err := root.con.GetAttr(ctx, "/"); err == nil {
+		t.Errorf("GetAttr succeeded while the volume was down")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("GetAttr ignored its context for %v", d)
+	}
+}
+
+func TestReconnectKeepsServerErrors(t *testing.T) {
+	mb := sdfstest.NewMemBackend()
+	o := &outage{}
+	dial := o.dialer(mb)
+	con, _ := dial()
+	r := NewReconnectingBackend(con, dial, time.Minute)
+	if _, err := r.GetAttr(context.Background(), "/missing"); ToErrno(err) != syscall.ENOENT {
+		t.Errorf("GetAttr = %v, want ENOENT", err)
+	}
+	if o.dials != 1 {
+		t.Errorf("dialed %d times for an error from the volume, want no reconnect", o.dials)
+	}
+}
+
+func TestIsTransportError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{errUnavailable, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true},
+		{fmt.Errorf("write: %w", syscall.EPIPE), true},
+		{status.Error(codes.NotFound, "missing"), false},
+		{&spb.SdfsError{Err: "refused", ErrorCode: syscall.ECONNREFUSED}, false},
+		{context.DeadlineExceeded, false},
+		{context.Canceled, false},
+		{errors.New("unexpected"), false},
+	} {
+		if got := isTransportError(tc.err); got != tc.want {
+			t.Errorf("isTransportError(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+// slowReopen is a connection whose first Open blocks until release is
+// closed, after telling started.
+type slowReopen struct {
+	Backend
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *slowReopen) Open(ctx context.Context, path string, flags int32) (int64, error) {
+	b.once.Do(func() {
+		close(b.started)
+		<-b.release
+	})
+	return b.Backend.Open(ctx, path, flags)
+}
+
+func TestReconnectReopensFilesOpenedMeanwhile(t *testing.T) {
+	mb := sdfstest.NewMemBackend()
+	ctx := context.Background()
+	for _, p := range []string{"/a", "/b"} {
+		if err := mb.MkNod(ctx, p, syscall.S_IFREG|0644, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next := &slowReopen{Backend: mb, started: make(chan struct{}), release: make(chan struct{})}
+	r := NewReconnectingBackend(mb, func() (Backend, error) { return next, nil }, time.Minute).(*reconnectingBackend)
+	if _, err := r.Open(ctx, "/a", syscall.O_RDWR); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- r.reconnect(ctx) }()
+	<-next.started
+	// Opened on the old connection while /a is reopened on the new one.
+	fd, err := r.Open(ctx, "/b", syscall.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(next.release)
+	if err := <-done; err != nil {
+		t.Fatalf("reconnect: %v", err)
+	}
+	if err := r.Write(ctx, fd, []byte("x"), 0, 1); err != nil {
+		t.Errorf("Write to a file opened during the reconnect: %v", err)
+	}
+}
+
+// TestDialKeepsCapabilities dials through every wrapper a mount can have
+// and checks that what the connection offers is still used, and that
+// what it lacks is still emulated.
+func TestDialKeepsCapabilities(t *testing.T) {
+	mb := sdfstest.NewMemBackend()
+	uid := uint32(1000)
+	info := ConnectionInfo{
+		MountPath:        "/mnt/sdfs-test",
+		Trace:            true,
+		UID:              &uid,
+		ReconnectTimeout: time.Minute,
+		MetadataTimeout:  time.Minute,
+		DataTimeout:      time.Minute,
+	}
+	for _, tc := range []struct {
+		name string
+		con  Backend
+		want bool
+	}{
+		{"backend", mb, true},
+		{"emulated", plainBackend{mb}, false},
+	} {
+		con, err := dialWrapped(func() (Backend, error) { return tc.con, nil }, info)
+		if err != nil {
+			t.Fatalf("%s: dialWrapped: %v", tc.name, err)
+		}
+		// Each is what the wrappers offer and what the connection does.
+		caps := map[string][2]bool{}
+		_, renamer := asFlagRenamer(con)
+		caps["FlagRenamer"] = [2]bool{renamer, hasInterface(tc.con, (*FlagRenamer)(nil))}
+		_, locker := asLocker(con)
+		caps["Locker"] = [2]bool{locker, hasInterface(tc.con, (*Locker)(nil))}
+		_, allocator := asAllocator(con)
+		caps["Allocator"] = [2]bool{allocator, hasInterface(tc.con, (*Allocator)(nil))}
+		_, appender := asAppender(con)
+		caps["Appender"] = [2]bool{appender, hasInterface(tc.con, (*Appender)(nil))}
+		for name, c := range caps {
+			if c[0] != c[1] {
+				t.Errorf("%s: %s through the wrappers is %v, but %v for the connection", tc.name, name, c[0], c[1])
+			}
+		}
+
+		r, err := NewsdfsRoot(con, info)
+		if err != nil {
+			t.Fatalf("%s: NewsdfsRoot: %v", tc.name, err)
+		}
+		root := r.(*sdfsRoot)
+		ffs.NewNodeFS(root, &ffs.Options{})
+		ctx := context.Background()
+		_, fh := create(t, &root.sdfsNode, tc.name)
+		fh.Release(ctx)
+		mb.ResetCalls()
+
+		errno := root.Rename(ctx, tc.name, root, tc.name+"-renamed", unix.RENAME_NOREPLACE)
+		if want := map[bool]syscall.Errno{true: 0, false: syscall.EINVAL}[tc.want]; errno != want {
+			t.Errorf("%s: Rename(NOREPLACE) = %v, want %v", tc.name, errno, want)
+		}
+		if used := mb.Calls("RenameWithFlags"); (used == 1) != tc.want {
+			t.Errorf("%s: the volume was asked to rename with flags %d times", tc.name, used)
+		}
+	}
+}
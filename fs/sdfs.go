@@ -4,26 +4,41 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"strconv"
 	"syscall"
 	"time"
 
 	ffs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
-	spb "github.com/opendedup/sdfs-client-go/api"
 	sapi "github.com/opendedup/sdfs-client-go/sdfs"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
 type sdfsRoot struct {
 	sdfsNode
-	rootPath  string
-	rootMount string
-	rootDev   uint64
+	con         Backend
+	cache       *attrCache
+	locks       *lockTable
+	writes      *writeBuffers
+	reads       *readAheads
+	blocks      *blockCache
+	metrics     *opMetrics
+	handles     *handleCount
+	unexpected  *errorCounts
+	rootPath    string
+	rootMount   string
+	rootDev     uint64
+	dirPageSize int32
+	appends     *appendLocks
 }
 
 type ConnectionInfo struct {
-	Buffers      int
-	Threads      int
+	// Deprecated: Buffers and Threads are ignored. The client library
+	// sizes its dedupe engine itself.
+	Buffers int
+	Threads int
+	// LogPath is the directory the mount logs to.
 	LogPath      string
 	Cachsize     int
 	Cachage      int
@@ -36,14 +51,49 @@ type ConnectionInfo struct {
 	User         string
 	Pwd          string
 	DisableTrust bool
+	DirPageSize  int
+	// AttrCacheTTL is how long file attributes are cached by the mount
+	// and NegativeCacheTTL how long a missing path is remembered. Zero
+	// disables the respective cache.
+	AttrCacheTTL     time.Duration
+	NegativeCacheTTL time.Duration
+	// WriteBufferSize is how much a file handle collects before writing
+	// to the server and WriteBufferMemory bounds what all handles of the
+	// mount hold together. A zero WriteBufferSize writes through.
+	WriteBufferSize   int
+	WriteBufferMemory int64
+	// ReadAheadSize is the largest window a file handle reads ahead of
+	// sequential reads, filled by ReadAheadParallel concurrent reads. A
+	// zero ReadAheadSize disables read-ahead.
+	ReadAheadSize     int
+	ReadAheadParallel int
+	// BlockCacheDir, when set, is a local directory that keeps file data
+	// read from the volume across mounts, up to BlockCacheSize bytes per
+	// volume.
+	BlockCacheDir  string
+	BlockCacheSize int64
+	// ReconnectTimeout is how long operations wait for a lost connection
+	// to the volume to be re-established. Zero fails them right away.
+	ReconnectTimeout time.Duration
+	// MetadataTimeout, DataTimeout and FsyncTimeout bound requests to the
+	// volume that work on metadata, move file data, or flush it to stable
+	// storage. Zero leaves the class unbounded.
+	MetadataTimeout time.Duration
+	DataTimeout     time.Duration
+	FsyncTimeout    time.Duration
+	// Trace records every request to the volume as a span of the FUSE
+	// operation that made it and passes the trace context to the server.
+	Trace bool
+	// UID and GID, when set, are shown as the owner and group of every
+	// file instead of those the volume records.
+	UID *uint32
+	GID *uint32
 }
 
 type sdfsNode struct {
 	ffs.Inode
 }
 
-var con *spb.SdfsConnection = nil
-
 var _ = (ffs.NodeStatfser)((*sdfsNode)(nil))
 var _ = (ffs.NodeGetattrer)((*sdfsNode)(nil))
 var _ = (ffs.NodeGetxattrer)((*sdfsNode)(nil))
@@ -58,52 +108,66 @@ var _ = (ffs.NodeReaddirer)((*sdfsNode)(nil))
 var _ = (ffs.NodeMkdirer)((*sdfsNode)(nil))
 var _ = (ffs.NodeMknoder)((*sdfsNode)(nil))
 var _ = (ffs.NodeSymlinker)((*sdfsNode)(nil))
+var _ = (ffs.NodeLinker)((*sdfsNode)(nil))
 var _ = (ffs.NodeReadlinker)((*sdfsNode)(nil))
 var _ = (ffs.NodeUnlinker)((*sdfsNode)(nil))
 var _ = (ffs.NodeRmdirer)((*sdfsNode)(nil))
 var _ = (ffs.NodeRenamer)((*sdfsNode)(nil))
 var _ = (ffs.NodeSetattrer)((*sdfsNode)(nil))
 var _ = (ffs.NodeCreater)((*sdfsNode)(nil))
+var _ = (ffs.NodeGetlker)((*sdfsNode)(nil))
+var _ = (ffs.NodeSetlker)((*sdfsNode)(nil))
+var _ = (ffs.NodeSetlkwer)((*sdfsNode)(nil))
 
 //SetLogLevel sets the log level for this service
 func SetLogLevel(level log.Level) {
 	log.SetLevel(level)
 }
 
-func (n *sdfsNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+func (n *sdfsNode) Getxattr(ctx context.Context, attr string, dest []byte) (_ uint32, errno syscall.Errno) {
+	ctx, op := n.begin(ctx, "getxattr")
+	defer op.end(&errno)
 
-	fi, err := con.GetXAttr(ctx, attr, n.path())
+	fi, err := n.backend().GetXAttr(ctx, attr, n.path())
 	if err != nil {
 		log.Debugf("getxattr %v", err)
-		return uint32(0), ToErrno(err)
+		return uint32(0), errnoOf(ctx, err)
 	}
 	sz := copy(dest, fi)
 	return uint32(sz), ffs.OK
 }
 
-func (n *sdfsNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+func (n *sdfsNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) (errno syscall.Errno) {
+	ctx, op := n.begin(ctx, "setxattr")
+	defer op.end(&errno)
 	s := string(data)
-	err := con.SetXAttr(ctx, attr, s, n.path())
+	err := n.backend().SetXAttr(ctx, attr, s, n.path())
+	n.cache().invalidate(n.path())
 	if err != nil {
 		log.Debugf("setxattr %v", err)
-		return ToErrno(err)
+		return errnoOf(ctx, err)
 	}
 	return ffs.OK
 }
 
-func (n *sdfsNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
-	err := con.RemoveXAttr(ctx, attr, n.path())
+func (n *sdfsNode) Removexattr(ctx context.Context, attr string) (errno syscall.Errno) {
+	ctx, op := n.begin(ctx, "removexattr")
+	defer op.end(&errno)
+	err := n.backend().RemoveXAttr(ctx, attr, n.path())
+	n.cache().invalidate(n.path())
 	if err != nil {
 		log.Debugf("removexattr %v", err)
-		return ToErrno(err)
+		return errnoOf(ctx, err)
 	}
 	return ffs.OK
 }
 
-func (n *sdfsNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
-	fi, err := con.Stat(ctx, n.path())
+func (n *sdfsNode) Listxattr(ctx context.Context, dest []byte) (_ uint32, errno syscall.Errno) {
+	ctx, op := n.begin(ctx, "listxattr")
+	defer op.end(&errno)
+	fi, err := n.cache().stat(ctx, n.backend(), n.path())
 	if err != nil {
-		return uint32(0), ToErrno(err)
+		return uint32(0), errnoOf(ctx, err)
 	}
 	offset := 0
 	for _, v := range fi.FileAttributes {
@@ -116,9 +180,19 @@ func (n *sdfsNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.
 	return uint32(offset), ffs.OK
 }
 
+// CopyFileRange shares the extents of the source range with the
+// destination through CopyExtent instead of copying data.
+//
+// This is also the only clone path a mount has. FICLONE, FICLONERANGE
+// and FIDEDUPERANGE are answered by the kernel's remap_file_range, which
+// FUSE does not implement, so those ioctls fail with EOPNOTSUPP before
+// reaching the filesystem; cp --reflink=auto and most image tools then
+// fall back to copy_file_range and end up here.
 func (n *sdfsNode) CopyFileRange(ctx context.Context, fhIn ffs.FileHandle,
 	offIn uint64, out *ffs.Inode, fhOut ffs.FileHandle, offOut uint64,
-	len uint64, flags uint64) (uint32, syscall.Errno) {
+	len uint64, flags uint64) (_ uint32, errno syscall.Errno) {
+	ctx, op := n.begin(ctx, "copyfilerange")
+	defer op.end(&errno)
 	lfIn, ok := fhIn.(*sdfsFile)
 	if !ok {
 		return 0, syscall.ENOTSUP
@@ -128,19 +202,27 @@ func (n *sdfsNode) CopyFileRange(ctx context.Context, fhIn ffs.FileHandle,
 		return 0, syscall.ENOTSUP
 	}
 
+	// Data still buffered by either side has to be on the server first.
+	n.root().writes.flushIno(ctx, lfIn.ino)
+	n.root().writes.flushIno(ctx, lfOut.ino)
+	defer n.root().reads.invalidate(lfOut.ino)
+	defer n.root().blocks.invalidate(lfOut.path)
 	signedOffIn := int64(offIn)
 	signedOffOut := int64(offOut)
-	count, err := con.CopyExtent(ctx, lfIn.path, lfOut.path, signedOffIn, signedOffOut, int64(len))
+	count, err := n.backend().CopyExtent(ctx, lfIn.path, lfOut.path, signedOffIn, signedOffOut, int64(len))
+	n.cache().invalidate(lfOut.path)
 	if err != nil {
-		return 0, ToErrno(err)
+		return 0, errnoOf(ctx, err)
 	}
 	return uint32(count), ffs.OK
 }
 
-func (n *sdfsNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
-	fi, err := con.StatFS(ctx)
+func (n *sdfsNode) Statfs(ctx context.Context, out *fuse.StatfsOut) (errno syscall.Errno) {
+	ctx, op := n.begin(ctx, "statfs")
+	defer op.end(&errno)
+	fi, err := n.backend().StatFS(ctx)
 	if err != nil {
-		return ToErrno(err)
+		return errnoOf(ctx, err)
 	}
 	out.Bavail = uint64(fi.Bfree)
 	out.Bfree = uint64(fi.Bfree)
@@ -150,31 +232,26 @@ func (n *sdfsNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errn
 	return ffs.OK
 }
 
-func (r *sdfsRoot) Getattr(ctx context.Context, f ffs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	fi, err := con.GetAttr(ctx, r.path())
+func (r *sdfsRoot) Getattr(ctx context.Context, f ffs.FileHandle, out *fuse.AttrOut) (errno syscall.Errno) {
+	ctx, op := r.begin(ctx, "getattr")
+	defer op.end(&errno)
+	fi, err := r.getattr(ctx)
 	if err != nil {
 		log.Debugf("unable to getattr for %s %v", r.path(), err)
-		return ToErrno(err)
+		return errnoOf(ctx, err)
 	}
-	atime := time.Unix(0, fi.Atime*int64(time.Millisecond))
-	ctime := time.Unix(0, fi.Ctim*int64(time.Millisecond))
-	mtime := time.Unix(0, fi.Mtim*int64(time.Millisecond))
-	out.SetTimes(&atime, &mtime, &ctime)
-	out.Size = uint64(fi.Size)
-	out.Blocks = uint64(fi.Size / 512)
-	out.Owner.Uid = uint32(fi.Uid)
-	out.Owner.Gid = uint32(fi.Gid)
-	out.Mode = uint32(fi.Mode)
-	out.Blksize = 512
+	ToAttr(fi, &out.Attr)
 	return ffs.OK
 }
 
 //Readlink reads a symlink path from the sdfs filesystem
-func (n *sdfsNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
-	fi, err := con.ReadLink(ctx, n.path())
+func (n *sdfsNode) Readlink(ctx context.Context) (_ []byte, errno syscall.Errno) {
+	ctx, op := n.begin(ctx, "readlink")
+	defer op.end(&errno)
+	fi, err := n.backend().ReadLink(ctx, n.path())
 	if err != nil {
 		log.Debugf("unable to readlink for %s %v", n.path(), err)
-		return nil, ToErrno(err)
+		return nil, errnoOf(ctx, err)
 	}
 	return []byte(fi), ffs.OK
 }
@@ -183,18 +260,84 @@ func (n *sdfsNode) root() *sdfsRoot {
 	return n.Root().Operations().(*sdfsRoot)
 }
 
+func (n *sdfsNode) backend() Backend {
+	return n.root().con
+}
+
+func (n *sdfsNode) cache() *attrCache {
+	return n.root().cache
+}
+
+// getattr returns the attributes of n, from the cache while they are
+// fresh.
+func (n *sdfsNode) getattr(ctx context.Context) (*sapi.Stat, error) {
+	n.root().writes.flushIno(ctx, n.StableAttr().Ino)
+	fi, prev, err := n.cache().getAttr(ctx, n.backend(), n.path())
+	if prev != nil {
+		n.notifyChanged(ctx, prev, fi, err)
+	}
+	return fi, err
+}
+
+// notifyChanged tells the kernel to drop what it cached for n when a
+// refresh shows that n was removed, replaced or modified since prev was
+// cached. Only requests that came in through the kernel send
+// notifications, and they are sent asynchronously so the kernel is not
+// asked to invalidate an inode it is busy with.
+func (n *sdfsNode) notifyChanged(ctx context.Context, prev, fi *sapi.Stat, err error) {
+	if _, ok := fuse.FromContext(ctx); !ok {
+		return
+	}
+	if err != nil && ToErrno(err) != syscall.ENOENT {
+		return
+	}
+	if fi == nil || fi.Dev != prev.Dev {
+		if name, parent := n.Parent(); parent != nil {
+			log.Debugf("%s changed on the server, invalidating entry", n.path())
+			go parent.NotifyEntry(name)
+		}
+		return
+	}
+	if fi.Mtim != prev.Mtim || fi.Size != prev.Size {
+		log.Debugf("%s changed on the server, invalidating content", n.path())
+		go n.NotifyContent(0, 0)
+	}
+}
+
+// newFile wraps an open file descriptor of n's path in a handle that
+// shares the mount's caches, buffers and lock table.
+func (n *sdfsNode) newFile(fd int64, path string) *sdfsFile {
+	lf := NewsdfsFile(n.backend(), fd, path).(*sdfsFile)
+	lf.cache = n.cache()
+	lf.locks = n.root().locks
+	lf.ino = n.StableAttr().Ino
+	lf.appends = n.root().appends
+	lf.writes = n.root().writes
+	lf.reads = n.root().reads
+	lf.reads.open(lf.ino)
+	lf.blocks = n.root().blocks
+	lf.metrics = n.root().metrics
+	lf.metrics.handleOpened()
+	lf.unexpected = n.root().unexpected
+	lf.handles = n.root().handles
+	lf.handles.add(1)
+	return lf
+}
+
 func (n *sdfsNode) path() string {
 	path := n.Path(n.Root())
 	return filepath.Join(n.root().rootPath, path)
 }
 
-func (n *sdfsNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*ffs.Inode, syscall.Errno) {
+func (n *sdfsNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (_ *ffs.Inode, errno syscall.Errno) {
+	ctx, op := n.begin(ctx, "lookup")
+	defer op.end(&errno)
 	p := filepath.Join(n.path(), name)
 
-	fi, err := con.GetAttr(ctx, p)
+	fi, _, err := n.cache().getAttr(ctx, n.backend(), p)
 	if err != nil {
 		log.Debugf("error getting attr for %s %v", name, err)
-		return nil, ToErrno(err)
+		return nil, errnoOf(ctx, err)
 	}
 	ToStat(fi, out)
 	node := &sdfsNode{}
@@ -204,17 +347,7 @@ func (n *sdfsNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut)
 
 //ToStat turns a fileinfo into a stat
 func ToStat(fi *sapi.Stat, out *fuse.EntryOut) {
-	atime := time.Unix(0, fi.Atime*int64(time.Millisecond))
-	ctime := time.Unix(0, fi.Ctim*int64(time.Millisecond))
-	mtime := time.Unix(0, fi.Mtim*int64(time.Millisecond))
-	out.SetTimes(&atime, &mtime, &ctime)
-	out.Size = uint64(fi.Size)
-	out.Blocks = uint64(fi.Size / 512)
-	out.Owner.Uid = uint32(fi.Uid)
-	out.Owner.Gid = uint32(fi.Gid)
-	out.Mode = uint32(fi.Mode)
-	out.Blksize = 512
-	out.Rdev = 0
+	ToAttr(fi, &out.Attr)
 }
 
 //ToAttr turns stat into attr
@@ -224,12 +357,20 @@ func ToAttr(fi *sapi.Stat, out *fuse.Attr) {
 	mtime := time.Unix(0, fi.Mtim*int64(time.Millisecond))
 	out.SetTimes(&atime, &mtime, &ctime)
 	out.Size = uint64(fi.Size)
-	out.Blocks = uint64(fi.Size / 512)
+	out.Blocks = uint64(fi.Blocks)
+	if fi.Blocks == 0 && fi.Size > 0 {
+		// The volume does not count the blocks of this file.
+		out.Blocks = uint64(fi.Size+511) / 512
+	}
 	out.Owner.Uid = uint32(fi.Uid)
 	out.Owner.Gid = uint32(fi.Gid)
 	out.Mode = uint32(fi.Mode)
 	out.Blksize = 512
 	out.Rdev = 0
+	out.Nlink = 1
+	if fi.Nlink > 0 {
+		out.Nlink = uint32(fi.Nlink)
+	}
 }
 
 // preserveOwner sets uid and gid of `path` according to the caller information
@@ -243,23 +384,26 @@ func (n *sdfsNode) preserveOwner(ctx context.Context, path string) error {
 		return nil
 	}
 	log.Debugf("setting chown for %s %d %d", path, caller.Gid, caller.Uid)
-	err := con.Chown(ctx, path, int32(caller.Gid), int32(caller.Uid))
+	err := n.backend().Chown(ctx, path, int32(caller.Gid), int32(caller.Uid))
 	if err != nil {
-		return ToErrno(err)
+		return errnoOf(ctx, err)
 	}
 	return ffs.OK
 }
 
-func (n *sdfsNode) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (*ffs.Inode, syscall.Errno) {
+func (n *sdfsNode) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (_ *ffs.Inode, errno syscall.Errno) {
+	ctx, op := n.begin(ctx, "mknod")
+	defer op.end(&errno)
 	p := filepath.Join(n.path(), name)
-	err := con.MkNod(ctx, p, int32(mode), int32(rdev))
+	err := n.backend().MkNod(ctx, p, int32(mode), int32(rdev))
+	n.cache().invalidate(p, n.path())
 	if err != nil {
-		return nil, ToErrno(err)
+		return nil, errnoOf(ctx, err)
 	}
 	n.preserveOwner(ctx, p)
-	fi, err := con.GetAttr(ctx, p)
+	fi, err := n.cache().fetchAttr(ctx, n.backend(), p)
 	if err != nil {
-		return nil, ToErrno(err)
+		return nil, errnoOf(ctx, err)
 	}
 	ToAttr(fi, &out.Attr)
 
@@ -269,17 +413,20 @@ func (n *sdfsNode) Mknod(ctx context.Context, name string, mode, rdev uint32, ou
 	return ch, 0
 }
 
-func (n *sdfsNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*ffs.Inode, syscall.Errno) {
+func (n *sdfsNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (_ *ffs.Inode, errno syscall.Errno) {
+	ctx, op := n.begin(ctx, "mkdir")
+	defer op.end(&errno)
 	p := filepath.Join(n.path(), name)
-	err := con.MkDir(ctx, p, int32(mode))
+	err := n.backend().MkDir(ctx, p, int32(mode))
+	n.cache().invalidate(p, n.path())
 	if err != nil {
-		return nil, ToErrno(err)
+		return nil, errnoOf(ctx, err)
 	}
 	n.preserveOwner(ctx, p)
-	fi, err := con.GetAttr(ctx, p)
+	fi, err := n.cache().fetchAttr(ctx, n.backend(), p)
 	if err != nil {
-		con.RmDir(ctx, p)
-		return nil, ToErrno(err)
+		n.backend().RmDir(ctx, p)
+		return nil, errnoOf(ctx, err)
 	}
 
 	ToAttr(fi, &out.Attr)
@@ -290,20 +437,28 @@ func (n *sdfsNode) Mkdir(ctx context.Context, name string, mode uint32, out *fus
 	return ch, 0
 }
 
-func (n *sdfsNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+func (n *sdfsNode) Rmdir(ctx context.Context, name string) (errno syscall.Errno) {
+	ctx, op := n.begin(ctx, "rmdir")
+	defer op.end(&errno)
 	p := filepath.Join(n.path(), name)
-	err := con.RmDir(ctx, p)
+	err := n.backend().RmDir(ctx, p)
+	n.cache().invalidateTree(p)
+	n.cache().invalidate(n.path())
 	if err != nil {
-		return ToErrno(err)
+		return errnoOf(ctx, err)
 	}
 	return ffs.OK
 }
 
-func (n *sdfsNode) Unlink(ctx context.Context, name string) syscall.Errno {
+func (n *sdfsNode) Unlink(ctx context.Context, name string) (errno syscall.Errno) {
+	ctx, op := n.begin(ctx, "unlink")
+	defer op.end(&errno)
 	p := filepath.Join(n.path(), name)
-	err := con.DeleteFile(ctx, p)
+	err := n.backend().DeleteFile(ctx, p)
+	n.cache().invalidate(p, n.path())
+	n.root().blocks.invalidate(p)
 	if err != nil {
-		return ToErrno(err)
+		return errnoOf(ctx, err)
 	}
 	return ffs.OK
 }
@@ -315,18 +470,44 @@ func tosdfsNode(op ffs.InodeEmbedder) *sdfsNode {
 	return op.(*sdfsNode)
 }
 
-func (n *sdfsNode) Rename(ctx context.Context, name string, newParent ffs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+func (n *sdfsNode) Rename(ctx context.Context, name string, newParent ffs.InodeEmbedder, newName string, flags uint32) (errno syscall.Errno) {
+	ctx, op := n.begin(ctx, "rename")
+	defer op.end(&errno)
 	newParentsdfs := tosdfsNode(newParent)
-	/*
-		if flags&ffs.RENAME_EXCHANGE != 0 {
-			return n.renameExchange(name, newParentsdfs, newName)
-		}
-	*/
-
 	p1 := filepath.Join(n.path(), name)
 	p2 := filepath.Join(newParentsdfs.path(), newName)
-	err := con.Rename(ctx, p1, p2)
-	return ToErrno(err)
+	errno = n.rename(ctx, p1, p2, flags)
+	// After an exchange both paths hold what used to be at the other,
+	// so everything cached below either of them is stale.
+	n.cache().invalidateTree(p1)
+	n.cache().invalidateTree(p2)
+	n.cache().invalidate(n.path(), newParentsdfs.path())
+	n.root().blocks.invalidateTree(p1)
+	n.root().blocks.invalidateTree(p2)
+	return errno
+}
+
+// rename moves p1 to p2 honoring the renameat2(2) flags. Backends that
+// are not a FlagRenamer cannot apply them atomically, so both
+// RENAME_NOREPLACE and RENAME_EXCHANGE fail with EINVAL there, as on
+// filesystems without renameat2, and callers fall back to their own way.
+func (n *sdfsNode) rename(ctx context.Context, p1, p2 string, flags uint32) syscall.Errno {
+	if flags == 0 {
+		return errnoOf(ctx, n.backend().Rename(ctx, p1, p2))
+	}
+	if flags&^(unix.RENAME_NOREPLACE|ffs.RENAME_EXCHANGE) != 0 ||
+		flags&unix.RENAME_NOREPLACE != 0 && flags&ffs.RENAME_EXCHANGE != 0 {
+		return syscall.EINVAL
+	}
+	fr, ok := asFlagRenamer(n.backend())
+	if !ok {
+		return syscall.EINVAL
+	}
+	err := fr.RenameWithFlags(ctx, p1, p2, flags)
+	if err != nil {
+		log.Debugf("rename %s %s flags %#x %v", p1, p2, flags, err)
+	}
+	return errnoOf(ctx, err)
 }
 
 func (r *sdfsRoot) idFromStat(st *sapi.Stat) ffs.StableAttr {
@@ -338,94 +519,117 @@ func (r *sdfsRoot) idFromStat(st *sapi.Stat) ffs.StableAttr {
 }
 
 func (n *sdfsNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *ffs.Inode, fh ffs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	ctx, op := n.begin(ctx, "create")
+	defer op.end(&errno)
 	p := filepath.Join(n.path(), name)
-	err := con.MkNod(ctx, p, int32(mode), 0)
+	err := n.backend().MkNod(ctx, p, int32(mode), 0)
+	n.cache().invalidate(p, n.path())
 	if err != nil {
-		return nil, nil, 0, ToErrno(err)
+		return nil, nil, 0, errnoOf(ctx, err)
 	}
 	n.preserveOwner(ctx, p)
-	fi, err := con.GetAttr(ctx, p)
+	fi, err := n.cache().fetchAttr(ctx, n.backend(), p)
 	if err != nil {
-		con.Unlink(ctx, p)
-		return nil, nil, 0, ToErrno(err)
+		n.backend().Unlink(ctx, p)
+		return nil, nil, 0, errnoOf(ctx, err)
 	}
-	fd, err := con.Open(ctx, p, int32(flags))
+	fd, err := n.backend().Open(ctx, p, int32(flags&^syscall.O_APPEND))
 	if err != nil {
-		con.Unlink(ctx, p)
-		return nil, nil, 0, ToErrno(err)
+		n.backend().Unlink(ctx, p)
+		return nil, nil, 0, errnoOf(ctx, err)
 	}
 	node := &sdfsNode{}
 	ch := n.NewInode(ctx, node, n.root().idFromStat(fi))
-	lf := NewsdfsFile(fd, p)
+	lf := node.newFile(fd, p)
+	lf.append = flags&syscall.O_APPEND != 0
 	ToAttr(fi, &out.Attr)
 	return ch, lf, 0, 0
 }
 
-func (n *sdfsNode) Symlink(ctx context.Context, name, target string, out *fuse.EntryOut) (*ffs.Inode, syscall.Errno) {
-	//p := filepath.Join(n.path(), name)
-	err := con.SymLink(ctx, name, target)
+// Link fails with EPERM, as link(2) does on filesystems without hard
+// links. The volume gives every name a file of its own.
+func (n *sdfsNode) Link(ctx context.Context, target ffs.InodeEmbedder, name string, out *fuse.EntryOut) (*ffs.Inode, syscall.Errno) {
+	return nil, syscall.EPERM
+}
+
+// Symlink creates name in n pointing at target. The target is stored as
+// given, so relative and dangling targets are preserved, and the new
+// node carries the attributes of the link itself.
+func (n *sdfsNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (_ *ffs.Inode, errno syscall.Errno) {
+	ctx, op := n.begin(ctx, "symlink")
+	defer op.end(&errno)
+	p := filepath.Join(n.path(), name)
+	err := n.backend().SymLink(ctx, target, p)
+	n.cache().invalidate(p, n.path())
 	if err != nil {
-		log.Debugf("error during symlink %s to %s : %v", name, target, err)
-		return nil, ToErrno(err)
+		log.Debugf("error during symlink %s to %s : %v", p, target, err)
+		return nil, errnoOf(ctx, err)
 	}
-	n.preserveOwner(ctx, target)
-	fi, err := con.GetAttr(ctx, target)
+	n.preserveOwner(ctx, p)
+	fi, err := n.cache().fetchAttr(ctx, n.backend(), p)
 	if err != nil {
-		log.Debugf("error getting attr during symlink %s to %s :%v", name, target, err)
-		con.Unlink(ctx, target)
-		return nil, ToErrno(err)
+		log.Debugf("error getting attr during symlink %s to %s :%v", p, target, err)
+		n.backend().Unlink(ctx, p)
+		n.cache().invalidate(p)
+		return nil, errnoOf(ctx, err)
 	}
+	ToStat(fi, out)
 	node := &sdfsNode{}
 	ch := n.NewInode(ctx, node, n.root().idFromStat(fi))
 	return ch, 0
 }
 
 func (n *sdfsNode) Open(ctx context.Context, flags uint32) (fh ffs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	flags = flags &^ syscall.O_APPEND
+	ctx, op := n.begin(ctx, "open")
+	defer op.end(&errno)
+	// Appending is done by the handle, which knows where the end of the
+	// file is on the server, rather than by the offsets the kernel sends.
 	p := n.path()
-	f, err := con.Open(ctx, p, int32(flags))
+	f, err := n.backend().Open(ctx, p, int32(flags&^syscall.O_APPEND))
 	if err != nil {
-		return nil, 0, ToErrno(err)
+		return nil, 0, errnoOf(ctx, err)
 	}
-	lf := NewsdfsFile(f, p)
+	lf := n.newFile(f, p)
+	lf.append = flags&syscall.O_APPEND != 0
 	return lf, 0, 0
 }
 
-func (n *sdfsNode) Opendir(ctx context.Context) syscall.Errno {
+func (n *sdfsNode) Opendir(ctx context.Context) (errno syscall.Errno) {
+	ctx, op := n.begin(ctx, "opendir")
+	defer op.end(&errno)
 
 	p := n.path()
-	_, err := con.Stat(ctx, p)
+	_, err := n.cache().stat(ctx, n.backend(), p)
 	if err != nil {
-		return ToErrno(err)
+		return errnoOf(ctx, err)
 	}
 	return ffs.OK
 }
 
-func (n *sdfsNode) Readdir(ctx context.Context) (ffs.DirStream, syscall.Errno) {
-	return NewsdfsDirStream(ctx, n.path())
+func (n *sdfsNode) Readdir(ctx context.Context) (_ ffs.DirStream, errno syscall.Errno) {
+	ctx, op := n.begin(ctx, "readdir")
+	defer op.end(&errno)
+	ds, errno := openDirStream(ctx, n.backend(), n.path(), n.root().dirPageSize, n)
+	if errno != 0 {
+		return nil, errno
+	}
+	return ds, ffs.OK
 }
 
-func (n *sdfsNode) Getattr(ctx context.Context, f ffs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	p := n.path()
-
-	fi, err := con.GetAttr(ctx, p)
+func (n *sdfsNode) Getattr(ctx context.Context, f ffs.FileHandle, out *fuse.AttrOut) (errno syscall.Errno) {
+	ctx, op := n.begin(ctx, "getattr")
+	defer op.end(&errno)
+	fi, err := n.getattr(ctx)
 	if err != nil {
-		return ToErrno(err)
+		return errnoOf(ctx, err)
 	}
-	atime := time.Unix(0, fi.Atime*int64(time.Millisecond))
-	ctime := time.Unix(0, fi.Ctim*int64(time.Millisecond))
-	mtime := time.Unix(0, fi.Mtim*int64(time.Millisecond))
-	out.SetTimes(&atime, &mtime, &ctime)
-	out.Size = uint64(fi.Size)
-	out.Blocks = uint64(fi.Size / 512)
-	out.Owner.Uid = uint32(fi.Uid)
-	out.Owner.Gid = uint32(fi.Gid)
-	out.Mode = uint32(fi.Mode)
-	out.Blksize = 512
+	ToAttr(fi, &out.Attr)
 	return ffs.OK
 }
 
-func (n *sdfsNode) Setattr(ctx context.Context, f ffs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+func (n *sdfsNode) Setattr(ctx context.Context, f ffs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) (errno syscall.Errno) {
+	ctx, op := n.begin(ctx, "setattr")
+	defer op.end(&errno)
 	p := n.path()
 	z := n.Path(&n.Inode)
 	log.Printf("z = %s", z)
@@ -434,9 +638,12 @@ func (n *sdfsNode) Setattr(ctx context.Context, f ffs.FileHandle, in *fuse.SetAt
 
 		fsa.Setattr(ctx, in, out)
 	} else {
+		n.root().writes.flushIno(ctx, n.StableAttr().Ino)
+		defer n.root().reads.invalidate(n.StableAttr().Ino)
+		defer n.root().blocks.invalidate(p)
 		if m, ok := in.GetMode(); ok {
-			if err := con.Chmod(ctx, p, int32(m)); err != nil {
-				return ToErrno(err)
+			if err := n.backend().Chmod(ctx, p, int32(m)); err != nil {
+				return errnoOf(ctx, err)
 			}
 		}
 		log.Debugf("reading %v", in)
@@ -452,8 +659,8 @@ func (n *sdfsNode) Setattr(ctx context.Context, f ffs.FileHandle, in *fuse.SetAt
 				sgid = int(gid)
 			}
 			log.Printf("setarr uid = %d guid = %d path = %s", uid, gid, p)
-			if err := con.Chown(ctx, p, int32(sgid), int32(suid)); err != nil {
-				return ToErrno(err)
+			if err := n.backend().Chown(ctx, p, int32(sgid), int32(suid)); err != nil {
+				return errnoOf(ctx, err)
 			}
 		}
 
@@ -473,60 +680,74 @@ func (n *sdfsNode) Setattr(ctx context.Context, f ffs.FileHandle, in *fuse.SetAt
 			at := fuse.UtimeToTimespec(ap).Nsec / int64(time.Millisecond)
 			mt := fuse.UtimeToTimespec(mp).Nsec / int64(time.Millisecond)
 
-			if err := con.Utime(ctx, p, at, mt); err != nil {
-				return ffs.ToErrno(err)
+			if err := n.backend().Utime(ctx, p, at, mt); err != nil {
+				return errnoOf(ctx, err)
 			}
 		}
 
 		if sz, ok := in.GetSize(); ok {
-			if err := con.Truncate(ctx, p, int64(sz)); err != nil {
-				return ffs.ToErrno(err)
+			if err := n.backend().Truncate(ctx, p, int64(sz)); err != nil {
+				return errnoOf(ctx, err)
 			}
 		}
 	}
 
-	fi, err := con.GetAttr(ctx, p)
+	n.cache().invalidate(p)
+	fi, err := n.cache().fetchAttr(ctx, n.backend(), p)
 	if err != nil {
-		return ToErrno(err)
+		return errnoOf(ctx, err)
 	}
-	atime := time.Unix(0, fi.Atime*int64(time.Millisecond))
-	ctime := time.Unix(0, fi.Ctim*int64(time.Millisecond))
-	mtime := time.Unix(0, fi.Mtim*int64(time.Millisecond))
-	out.SetTimes(&atime, &mtime, &ctime)
-	out.Size = uint64(fi.Size)
-	out.Blocks = uint64(fi.Size / 512)
 	log.Printf("uid = %d guid = %d", fi.Uid, fi.Gid)
-	out.Owner.Uid = uint32(fi.Uid)
-	out.Owner.Gid = uint32(fi.Gid)
-	out.Mode = uint32(fi.Mode)
-	out.Blksize = 512
+	ToAttr(fi, &out.Attr)
 
 	return ffs.OK
 }
 
-// NewsdfsRoot returns a root node for a sdfs file system whose
-// root is at the given root. This node implements all NodeXxxxer
-// operations available.
-func NewsdfsRoot(root string, connectionInfo ConnectionInfo) (ffs.InodeEmbedder, error) {
-	var err error
-	spb.DisableTrust = connectionInfo.DisableTrust
-	spb.Password = connectionInfo.Pwd
-	spb.UserName = connectionInfo.User
-	con, err = spb.NewConnection(root, connectionInfo.Dedupe, !connectionInfo.Nocompress,
-		connectionInfo.Volumeid, connectionInfo.Cachsize, connectionInfo.Cachage)
-	if err != nil {
-		return nil, err
-	}
+// NewsdfsRoot returns a root node for a sdfs file system backed by con.
+// This node implements all NodeXxxxer operations available.
+func NewsdfsRoot(con Backend, connectionInfo ConnectionInfo) (ffs.InodeEmbedder, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	fi, err := con.GetVolumeInfo(ctx)
 	if err != nil {
 		return nil, err
 	}
+	var blocks *blockCache
+	if connectionInfo.BlockCacheDir != "" {
+		// Paths only mean something within a volume.
+		dir := filepath.Join(connectionInfo.BlockCacheDir, strconv.FormatInt(fi.SerialNumber, 10))
+		if blocks, err = openBlockCache(dir, connectionInfo.BlockCacheSize); err != nil {
+			return nil, err
+		}
+	}
 	n := &sdfsRoot{
-		rootPath:  "/",
-		rootDev:   uint64(fi.SerialNumber),
-		rootMount: connectionInfo.MountPath,
+		con:         con,
+		cache:       newAttrCache(connectionInfo.AttrCacheTTL, connectionInfo.NegativeCacheTTL),
+		locks:       newLockTable(),
+		writes:      newWriteBuffers(connectionInfo.WriteBufferSize, connectionInfo.WriteBufferMemory),
+		appends:     newAppendLocks(),
+		reads:       newReadAheads(connectionInfo.ReadAheadSize, connectionInfo.ReadAheadParallel),
+		blocks:      blocks,
+		handles:     &handleCount{},
+		unexpected:  newErrorCounts(),
+		rootPath:    "/",
+		rootDev:     uint64(fi.SerialNumber),
+		rootMount:   connectionInfo.MountPath,
+		dirPageSize: int32(connectionInfo.DirPageSize),
 	}
 	return n, nil
 }
+
+// Mount serves the file system of root on dir, as ffs.Mount does, through
+// NewRawFS.
+func Mount(dir string, root ffs.InodeEmbedder, opts *ffs.Options) (*fuse.Server, error) {
+	server, err := fuse.NewServer(NewRawFS(root, opts), dir, &opts.MountOptions)
+	if err != nil {
+		return nil, err
+	}
+	go server.Serve()
+	if err := server.WaitMount(); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
@@ -0,0 +1,447 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	ffs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/opendedup/gofuse-sdfs/fs/sdfstest"
+	spb "github.com/opendedup/sdfs-client-go/api"
+	sapi "github.com/opendedup/sdfs-client-go/sdfs"
+	"golang.org/x/sys/unix"
+)
+
+// newTestRoot builds a node tree over an in-memory volume without
+// mounting it.
+func newTestRoot(t *testing.T) (*sdfsRoot, *sdfstest.MemBackend) {
+	t.Helper()
+	mb := sdfstest.NewMemBackend()
+	r, err := NewsdfsRoot(mb, ConnectionInfo{MountPath: "/mnt/sdfs-test"})
+	if err != nil {
+		t.Fatalf("NewsdfsRoot: %v", err)
+	}
+	root := r.(*sdfsRoot)
+	ffs.NewNodeFS(root, &ffs.Options{})
+	return root, mb
+}
+
+// lookup resolves name below parent and links the result into the tree,
+// as the FUSE bridge does after a LOOKUP.
+func lookup(t *testing.T, parent *sdfsNode, name string) *sdfsNode {
+	t.Helper()
+	var out fuse.EntryOut
+	ch, errno := parent.Lookup(context.Background(), name, &out)
+	if errno != 0 {
+		t.Fatalf("Lookup(%q): %v", name, errno)
+	}
+	parent.AddChild(name, ch, true)
+	return ch.Operations().(*sdfsNode)
+}
+
+// create makes a regular file below parent and returns its node and an
+// open handle.
+func create(t *testing.T, parent *sdfsNode, name string) (*sdfsNode, *sdfsFile) {
+	t.Helper()
+	var out fuse.EntryOut
+	ch, fh, _, errno := parent.Create(context.Background(), name, syscall.O_RDWR, syscall.S_IFREG|0644, &out)
+	if errno != 0 {
+		t.Fatalf("Create(%q): %v", name, errno)
+	}
+	parent.AddChild(name, ch, true)
+	return ch.Operations().(*sdfsNode), fh.(*sdfsFile)
+}
+
+func mkdir(t *testing.T, parent *sdfsNode, name string) *sdfsNode {
+	t.Helper()
+	var out fuse.EntryOut
+	ch, errno := parent.Mkdir(context.Background(), name, 0755, &out)
+	if errno != 0 {
+		t.Fatalf("Mkdir(%q): %v", name, errno)
+	}
+	if out.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		t.Errorf("Mkdir(%q) mode %o, want a directory", name, out.Mode)
+	}
+	parent.AddChild(name, ch, true)
+	return ch.Operations().(*sdfsNode)
+}
+
+func TestRootGetattr(t *testing.T) {
+	root, _ := newTestRoot(t)
+	var out fuse.AttrOut
+	if errno := root.Getattr(context.Background(), nil, &out); errno != 0 {
+		t.Fatalf("Getattr: %v", errno)
+	}
+	if out.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		t.Errorf("root mode %o, want a directory", out.Mode)
+	}
+}
+
+func TestLookupMissing(t *testing.T) {
+	root, _ := newTestRoot(t)
+	var out fuse.EntryOut
+	if _, errno := root.Lookup(context.Background(), "missing", &out); errno != syscall.ENOENT {
+		t.Errorf("Lookup(missing) = %v, want ENOENT", errno)
+	}
+}
+
+func TestCreateLookup(t *testing.T) {
+	root, _ := newTestRoot(t)
+	ctx := context.Background()
+	n, fh := create(t, &root.sdfsNode, "file")
+	defer fh.Release(ctx)
+
+	if n.path() != "/file" {
+		t.Errorf("path %q, want /file", n.path())
+	}
+	var out fuse.EntryOut
+	if _, _, _, errno := root.Create(ctx, "file", syscall.O_RDWR, 0644, &out); errno != syscall.EEXIST {
+		t.Errorf("second Create = %v, want EEXIST", errno)
+	}
+	got := lookup(t, &root.sdfsNode, "file")
+	if got.StableAttr().Ino != n.StableAttr().Ino {
+		t.Errorf("Lookup ino %d, Create ino %d", got.StableAttr().Ino, n.StableAttr().Ino)
+	}
+}
+
+func TestMkdirRmdir(t *testing.T) {
+	root, _ := newTestRoot(t)
+	ctx := context.Background()
+	dir := mkdir(t, &root.sdfsNode, "dir")
+	_, fh := create(t, dir, "file")
+	fh.Release(ctx)
+
+	if errno := root.Rmdir(ctx, "dir"); errno != syscall.ENOTEMPTY {
+		t.Errorf("Rmdir(non-empty) = %v, want ENOTEMPTY", errno)
+	}
+	if errno := dir.Unlink(ctx, "file"); errno != 0 {
+		t.Fatalf("Unlink: %v", errno)
+	}
+	if errno := root.Rmdir(ctx, "dir"); errno != 0 {
+		t.Fatalf("Rmdir: %v", errno)
+	}
+	var out fuse.EntryOut
+	if _, errno := root.Lookup(ctx, "dir", &out); errno != syscall.ENOENT {
+		t.Errorf("Lookup after Rmdir = %v, want ENOENT", errno)
+	}
+}
+
+func TestMknod(t *testing.T) {
+	root, _ := newTestRoot(t)
+	var out fuse.EntryOut
+	if _, errno := root.Mknod(context.Background(), "fifo", syscall.S_IFIFO|0600, 0, &out); errno != 0 {
+		t.Fatalf("Mknod: %v", errno)
+	}
+	if out.Mode != syscall.S_IFIFO|0600 {
+		t.Errorf("Mknod mode %o, want %o", out.Mode, syscall.S_IFIFO|0600)
+	}
+}
+
+func TestUnlink(t *testing.T) {
+	root, mb := newTestRoot(t)
+	ctx := context.Background()
+	_, fh := create(t, &root.sdfsNode, "file")
+	fh.Release(ctx)
+
+	if errno := root.Unlink(ctx, "file"); errno != 0 {
+		t.Fatalf("Unlink: %v", errno)
+	}
+	if _, err := mb.GetAttr(ctx, "/file"); ToErrno(err) != syscall.ENOENT {
+		t.Errorf("GetAttr after Unlink = %v, want ENOENT", err)
+	}
+	if errno := root.Unlink(ctx, "file"); errno != syscall.ENOENT {
+		t.Errorf("second Unlink = %v, want ENOENT", errno)
+	}
+}
+
+func TestRename(t *testing.T) {
+	root, mb := newTestRoot(t)
+	ctx := context.Background()
+	dir := mkdir(t, &root.sdfsNode, "dir")
+	_, fh := create(t, &root.sdfsNode, "a")
+	fh.Write(ctx, []byte("hello"), 0)
+	fh.Release(ctx)
+
+	if errno := root.Rename(ctx, "a", dir, "b", 0); errno != 0 {
+		t.Fatalf("Rename: %v", errno)
+	}
+	if _, err := mb.GetAttr(ctx, "/a"); ToErrno(err) != syscall.ENOENT {
+		t.Errorf("GetAttr(/a) after Rename = %v, want ENOENT", err)
+	}
+	fi, err := mb.GetAttr(ctx, "/dir/b")
+	if err != nil {
+		t.Fatalf("GetAttr(/dir/b): %v", err)
+	}
+	if fi.Size != 5 {
+		t.Errorf("renamed size %d, want 5", fi.Size)
+	}
+	if errno := root.Rename(ctx, "a", dir, "c", 0); errno != syscall.ENOENT {
+		t.Errorf("Rename(missing) = %v, want ENOENT", errno)
+	}
+}
+
+func TestRenameNoReplace(t *testing.T) {
+	root, mb := newTestRoot(t)
+	ctx := context.Background()
+	_, fh := create(t, &root.sdfsNode, "a")
+	fh.Release(ctx)
+	_, fh = create(t, &root.sdfsNode, "b")
+	fh.Release(ctx)
+
+	if errno := root.Rename(ctx, "a", root, "b", unix.RENAME_NOREPLACE); errno != syscall.EEXIST {
+		t.Errorf("Rename(NOREPLACE) onto existing = %v, want EEXIST", errno)
+	}
+	if _, err := mb.GetAttr(ctx, "/a"); err != nil {
+		t.Errorf("source gone after failed rename: %v", err)
+	}
+	if errno := root.Rename(ctx, "a", root, "c", unix.RENAME_NOREPLACE); errno != 0 {
+		t.Errorf("Rename(NOREPLACE) = %v", errno)
+	}
+
+	// Without backend support the flag is refused rather than emulated.
+	root.con = plainBackend{mb}
+	if errno := root.Rename(ctx, "c", root, "d", unix.RENAME_NOREPLACE); errno != syscall.EINVAL {
+		t.Errorf("Rename(NOREPLACE) without backend support = %v, want EINVAL", errno)
+	}
+	if _, err := mb.GetAttr(ctx, "/c"); err != nil {
+		t.Errorf("source gone after refused rename: %v", err)
+	}
+	if errno := root.Rename(ctx, "c", root, "b", 0); errno != 0 {
+		t.Errorf("Rename without flags = %v", errno)
+	}
+}
+
+func TestRenameExchange(t *testing.T) {
+	root, mb := newTestRoot(t)
+	ctx := context.Background()
+	dir := mkdir(t, &root.sdfsNode, "dir")
+	_, fh := create(t, dir, "inner")
+	fh.Release(ctx)
+	_, fh = create(t, &root.sdfsNode, "file")
+	fh.Write(ctx, []byte("hello"), 0)
+	fh.Release(ctx)
+
+	before, _ := mb.GetAttr(ctx, "/file")
+	if errno := root.Rename(ctx, "dir", root, "file", ffs.RENAME_EXCHANGE); errno != 0 {
+		t.Fatalf("Rename(EXCHANGE): %v", errno)
+	}
+	fi, err := mb.GetAttr(ctx, "/dir")
+	if err != nil || fi.Dev != before.Dev || fi.Size != 5 {
+		t.Errorf("/dir after exchange = %+v, %v, want the old /file", fi, err)
+	}
+	if _, err := mb.GetAttr(ctx, "/file/inner"); err != nil {
+		t.Errorf("/file/inner after exchange: %v", err)
+	}
+	if f := lookup(t, &root.sdfsNode, "file"); f.StableAttr().Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		t.Errorf("Lookup(file) after exchange mode %o, want a directory", f.StableAttr().Mode)
+	}
+
+	if errno := root.Rename(ctx, "dir", root, "missing", ffs.RENAME_EXCHANGE); errno != syscall.ENOENT {
+		t.Errorf("Rename(EXCHANGE) with missing target = %v, want ENOENT", errno)
+	}
+	if errno := root.Rename(ctx, "dir", root, "file", ffs.RENAME_EXCHANGE|unix.RENAME_NOREPLACE); errno != syscall.EINVAL {
+		t.Errorf("Rename(EXCHANGE|NOREPLACE) = %v, want EINVAL", errno)
+	}
+	root.con = plainBackend{mb}
+	if errno := root.Rename(ctx, "dir", root, "file", ffs.RENAME_EXCHANGE); errno != syscall.EINVAL {
+		t.Errorf("Rename(EXCHANGE) without backend support = %v, want EINVAL", errno)
+	}
+}
+
+func TestXattr(t *testing.T) {
+	root, _ := newTestRoot(t)
+	ctx := context.Background()
+	n, fh := create(t, &root.sdfsNode, "file")
+	fh.Release(ctx)
+
+	if errno := n.Setxattr(ctx, "user.a", []byte("1"), 0); errno != 0 {
+		t.Fatalf("Setxattr: %v", errno)
+	}
+	if errno := n.Setxattr(ctx, "user.b", []byte("22"), 0); errno != 0 {
+		t.Fatalf("Setxattr: %v", errno)
+	}
+	buf := make([]byte, 64)
+	sz, errno := n.Getxattr(ctx, "user.b", buf)
+	if errno != 0 {
+		t.Fatalf("Getxattr: %v", errno)
+	}
+	if string(buf[:sz]) != "22" {
+		t.Errorf("Getxattr = %q, want 22", buf[:sz])
+	}
+	sz, errno = n.Listxattr(ctx, buf)
+	if errno != 0 {
+		t.Fatalf("Listxattr: %v", errno)
+	}
+	if got := strings.Split(strings.TrimRight(string(buf[:sz]), "\x00"), "\x00"); strings.Join(got, ",") != "user.a,user.b" {
+		t.Errorf("Listxattr = %q", got)
+	}
+	if errno := n.Removexattr(ctx, "user.a"); errno != 0 {
+		t.Fatalf("Removexattr: %v", errno)
+	}
+	if _, errno := n.Getxattr(ctx, "user.a", buf); errno != syscall.ENODATA {
+		t.Errorf("Getxattr after Removexattr = %v, want ENODATA", errno)
+	}
+}
+
+func TestSetattr(t *testing.T) {
+	root, _ := newTestRoot(t)
+	ctx := context.Background()
+	n, fh := create(t, &root.sdfsNode, "file")
+	fh.Write(ctx, bytes.Repeat([]byte{'x'}, 100), 0)
+	fh.Release(ctx)
+
+	in := &fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_MODE | fuse.FATTR_UID | fuse.FATTR_GID | fuse.FATTR_SIZE
+	in.Mode = 0600
+	in.Uid = 1000
+	in.Gid = 1001
+	in.Size = 10
+	var out fuse.AttrOut
+	if errno := n.Setattr(ctx, nil, in, &out); errno != 0 {
+		t.Fatalf("Setattr: %v", errno)
+	}
+	if out.Mode != syscall.S_IFREG|0600 {
+		t.Errorf("mode %o, want %o", out.Mode, syscall.S_IFREG|0600)
+	}
+	if out.Uid != 1000 || out.Gid != 1001 {
+		t.Errorf("owner %d:%d, want 1000:1001", out.Uid, out.Gid)
+	}
+	if out.Size != 10 {
+		t.Errorf("size %d, want 10", out.Size)
+	}
+
+	var attr fuse.AttrOut
+	if errno := n.Getattr(ctx, nil, &attr); errno != 0 {
+		t.Fatalf("Getattr: %v", errno)
+	}
+	if attr.Size != 10 || attr.Mode != out.Mode {
+		t.Errorf("Getattr = size %d mode %o, want size 10 mode %o", attr.Size, attr.Mode, out.Mode)
+	}
+}
+
+func TestStatfs(t *testing.T) {
+	root, _ := newTestRoot(t)
+	var out fuse.StatfsOut
+	if errno := root.Statfs(context.Background(), &out); errno != 0 {
+		t.Fatalf("Statfs: %v", errno)
+	}
+	if out.Bsize == 0 || out.Blocks == 0 || out.NameLen != 255 {
+		t.Errorf("Statfs = %+v", out)
+	}
+}
+
+func TestToAttrBlocks(t *testing.T) {
+	for _, tc := range []struct {
+		size, blocks int64
+		want         uint64
+	}{
+		{8192, 8, 8},
+		{8192, 0, 16},
+		{1000, 0, 2},
+		{0, 0, 0},
+	} {
+		var out fuse.Attr
+		ToAttr(&sapi.Stat{Size: tc.size, Blocks: tc.blocks}, &out)
+		if out.Blocks != tc.want {
+			t.Errorf("size %d with %d blocks reported as %d blocks, want %d", tc.size, tc.blocks, out.Blocks, tc.want)
+		}
+	}
+}
+
+// plainBackend hides the optional interfaces, such as FlagRenamer and
+// Locker, of the backend it wraps. It offers what a volume offers
+// through *spb.SdfsConnection.
+type plainBackend struct {
+	Backend
+}
+
+// TestConnectionCapabilities pins down the optional interfaces the volume
+// client lacks, which makes the tests against plainBackend the tests
+// of a real mount. When the client gains one, the fallback it replaces and
+// the limitations in README.md need another look.
+func TestConnectionCapabilities(t *testing.T) {
+	var con Backend = &spb.SdfsConnection{}
+	for name, ok := range map[string]bool{
+		"FlagRenamer": hasInterface(con, (*FlagRenamer)(nil)),
+		"Locker":      hasInterface(con, (*Locker)(nil)),
+		"Allocator":   hasInterface(con, (*Allocator)(nil)),
+		"Appender":    hasInterface(con, (*Appender)(nil)),
+	} {
+		if ok {
+			t.Errorf("*spb.SdfsConnection is a %s now", name)
+		}
+	}
+}
+
+// hasInterface reports whether b implements the interface iface points to.
+func hasInterface(b Backend, iface interface{}) bool {
+	return reflect.TypeOf(b).Implements(reflect.TypeOf(iface).Elem())
+}
+
+func TestLinkUnsupported(t *testing.T) {
+	root, _ := newTestRoot(t)
+	ctx := context.Background()
+	a, fh := create(t, &root.sdfsNode, "a")
+	fh.Release(ctx)
+	var out fuse.EntryOut
+	if _, errno := root.Link(ctx, a, "b", &out); errno != syscall.EPERM {
+		t.Errorf("Link = %v, want EPERM", errno)
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	root, mb := newTestRoot(t)
+	ctx := context.Background()
+	dir := mkdir(t, &root.sdfsNode, "dir")
+	_, fh := create(t, &root.sdfsNode, "file")
+	fh.Release(ctx)
+
+	for _, tc := range []struct {
+		name, target string
+	}{
+		{"relative", "../file"},
+		{"absolute", "/mnt/sdfs-test/file"},
+		{"dangling", "missing/target"},
+	} {
+		var out fuse.EntryOut
+		ch, errno := dir.Symlink(ctx, tc.target, tc.name, &out)
+		if errno != 0 {
+			t.Fatalf("Symlink(%s): %v", tc.name, errno)
+		}
+		dir.AddChild(tc.name, ch, true)
+		if out.Mode&syscall.S_IFMT != syscall.S_IFLNK || out.Size != uint64(len(tc.target)) {
+			t.Errorf("%s: mode %o size %d, want a link of size %d", tc.name, out.Mode, out.Size, len(tc.target))
+		}
+		if ch.StableAttr().Mode&syscall.S_IFMT != syscall.S_IFLNK {
+			t.Errorf("%s: inode mode %o, want a link", tc.name, ch.StableAttr().Mode)
+		}
+		if got, err := mb.ReadLink(ctx, "/dir/"+tc.name); err != nil || got != tc.target {
+			t.Errorf("%s: backend link = %q, %v, want %q", tc.name, got, err, tc.target)
+		}
+
+		n := lookup(t, dir, tc.name)
+		var attr fuse.AttrOut
+		if errno := n.Getattr(ctx, nil, &attr); errno != 0 {
+			t.Fatalf("%s: Getattr: %v", tc.name, errno)
+		}
+		if attr.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+			t.Errorf("%s: Getattr mode %o, want a link", tc.name, attr.Mode)
+		}
+		got, errno := n.Readlink(ctx)
+		if errno != 0 || string(got) != tc.target {
+			t.Errorf("%s: Readlink = %q, %v, want %q", tc.name, got, errno, tc.target)
+		}
+	}
+
+	var out fuse.EntryOut
+	if _, errno := dir.Symlink(ctx, "x", "relative", &out); errno != syscall.EEXIST {
+		t.Errorf("Symlink over existing name = %v, want EEXIST", errno)
+	}
+	if _, err := mb.GetAttr(ctx, "/relative"); ToErrno(err) != syscall.ENOENT {
+		t.Errorf("link was created at the volume root: %v", err)
+	}
+}
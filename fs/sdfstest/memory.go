@@ -0,0 +1,827 @@
+// Package sdfstest provides an in-memory implementation of the SDFS
+// connection surface used by package fs, so the filesystem can be
+// exercised without a running SDFS volume service.
+package sdfstest
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	spb "github.com/opendedup/sdfs-client-go/api"
+	sapi "github.com/opendedup/sdfs-client-go/sdfs"
+	"golang.org/x/sys/unix"
+)
+
+const blockSize = 4096
+
+type memInode struct {
+	ino    int64
+	mode   int32
+	uid    int32
+	gid    int32
+	rdev   int32
+	atime  int64
+	mtime  int64
+	ctime  int64
+	data   []byte
+	target string
+	xattrs map[string]string
+}
+
+type memHandle struct {
+	path  string
+	node  *memInode
+	flags int32
+}
+
+// MemBackend is an in-memory SDFS volume. It is safe for concurrent use.
+type MemBackend struct {
+	mu      sync.Mutex
+	paths   map[string]*memInode
+	fds     map[int64]*memHandle
+	nextIno int64
+	nextFd  int64
+	serial  int64
+	calls   map[string]int
+}
+
+// NewMemBackend returns an empty volume containing only the root directory.
+func NewMemBackend() *MemBackend {
+	m := &MemBackend{
+		paths:   make(map[string]*memInode),
+		fds:     make(map[int64]*memHandle),
+		nextIno: 1,
+		nextFd:  1,
+		serial:  0x5d75,
+		calls:   make(map[string]int),
+	}
+	m.paths["/"] = m.newInode(syscall.S_IFDIR | 0755)
+	return m
+}
+
+// Calls returns how many times op has been invoked on the backend.
+func (m *MemBackend) Calls(op string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls[op]
+}
+
+// ResetCalls clears the per operation call counters.
+func (m *MemBackend) ResetCalls() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = make(map[string]int)
+}
+
+func (m *MemBackend) enter(op string) {
+	m.mu.Lock()
+	m.calls[op]++
+}
+
+func newError(errno syscall.Errno, op, path string) error {
+	return &spb.SdfsError{Err: op + " " + path + ": " + errno.Error(), ErrorCode: errno}
+}
+
+func now() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func (m *MemBackend) newInode(mode int32) *memInode {
+	t := now()
+	n := &memInode{
+		ino:    m.nextIno,
+		mode:   mode,
+		atime:  t,
+		mtime:  t,
+		ctime:  t,
+		xattrs: make(map[string]string),
+	}
+	m.nextIno++
+	return n
+}
+
+func clean(path string) string {
+	return filepath.Join("/", path)
+}
+
+func isDir(n *memInode) bool {
+	return n.mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+// lookupParent returns the directory that would contain path.
+func (m *MemBackend) lookupParent(op, path string) (*memInode, error) {
+	parent, ok := m.paths[filepath.Dir(path)]
+	if !ok {
+		return nil, newError(syscall.ENOENT, op, path)
+	}
+	if !isDir(parent) {
+		return nil, newError(syscall.ENOTDIR, op, path)
+	}
+	return parent, nil
+}
+
+func (m *MemBackend) lookup(op, path string) (*memInode, error) {
+	n, ok := m.paths[path]
+	if !ok {
+		return nil, newError(syscall.ENOENT, op, path)
+	}
+	return n, nil
+}
+
+// children returns the sorted names directly below dir.
+func (m *MemBackend) children(dir string) []string {
+	prefix := dir
+	if prefix != "/" {
+		prefix += "/"
+	}
+	var names []string
+	for p := range m.paths {
+		if p == dir || !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		name := p[len(prefix):]
+		if !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *MemBackend) stat(name string, n *memInode) *sapi.Stat {
+	size := int64(len(n.data))
+	if n.mode&syscall.S_IFMT == syscall.S_IFLNK {
+		size = int64(len(n.target))
+	}
+	return &sapi.Stat{
+		FileName: name,
+		Dev:      n.ino,
+		Ino:      n.ino,
+		Mode:     n.mode,
+		Nlink:    1,
+		Uid:      n.uid,
+		Gid:      n.gid,
+		Rdev:     int64(n.rdev),
+		Size:     size,
+		Blksize:  blockSize,
+		Blocks:   allocated(n.data) / 512,
+		Atime:    n.atime,
+		Mtim:     n.mtime,
+		Ctim:     n.ctime,
+	}
+}
+
+// GetVolumeInfo returns the volume serial number and its capacity.
+func (m *MemBackend) GetVolumeInfo(ctx context.Context) (*sapi.VolumeInfoResponse, error) {
+	m.enter("GetVolumeInfo")
+	defer m.mu.Unlock()
+	var used int64
+	for _, n := range m.paths {
+		used += int64(len(n.data))
+	}
+	return &sapi.VolumeInfoResponse{
+		Path:         "/",
+		Name:         "memory",
+		CurrentSize:  used,
+		Capacity:     1 << 40,
+		SerialNumber: m.serial,
+	}, nil
+}
+
+// StatFS reports fixed filesystem statistics.
+func (m *MemBackend) StatFS(ctx context.Context) (*sapi.StatFS, error) {
+	m.enter("StatFS")
+	defer m.mu.Unlock()
+	return &sapi.StatFS{
+		Bsize:   blockSize,
+		Blocks:  1 << 28,
+		Bfree:   1 << 27,
+		Bavail:  1 << 27,
+		Files:   1 << 20,
+		Ffree:   1<<20 - int64(len(m.paths)),
+		Namelen: 255,
+	}, nil
+}
+
+// GetAttr stats path without following a trailing symlink.
+func (m *MemBackend) GetAttr(ctx context.Context, path string) (*sapi.Stat, error) {
+	m.enter("GetAttr")
+	defer m.mu.Unlock()
+	path = clean(path)
+	n, err := m.lookup("getattr", path)
+	if err != nil {
+		return nil, err
+	}
+	return m.stat(filepath.Base(path), n), nil
+}
+
+// Stat returns the file info record, including extended attributes.
+func (m *MemBackend) Stat(ctx context.Context, path string) (*sapi.FileInfoResponse, error) {
+	m.enter("Stat")
+	defer m.mu.Unlock()
+	path = clean(path)
+	n, err := m.lookup("stat", path)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(n.xattrs))
+	for k := range n.xattrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fi := &sapi.FileInfoResponse{
+		FileName: filepath.Base(path),
+		FilePath: path,
+		Size:     int64(len(n.data)),
+		Mode:     n.mode,
+	}
+	for _, k := range keys {
+		fi.FileAttributes = append(fi.FileAttributes, &sapi.FileAttributes{Key: k, Value: n.xattrs[k]})
+	}
+	return fi, nil
+}
+
+// ListDir returns up to returnsize entries of path that sort after marker.
+// The returned marker is the name of the last entry; an empty page ends
+// the listing.
+func (m *MemBackend) ListDir(ctx context.Context, path, marker string, compact bool, returnsize int32) (string, []*sapi.Stat, error) {
+	m.enter("ListDir")
+	defer m.mu.Unlock()
+	path = clean(path)
+	n, err := m.lookup("listdir", path)
+	if err != nil {
+		return "", nil, err
+	}
+	if !isDir(n) {
+		return "", nil, newError(syscall.ENOTDIR, "listdir", path)
+	}
+	names := m.children(path)
+	start := sort.SearchStrings(names, marker)
+	if start < len(names) && names[start] == marker {
+		start++
+	}
+	var list []*sapi.Stat
+	for _, name := range names[start:] {
+		if returnsize > 0 && int32(len(list)) >= returnsize {
+			break
+		}
+		list = append(list, m.stat(name, m.paths[filepath.Join(path, name)]))
+		marker = name
+	}
+	return marker, list, nil
+}
+
+// ReadLink returns the target of the symlink at path.
+func (m *MemBackend) ReadLink(ctx context.Context, path string) (string, error) {
+	m.enter("ReadLink")
+	defer m.mu.Unlock()
+	path = clean(path)
+	n, err := m.lookup("readlink", path)
+	if err != nil {
+		return "", err
+	}
+	if n.mode&syscall.S_IFMT != syscall.S_IFLNK {
+		return "", newError(syscall.EINVAL, "readlink", path)
+	}
+	return n.target, nil
+}
+
+// GetXAttr returns the value of the extended attribute name.
+func (m *MemBackend) GetXAttr(ctx context.Context, name, path string) (string, error) {
+	m.enter("GetXAttr")
+	defer m.mu.Unlock()
+	path = clean(path)
+	n, err := m.lookup("getxattr", path)
+	if err != nil {
+		return "", err
+	}
+	v, ok := n.xattrs[name]
+	if !ok {
+		return "", newError(syscall.ENODATA, "getxattr", path)
+	}
+	return v, nil
+}
+
+// SetXAttr sets the extended attribute name to value.
+func (m *MemBackend) SetXAttr(ctx context.Context, name, value, path string) error {
+	m.enter("SetXAttr")
+	defer m.mu.Unlock()
+	path = clean(path)
+	n, err := m.lookup("setxattr", path)
+	if err != nil {
+		return err
+	}
+	n.xattrs[name] = value
+	n.ctime = now()
+	return nil
+}
+
+// RemoveXAttr deletes the extended attribute name.
+func (m *MemBackend) RemoveXAttr(ctx context.Context, name, path string) error {
+	m.enter("RemoveXAttr")
+	defer m.mu.Unlock()
+	path = clean(path)
+	n, err := m.lookup("removexattr", path)
+	if err != nil {
+		return err
+	}
+	if _, ok := n.xattrs[name]; !ok {
+		return newError(syscall.ENODATA, "removexattr", path)
+	}
+	delete(n.xattrs, name)
+	n.ctime = now()
+	return nil
+}
+
+func (m *MemBackend) create(op, path string, mode int32) (*memInode, error) {
+	if _, err := m.lookupParent(op, path); err != nil {
+		return nil, err
+	}
+	if _, ok := m.paths[path]; ok {
+		return nil, newError(syscall.EEXIST, op, path)
+	}
+	n := m.newInode(mode)
+	m.paths[path] = n
+	return n, nil
+}
+
+// MkNod creates a file. A mode without file type bits creates a regular
+// file.
+func (m *MemBackend) MkNod(ctx context.Context, path string, mode int32, rdev int32) error {
+	m.enter("MkNod")
+	defer m.mu.Unlock()
+	if mode&syscall.S_IFMT == 0 {
+		mode |= syscall.S_IFREG
+	}
+	n, err := m.create("mknod", clean(path), mode)
+	if err != nil {
+		return err
+	}
+	n.rdev = rdev
+	return nil
+}
+
+// MkDir creates a directory.
+func (m *MemBackend) MkDir(ctx context.Context, path string, mode int32) error {
+	m.enter("MkDir")
+	defer m.mu.Unlock()
+	_, err := m.create("mkdir", clean(path), syscall.S_IFDIR|mode&^syscall.S_IFMT)
+	return err
+}
+
+// RmDir removes an empty directory.
+func (m *MemBackend) RmDir(ctx context.Context, path string) error {
+	m.enter("RmDir")
+	defer m.mu.Unlock()
+	path = clean(path)
+	n, err := m.lookup("rmdir", path)
+	if err != nil {
+		return err
+	}
+	if !isDir(n) {
+		return newError(syscall.ENOTDIR, "rmdir", path)
+	}
+	if len(m.children(path)) > 0 {
+		return newError(syscall.ENOTEMPTY, "rmdir", path)
+	}
+	delete(m.paths, path)
+	return nil
+}
+
+// SymLink creates a symlink at dst pointing to src.
+func (m *MemBackend) SymLink(ctx context.Context, src, dst string) error {
+	m.enter("SymLink")
+	defer m.mu.Unlock()
+	n, err := m.create("symlink", clean(dst), syscall.S_IFLNK|0777)
+	if err != nil {
+		return err
+	}
+	n.target = src
+	return nil
+}
+
+func (m *MemBackend) unlink(op, path string) error {
+	path = clean(path)
+	n, err := m.lookup(op, path)
+	if err != nil {
+		return err
+	}
+	if isDir(n) {
+		return newError(syscall.EISDIR, op, path)
+	}
+	delete(m.paths, path)
+	return nil
+}
+
+// DeleteFile removes a non directory entry.
+func (m *MemBackend) DeleteFile(ctx context.Context, path string) error {
+	m.enter("DeleteFile")
+	defer m.mu.Unlock()
+	return m.unlink("delete", path)
+}
+
+// Unlink removes a non directory entry.
+func (m *MemBackend) Unlink(ctx context.Context, path string) error {
+	m.enter("Unlink")
+	defer m.mu.Unlock()
+	return m.unlink("unlink", path)
+}
+
+// Rename moves src to dst, replacing dst if it exists.
+func (m *MemBackend) Rename(ctx context.Context, src, dst string) error {
+	m.enter("Rename")
+	defer m.mu.Unlock()
+	return m.rename(src, dst, 0)
+}
+
+// RenameWithFlags renames with the renameat2(2) flags RENAME_NOREPLACE
+// and RENAME_EXCHANGE.
+func (m *MemBackend) RenameWithFlags(ctx context.Context, src, dst string, flags uint32) error {
+	m.enter("RenameWithFlags")
+	defer m.mu.Unlock()
+	return m.rename(src, dst, flags)
+}
+
+func (m *MemBackend) rename(src, dst string, flags uint32) error {
+	src = clean(src)
+	dst = clean(dst)
+	n, err := m.lookup("rename", src)
+	if err != nil {
+		return err
+	}
+	if _, err := m.lookupParent("rename", dst); err != nil {
+		return err
+	}
+	if flags&^(unix.RENAME_NOREPLACE|unix.RENAME_EXCHANGE) != 0 ||
+		flags == unix.RENAME_NOREPLACE|unix.RENAME_EXCHANGE {
+		return newError(syscall.EINVAL, "rename", src)
+	}
+	if flags&unix.RENAME_EXCHANGE != 0 {
+		return m.exchange(n, src, dst)
+	}
+	if src == dst {
+		return nil
+	}
+	if strings.HasPrefix(dst, src+"/") {
+		return newError(syscall.EINVAL, "rename", dst)
+	}
+	if _, ok := m.paths[dst]; ok && flags&unix.RENAME_NOREPLACE != 0 {
+		return newError(syscall.EEXIST, "rename", dst)
+	}
+	if old, ok := m.paths[dst]; ok {
+		if isDir(old) != isDir(n) {
+			if isDir(old) {
+				return newError(syscall.EISDIR, "rename", dst)
+			}
+			return newError(syscall.ENOTDIR, "rename", dst)
+		}
+		if isDir(old) && len(m.children(dst)) > 0 {
+			return newError(syscall.ENOTEMPTY, "rename", dst)
+		}
+	}
+	for p, c := range m.paths {
+		if strings.HasPrefix(p, src+"/") {
+			delete(m.paths, p)
+			m.paths[dst+p[len(src):]] = c
+		}
+	}
+	delete(m.paths, src)
+	m.paths[dst] = n
+	n.ctime = now()
+	return nil
+}
+
+// exchange swaps the files at src and dst, together with everything
+// below them.
+func (m *MemBackend) exchange(n *memInode, src, dst string) error {
+	o, err := m.lookup("rename", dst)
+	if err != nil {
+		return err
+	}
+	if src == dst {
+		return nil
+	}
+	if strings.HasPrefix(dst, src+"/") || strings.HasPrefix(src, dst+"/") {
+		return newError(syscall.EINVAL, "rename", dst)
+	}
+	moved := make(map[string]*memInode)
+	for p, c := range m.paths {
+		switch {
+		case strings.HasPrefix(p, src+"/"):
+			moved[dst+p[len(src):]] = c
+			delete(m.paths, p)
+		case strings.HasPrefix(p, dst+"/"):
+			moved[src+p[len(dst):]] = c
+			delete(m.paths, p)
+		}
+	}
+	for p, c := range moved {
+		m.paths[p] = c
+	}
+	m.paths[src] = o
+	m.paths[dst] = n
+	t := now()
+	n.ctime = t
+	o.ctime = t
+	return nil
+}
+
+// Chown changes ownership. A value of -1 leaves that id unchanged.
+func (m *MemBackend) Chown(ctx context.Context, path string, gid int32, uid int32) error {
+	m.enter("Chown")
+	defer m.mu.Unlock()
+	path = clean(path)
+	n, err := m.lookup("chown", path)
+	if err != nil {
+		return err
+	}
+	if gid != -1 {
+		n.gid = gid
+	}
+	if uid != -1 {
+		n.uid = uid
+	}
+	n.ctime = now()
+	return nil
+}
+
+// Chmod replaces the permission bits of path.
+func (m *MemBackend) Chmod(ctx context.Context, path string, mode int32) error {
+	m.enter("Chmod")
+	defer m.mu.Unlock()
+	path = clean(path)
+	n, err := m.lookup("chmod", path)
+	if err != nil {
+		return err
+	}
+	n.mode = n.mode&syscall.S_IFMT | mode&^syscall.S_IFMT
+	n.ctime = now()
+	return nil
+}
+
+// Utime sets the access and modification times, in milliseconds.
+func (m *MemBackend) Utime(ctx context.Context, path string, atime int64, mtime int64) error {
+	m.enter("Utime")
+	defer m.mu.Unlock()
+	path = clean(path)
+	n, err := m.lookup("utime", path)
+	if err != nil {
+		return err
+	}
+	n.atime = atime
+	n.mtime = mtime
+	n.ctime = now()
+	return nil
+}
+
+func truncate(n *memInode, length int64) {
+	if length <= int64(len(n.data)) {
+		n.data = n.data[:length]
+	} else {
+		n.data = append(n.data, make([]byte, length-int64(len(n.data)))...)
+	}
+	n.mtime = now()
+	n.ctime = n.mtime
+}
+
+// zeroBlock reports whether block blk of data holds only zeros. The
+// volume stores no such blocks, so they read back as holes.
+func zeroBlock(data []byte, blk int64) bool {
+	end := (blk + 1) * blockSize
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	for _, b := range data[blk*blockSize : end] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// allocated returns the number of bytes the blocks of data that are not
+// holes take up.
+func allocated(data []byte) int64 {
+	var size int64
+	for blk := int64(0); blk*blockSize < int64(len(data)); blk++ {
+		if !zeroBlock(data, blk) {
+			size += blockSize
+		}
+	}
+	return size
+}
+
+// Allocate implements the fallocate modes that keep the layout of the
+// file: preallocation, punching holes and zeroing ranges.
+func (m *MemBackend) Allocate(ctx context.Context, path string, offset, length int64, mode uint32) error {
+	m.enter("Allocate")
+	defer m.mu.Unlock()
+	path = clean(path)
+	n, err := m.lookup("fallocate", path)
+	if err != nil {
+		return err
+	}
+	if isDir(n) {
+		return newError(syscall.EISDIR, "fallocate", path)
+	}
+	if offset < 0 || length <= 0 {
+		return newError(syscall.EINVAL, "fallocate", path)
+	}
+	keepSize := mode&unix.FALLOC_FL_KEEP_SIZE != 0
+	switch mode &^ unix.FALLOC_FL_KEEP_SIZE {
+	case 0, unix.FALLOC_FL_ZERO_RANGE:
+	case unix.FALLOC_FL_PUNCH_HOLE:
+		if !keepSize {
+			return newError(syscall.EINVAL, "fallocate", path)
+		}
+	default:
+		return newError(syscall.EOPNOTSUPP, "fallocate", path)
+	}
+	end := offset + length
+	if !keepSize && end > int64(len(n.data)) {
+		truncate(n, end)
+	}
+	if mode&(unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_ZERO_RANGE) != 0 {
+		if end > int64(len(n.data)) {
+			end = int64(len(n.data))
+		}
+		for i := offset; i < end; i++ {
+			n.data[i] = 0
+		}
+		n.mtime = now()
+		n.ctime = n.mtime
+	}
+	return nil
+}
+
+// Truncate sets the size of path to length.
+func (m *MemBackend) Truncate(ctx context.Context, path string, length int64) error {
+	m.enter("Truncate")
+	defer m.mu.Unlock()
+	path = clean(path)
+	n, err := m.lookup("truncate", path)
+	if err != nil {
+		return err
+	}
+	if isDir(n) {
+		return newError(syscall.EISDIR, "truncate", path)
+	}
+	if length < 0 {
+		return newError(syscall.EINVAL, "truncate", path)
+	}
+	truncate(n, length)
+	return nil
+}
+
+// Open returns a new file descriptor for path.
+func (m *MemBackend) Open(ctx context.Context, path string, flags int32) (int64, error) {
+	m.enter("Open")
+	defer m.mu.Unlock()
+	path = clean(path)
+	n, err := m.lookup("open", path)
+	if err != nil {
+		return -1, err
+	}
+	if flags&syscall.O_TRUNC != 0 && !isDir(n) {
+		truncate(n, 0)
+	}
+	fd := m.nextFd
+	m.nextFd++
+	m.fds[fd] = &memHandle{path: path, node: n, flags: flags}
+	return fd, nil
+}
+
+func (m *MemBackend) handle(op string, fd int64) (*memHandle, error) {
+	h, ok := m.fds[fd]
+	if !ok {
+		return nil, &spb.SdfsError{Err: op + ": bad file descriptor", ErrorCode: syscall.EBADF}
+	}
+	return h, nil
+}
+
+// Read returns up to size bytes at offset. It returns a short or empty
+// slice at end of file.
+func (m *MemBackend) Read(ctx context.Context, fd int64, offset int64, size int32) ([]byte, error) {
+	m.enter("Read")
+	defer m.mu.Unlock()
+	h, err := m.handle("read", fd)
+	if err != nil {
+		return nil, err
+	}
+	data := h.node.data
+	if offset >= int64(len(data)) {
+		return []byte{}, nil
+	}
+	end := offset + int64(size)
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	b := make([]byte, end-offset)
+	copy(b, data[offset:end])
+	return b, nil
+}
+
+// Write stores length bytes of data at offset, growing the file as needed.
+func (m *MemBackend) Write(ctx context.Context, fd int64, data []byte, offset int64, length int32) error {
+	m.enter("Write")
+	defer m.mu.Unlock()
+	h, err := m.handle("write", fd)
+	if err != nil {
+		return err
+	}
+	n := h.node
+	end := offset + int64(length)
+	if end > int64(len(n.data)) {
+		n.data = append(n.data, make([]byte, end-int64(len(n.data)))...)
+	}
+	copy(n.data[offset:end], data[:length])
+	n.mtime = now()
+	n.ctime = n.mtime
+	return nil
+}
+
+// Append writes length bytes of data at the end of the file open as fd.
+func (m *MemBackend) Append(ctx context.Context, fd int64, data []byte, length int32) (int64, error) {
+	m.enter("Append")
+	defer m.mu.Unlock()
+	h, err := m.handle("append", fd)
+	if err != nil {
+		return 0, err
+	}
+	n := h.node
+	off := int64(len(n.data))
+	n.data = append(n.data, data[:length]...)
+	n.mtime = now()
+	n.ctime = n.mtime
+	return off, nil
+}
+
+// Flush checks that fd is open.
+func (m *MemBackend) Flush(ctx context.Context, path string, fd int64) error {
+	m.enter("Flush")
+	defer m.mu.Unlock()
+	_, err := m.handle("flush", fd)
+	return err
+}
+
+// Fsync checks that fd is open.
+func (m *MemBackend) Fsync(ctx context.Context, path string, fd int64) error {
+	m.enter("Fsync")
+	defer m.mu.Unlock()
+	_, err := m.handle("fsync", fd)
+	return err
+}
+
+// Release closes fd.
+func (m *MemBackend) Release(ctx context.Context, fd int64) error {
+	m.enter("Release")
+	defer m.mu.Unlock()
+	if _, err := m.handle("release", fd); err != nil {
+		return err
+	}
+	delete(m.fds, fd)
+	return nil
+}
+
+// OpenHandles returns the number of file descriptors not yet released.
+func (m *MemBackend) OpenHandles() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.fds)
+}
+
+// CopyExtent copies length bytes from src at srcStart to dst at dstStart
+// and returns the number of bytes copied.
+func (m *MemBackend) CopyExtent(ctx context.Context, src, dst string, srcStart, dstStart, length int64) (int64, error) {
+	m.enter("CopyExtent")
+	defer m.mu.Unlock()
+	sn, err := m.lookup("copyextent", clean(src))
+	if err != nil {
+		return 0, err
+	}
+	dn, err := m.lookup("copyextent", clean(dst))
+	if err != nil {
+		return 0, err
+	}
+	if srcStart >= int64(len(sn.data)) {
+		return 0, nil
+	}
+	end := srcStart + length
+	if end > int64(len(sn.data)) {
+		end = int64(len(sn.data))
+	}
+	chunk := make([]byte, end-srcStart)
+	copy(chunk, sn.data[srcStart:end])
+	if dstEnd := dstStart + int64(len(chunk)); dstEnd > int64(len(dn.data)) {
+		truncate(dn, dstEnd)
+	}
+	copy(dn.data[dstStart:], chunk)
+	dn.mtime = now()
+	dn.ctime = dn.mtime
+	return int64(len(chunk)), nil
+}
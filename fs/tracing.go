@@ -0,0 +1,424 @@
+package fs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	sapi "github.com/opendedup/sdfs-client-go/sdfs"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+// tracer starts the spans of the mount. They go to the tracer provider
+// installed with otel.SetTracerProvider and are dropped when there is none.
+var tracer = otel.Tracer("github.com/opendedup/gofuse-sdfs/fs")
+
+// fuseOp is a FUSE operation being handled. It is traced as a span and
+// counted in the metrics of the mount when it ends.
+type fuseOp struct {
+	name       string
+	start      time.Time
+	span       trace.Span
+	metrics    *opMetrics
+	failure    *opFailure
+	unexpected *errorCounts
+}
+
+// opFailure is the error an operation last turned into an errno.
+type opFailure struct {
+	mu  sync.Mutex
+	err error
+}
+
+type opFailureKey struct{}
+
+// beginOp starts the operation called name. The returned context carries
+// its span to the requests it makes.
+func beginOp(ctx context.Context, m *opMetrics, u *errorCounts, name string) (context.Context, fuseOp) {
+	ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+	failure := &opFailure{}
+	ctx = context.WithValue(ctx, opFailureKey{}, failure)
+	return ctx, fuseOp{name: name, start: time.Now(), span: span, metrics: m, failure: failure, unexpected: u}
+}
+
+// errnoOf returns the errno of err and remembers err for the operation of
+// ctx, which counts it as unexpected if it ends with that errno.
+func errnoOf(ctx context.Context, err error) syscall.Errno {
+	if f, ok := ctx.Value(opFailureKey{}).(*opFailure); ok && err != nil {
+		f.mu.Lock()
+		f.err = err
+		f.mu.Unlock()
+	}
+	return ToErrno(err)
+}
+
+func (n *sdfsNode) begin(ctx context.Context, name string) (context.Context, fuseOp) {
+	ctx, op := beginOp(ctx, n.root().metrics, n.root().unexpected, name)
+	if op.span.IsRecording() {
+		op.span.SetAttributes(pathAttr(n.path()))
+	}
+	return ctx, op
+}
+
+func (f *sdfsFile) begin(ctx context.Context, name string) (context.Context, fuseOp) {
+	ctx, op := beginOp(ctx, f.metrics, f.unexpected, name)
+	if op.span.IsRecording() {
+		op.span.SetAttributes(pathAttr(f.path))
+	}
+	return ctx, op
+}
+
+// transferred records that the operation moved n bytes of file data in
+// direction.
+func (o fuseOp) transferred(direction string, n int) {
+	o.metrics.transferred(direction, n)
+	if o.span.IsRecording() {
+		o.span.SetAttributes(sizeAttr(n))
+	}
+}
+
+// end ends the operation with *errno. It is meant to be deferred on entry.
+func (o fuseOp) end(errno *syscall.Errno) {
+	if *errno != 0 {
+		o.span.SetAttributes(attribute.String("sdfs.errno", errnoName(*errno)))
+		o.span.SetStatus(codes.Error, errno.Error())
+		o.failure.mu.Lock()
+		if err := o.failure.err; err != nil && ToErrno(err) == *errno {
+			o.unexpected.add(err)
+		}
+		o.failure.mu.Unlock()
+	}
+	o.span.End()
+	o.metrics.observe(o.name, o.start, errno)
+}
+
+// tracingBackend traces every request to the volume as a child span of the
+// operation that made it, and passes the trace context on to the server in
+// the gRPC metadata of the request.
+type tracingBackend struct {
+	con Backend
+}
+
+var _ = (Backend)((*tracingBackend)(nil))
+var _ = (wrapper)((*tracingBackend)(nil))
+
+func withTracing(con Backend) Backend {
+	return &tracingBackend{con: con}
+}
+
+func (t *tracingBackend) unwrap() Backend {
+	return t.con
+}
+
+// CloseConnection closes the connection underneath, so that a reconnecting
+// backend can still let go of a connection it replaced.
+func (t *tracingBackend) CloseConnection(ctx context.Context) {
+	if c, ok := t.con.(interface{ CloseConnection(context.Context) }); ok {
+		c.CloseConnection(ctx)
+	}
+}
+
+// call starts the span of the request called name, returning the context
+// to send it with and a function to end it with its error.
+func call(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	ctx, span := tracer.Start(ctx, "sdfs."+name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	if !span.SpanContext().IsValid() {
+		return ctx, func(error) { span.End() }
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(md))
+	ctx = metadata.NewOutgoingContext(ctx, md)
+	return ctx, func(err error) {
+		if err != nil {
+			span.SetAttributes(attribute.String("sdfs.errno", errnoName(ToErrno(err))))
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// metadataCarrier lets a propagator write the trace context into gRPC
+// metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func pathAttr(path string) attribute.KeyValue {
+	return attribute.String("sdfs.path", path)
+}
+
+func fdAttr(fd int64) attribute.KeyValue {
+	return attribute.Int64("sdfs.fd", fd)
+}
+
+func sizeAttr(n int) attribute.KeyValue {
+	return attribute.Int("sdfs.size", n)
+}
+
+func (t *tracingBackend) GetVolumeInfo(ctx context.Context) (*sapi.VolumeInfoResponse, error) {
+	ctx, done := call(ctx, "GetVolumeInfo")
+	info, err := t.con.GetVolumeInfo(ctx)
+	done(err)
+	return info, err
+}
+
+func (t *tracingBackend) StatFS(ctx context.Context) (*sapi.StatFS, error) {
+	ctx, done := call(ctx, "StatFS")
+	st, err := t.con.StatFS(ctx)
+	done(err)
+	return st, err
+}
+
+func (t *tracingBackend) GetAttr(ctx context.Context, path string) (*sapi.Stat, error) {
+	ctx, done := call(ctx, "GetAttr", pathAttr(path))
+	fi, err := t.con.GetAttr(ctx, path)
+	done(err)
+	return fi, err
+}
+
+func (t *tracingBackend) Stat(ctx context.Context, path string) (*sapi.FileInfoResponse, error) {
+	ctx, done := call(ctx, "Stat", pathAttr(path))
+	fi, err := t.con.Stat(ctx, path)
+	done(err)
+	return fi, err
+}
+
+func (t *tracingBackend) ListDir(ctx context.Context, path, marker string, compact bool, returnsize int32) (string, []*sapi.Stat, error) {
+	ctx, done := call(ctx, "ListDir", pathAttr(path), attribute.String("sdfs.marker", marker))
+	next, list, err := t.con.ListDir(ctx, path, marker, compact, returnsize)
+	done(err)
+	return next, list, err
+}
+
+func (t *tracingBackend) ReadLink(ctx context.Context, path string) (string, error) {
+	ctx, done := call(ctx, "ReadLink", pathAttr(path))
+	target, err := t.con.ReadLink(ctx, path)
+	done(err)
+	return target, err
+}
+
+func (t *tracingBackend) GetXAttr(ctx context.Context, name, path string) (string, error) {
+	ctx, done := call(ctx, "GetXAttr", pathAttr(path), attribute.String("sdfs.xattr", name))
+	value, err := t.con.GetXAttr(ctx, name, path)
+	done(err)
+	return value, err
+}
+
+func (t *tracingBackend) SetXAttr(ctx context.Context, name, value, path string) error {
+	ctx, done := call(ctx, "SetXAttr", pathAttr(path), attribute.String("sdfs.xattr", name))
+	err := t.con.SetXAttr(ctx, name, value, path)
+	done(err)
+	return err
+}
+
+func (t *tracingBackend) RemoveXAttr(ctx context.Context, name, path string) error {
+	ctx, done := call(ctx, "RemoveXAttr", pathAttr(path), attribute.String("sdfs.xattr", name))
+	err := t.con.RemoveXAttr(ctx, name, path)
+	done(err)
+	return err
+}
+
+func (t *tracingBackend) MkNod(ctx context.Context, path string, mode int32, rdev int32) error {
+	ctx, done := call(ctx, "MkNod", pathAttr(path))
+	err := t.con.MkNod(ctx, path, mode, rdev)
+	done(err)
+	return err
+}
+
+func (t *tracingBackend) MkDir(ctx context.Context, path string, mode int32) error {
+	ctx, done := call(ctx, "MkDir", pathAttr(path))
+	err := t.con.MkDir(ctx, path, mode)
+	done(err)
+	return err
+}
+
+func (t *tracingBackend) RmDir(ctx context.Context, path string) error {
+	ctx, done := call(ctx, "RmDir", pathAttr(path))
+	err := t.con.RmDir(ctx, path)
+	done(err)
+	return err
+}
+
+func (t *tracingBackend) SymLink(ctx context.Context, src, dst string) error {
+	ctx, done := call(ctx, "SymLink", pathAttr(dst), attribute.String("sdfs.target", src))
+	err := t.con.SymLink(ctx, src, dst)
+	done(err)
+	return err
+}
+
+func (t *tracingBackend) DeleteFile(ctx context.Context, path string) error {
+	ctx, done := call(ctx, "DeleteFile", pathAttr(path))
+	err := t.con.DeleteFile(ctx, path)
+	done(err)
+	return err
+}
+
+func (t *tracingBackend) Unlink(ctx context.Context, path string) error {
+	ctx, done := call(ctx, "Unlink", pathAttr(path))
+	err := t.con.Unlink(ctx, path)
+	done(err)
+	return err
+}
+
+func (t *tracingBackend) Rename(ctx context.Context, src, dst string) error {
+	ctx, done := call(ctx, "Rename", pathAttr(src), attribute.String("sdfs.target", dst))
+	err := t.con.Rename(ctx, src, dst)
+	done(err)
+	return err
+}
+
+func (t *tracingBackend) Chown(ctx context.Context, path string, gid int32, uid int32) error {
+	ctx, done := call(ctx, "Chown", pathAttr(path))
+	err := t.con.Chown(ctx, path, gid, uid)
+	done(err)
+	return err
+}
+
+func (t *tracingBackend) Chmod(ctx context.Context, path string, mode int32) error {
+	ctx, done := call(ctx, "Chmod", pathAttr(path))
+	err := t.con.Chmod(ctx, path, mode)
+	done(err)
+	return err
+}
+
+func (t *tracingBackend) Utime(ctx context.Context, path string, atime int64, mtime int64) error {
+	ctx, done := call(ctx, "Utime", pathAttr(path))
+	err := t.con.Utime(ctx, path, atime, mtime)
+	done(err)
+	return err
+}
+
+func (t *tracingBackend) Truncate(ctx context.Context, path string, length int64) error {
+	ctx, done := call(ctx, "Truncate", pathAttr(path), attribute.Int64("sdfs.size", length))
+	err := t.con.Truncate(ctx, path, length)
+	done(err)
+	return err
+}
+
+func (t *tracingBackend) Open(ctx context.Context, path string, flags int32) (int64, error) {
+	ctx, done := call(ctx, "Open", pathAttr(path))
+	fd, err := t.con.Open(ctx, path, flags)
+	done(err)
+	return fd, err
+}
+
+func (t *tracingBackend) Read(ctx context.Context, fd int64, offset int64, size int32) ([]byte, error) {
+	ctx, done := call(ctx, "Read", fdAttr(fd), attribute.Int64("sdfs.offset", offset), sizeAttr(int(size)))
+	data, err := t.con.Read(ctx, fd, offset, size)
+	done(err)
+	return data, err
+}
+
+func (t *tracingBackend) Write(ctx context.Context, fd int64, data []byte, offset int64, length int32) error {
+	ctx, done := call(ctx, "Write", fdAttr(fd), attribute.Int64("sdfs.offset", offset), sizeAttr(int(length)))
+	err := t.con.Write(ctx, fd, data, offset, length)
+	done(err)
+	return err
+}
+
+func (t *tracingBackend) Flush(ctx context.Context, path string, fd int64) error {
+	ctx, done := call(ctx, "Flush", pathAttr(path), fdAttr(fd))
+	err := t.con.Flush(ctx, path, fd)
+	done(err)
+	return err
+}
+
+func (t *tracingBackend) Fsync(ctx context.Context, path string, fd int64) error {
+	ctx, done := call(ctx, "Fsync", pathAttr(path), fdAttr(fd))
+	err := t.con.Fsync(ctx, path, fd)
+	done(err)
+	return err
+}
+
+func (t *tracingBackend) Release(ctx context.Context, fd int64) error {
+	ctx, done := call(ctx, "Release", fdAttr(fd))
+	err := t.con.Release(ctx, fd)
+	done(err)
+	return err
+}
+
+func (t *tracingBackend) CopyExtent(ctx context.Context, src, dst string, srcStart, dstStart, length int64) (int64, error) {
+	ctx, done := call(ctx, "CopyExtent", pathAttr(src), attribute.String("sdfs.target", dst), attribute.Int64("sdfs.size", length))
+	n, err := t.con.CopyExtent(ctx, src, dst, srcStart, dstStart, length)
+	done(err)
+	return n, err
+}
+
+func (t *tracingBackend) RenameWithFlags(ctx context.Context, src, dst string, flags uint32) error {
+	fr, ok := t.con.(FlagRenamer)
+	if !ok {
+		return errNotSupported
+	}
+	ctx, done := call(ctx, "RenameWithFlags", pathAttr(src), attribute.String("sdfs.target", dst), attribute.Int64("sdfs.flags", int64(flags)))
+	err := fr.RenameWithFlags(ctx, src, dst, flags)
+	done(err)
+	return err
+}
+
+func (t *tracingBackend) GetLock(ctx context.Context, path string, owner uint64, lk *fuse.FileLock, flock bool) (*fuse.FileLock, error) {
+	l, ok := t.con.(Locker)
+	if !ok {
+		return nil, errNotSupported
+	}
+	ctx, done := call(ctx, "GetLock", pathAttr(path))
+	out, err := l.GetLock(ctx, path, owner, lk, flock)
+	done(err)
+	return out, err
+}
+
+func (t *tracingBackend) SetLock(ctx context.Context, path string, owner uint64, lk *fuse.FileLock, flock, wait bool) error {
+	l, ok := t.con.(Locker)
+	if !ok {
+		return errNotSupported
+	}
+	ctx, done := call(ctx, "SetLock", pathAttr(path), attribute.Bool("sdfs.wait", wait))
+	err := l.SetLock(ctx, path, owner, lk, flock, wait)
+	done(err)
+	return err
+}
+
+func (t *tracingBackend) Allocate(ctx context.Context, path string, offset, length int64, mode uint32) error {
+	a, ok := t.con.(Allocator)
+	if !ok {
+		return errNotSupported
+	}
+	ctx, done := call(ctx, "Allocate", pathAttr(path), attribute.Int64("sdfs.offset", offset), attribute.Int64("sdfs.size", length))
+	err := a.Allocate(ctx, path, offset, length, mode)
+	done(err)
+	return err
+}
+
+func (t *tracingBackend) Append(ctx context.Context, fd int64, data []byte, length int32) (int64, error) {
+	a, ok := t.con.(Appender)
+	if !ok {
+		return 0, errNotSupported
+	}
+	ctx, done := call(ctx, "Append", fdAttr(fd), sizeAttr(int(length)))
+	off, err := a.Append(ctx, fd, data, length)
+	done(err)
+	return off, err
+}
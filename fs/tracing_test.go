@@ -0,0 +1,125 @@
+package fs
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	sapi "github.com/opendedup/sdfs-client-go/sdfs"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc/metadata"
+)
+
+var (
+	spansOnce sync.Once
+	spans     *tracetest.InMemoryExporter
+)
+
+// recordSpans installs a tracer provider that keeps the spans ended from
+// now on. The provider stays for the rest of the tests, since tracers
+// handed out before it keep using the first one installed.
+func recordSpans() *tracetest.InMemoryExporter {
+	spansOnce.Do(func() {
+		spans = tracetest.NewInMemoryExporter()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	spans.Reset()
+	return spans
+}
+
+// headerBackend keeps the gRPC metadata GetAttr requests are sent with.
+type headerBackend struct {
+	Backend
+	mu  sync.Mutex
+	mds []metadata.MD
+}
+
+func (b *headerBackend) GetAttr(ctx context.Context, path string) (*sapi.Stat, error) {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	b.mu.Lock()
+	b.mds = append(b.mds, md)
+	b.mu.Unlock()
+	return b.Backend.GetAttr(ctx, path)
+}
+
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, s := range spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	t.Fatalf("no %s span among %d", name, len(spans))
+	return tracetest.SpanStub{}
+}
+
+func attr(s tracetest.SpanStub, key string) attribute.Value {
+	for _, kv := range s.Attributes {
+		if string(kv.Key) == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracing(t *testing.T) {
+	exp := recordSpans()
+	root, mb := newTestRoot(t)
+	hb := &headerBackend{Backend: mb}
+	root.con = withTracing(hb)
+	ctx := context.Background()
+
+	var out fuse.EntryOut
+	if _, errno := root.Lookup(ctx, "missing", &out); errno != syscall.ENOENT {
+		t.Fatalf("Lookup(missing) = %v", errno)
+	}
+	_, fh := create(t, &root.sdfsNode, "file")
+	if _, errno := fh.Write(ctx, []byte("hello"), 0); errno != 0 {
+		t.Fatalf("Write: %v", errno)
+	}
+	fh.Release(ctx)
+
+	got := exp.GetSpans()
+	lookupSpan := findSpan(t, got, "lookup")
+	if v := attr(lookupSpan, "sdfs.errno"); v.AsString() != "ENOENT" || lookupSpan.Status.Code != codes.Error {
+		t.Errorf("lookup span has errno %q and status %v, want ENOENT and an error", v.AsString(), lookupSpan.Status.Code)
+	}
+	if v := attr(lookupSpan, "sdfs.path"); v.AsString() != "/" {
+		t.Errorf("lookup span has path %q, want /", v.AsString())
+	}
+	getattr := findSpan(t, got, "sdfs.GetAttr")
+	if getattr.Parent.SpanID() != lookupSpan.SpanContext.SpanID() {
+		t.Errorf("GetAttr span is not a child of the lookup span")
+	}
+	if v := attr(getattr, "sdfs.path"); v.AsString() != "/missing" {
+		t.Errorf("GetAttr span has path %q, want /missing", v.AsString())
+	}
+
+	writeSpan := findSpan(t, got, "write")
+	if v := attr(writeSpan, "sdfs.size"); v.AsInt64() != 5 {
+		t.Errorf("write span has size %d, want 5", v.AsInt64())
+	}
+	if v := attr(writeSpan, "sdfs.errno"); v.Type() != attribute.INVALID {
+		t.Errorf("successful write span has errno %v", v.AsString())
+	}
+	if w := findSpan(t, got, "sdfs.Write"); w.Parent.SpanID() != writeSpan.SpanContext.SpanID() {
+		t.Errorf("Write span is not a child of the write span")
+	}
+
+	if len(hb.mds) == 0 {
+		t.Fatalf("no GetAttr request reached the backend")
+	}
+	tp := hb.mds[0].Get("traceparent")
+	if len(tp) != 1 || !strings.Contains(tp[0], lookupSpan.SpanContext.TraceID().String()) {
+		t.Errorf("GetAttr sent traceparent %q, want the trace of the lookup", tp)
+	}
+}
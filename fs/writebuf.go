@@ -0,0 +1,184 @@
+package fs
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultWriteBufferSize is the most a handle buffers before writing to
+// the server and DefaultWriteBufferMemory the most all handles of a mount
+// buffer together.
+const (
+	DefaultWriteBufferSize   = 1 << 20
+	DefaultWriteBufferMemory = 64 << 20
+)
+
+// writeBuffers accounts for the write buffers of a mount. A handle that
+// cannot get memory for a buffer writes directly to the server. Handles
+// holding data are listed per inode so that reads, stats and size changes
+// through any handle or node can push that data out first.
+type writeBuffers struct {
+	size  int
+	limit int64
+
+	mu    sync.Mutex
+	used  int64
+	dirty map[uint64]map[*sdfsFile]struct{}
+}
+
+func newWriteBuffers(size int, limit int64) *writeBuffers {
+	if size > 0 && limit < int64(size) {
+		limit = int64(size)
+	}
+	return &writeBuffers{
+		size:  size,
+		limit: limit,
+		dirty: make(map[uint64]map[*sdfsFile]struct{}),
+	}
+}
+
+// acquire reserves a buffer for f. It fails when buffering is disabled or
+// the mount has no memory left for it.
+func (w *writeBuffers) acquire(f *sdfsFile) bool {
+	if w == nil || w.size <= 0 {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.used+int64(w.size) > w.limit {
+		return false
+	}
+	w.used += int64(w.size)
+	fs, ok := w.dirty[f.ino]
+	if !ok {
+		fs = make(map[*sdfsFile]struct{})
+		w.dirty[f.ino] = fs
+	}
+	fs[f] = struct{}{}
+	return true
+}
+
+// release gives back the buffer of f.
+func (w *writeBuffers) release(f *sdfsFile) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.used -= int64(w.size)
+	delete(w.dirty[f.ino], f)
+	if len(w.dirty[f.ino]) == 0 {
+		delete(w.dirty, f.ino)
+	}
+}
+
+// flushIno writes out what every handle of ino has buffered. Failures are
+// left for the handles to report.
+func (w *writeBuffers) flushIno(ctx context.Context, ino uint64) {
+	w.flushOthers(ctx, ino, nil)
+}
+
+// flushOthers writes out what the handles of ino other than skip have
+// buffered, so that data written through skip lands after it.
+func (w *writeBuffers) flushOthers(ctx context.Context, ino uint64, skip *sdfsFile) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	var files []*sdfsFile
+	for f := range w.dirty[ino] {
+		if f != skip {
+			files = append(files, f)
+		}
+	}
+	w.mu.Unlock()
+	for _, f := range files {
+		f.mu.Lock()
+		f.flushLocked(ctx)
+		f.mu.Unlock()
+	}
+}
+
+// flushAll writes out what every handle of the mount has buffered and
+// returns the first failure, which the handle also keeps to report.
+func (w *writeBuffers) flushAll(ctx context.Context) error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	var files []*sdfsFile
+	for _, handles := range w.dirty {
+		for f := range handles {
+			files = append(files, f)
+		}
+	}
+	w.mu.Unlock()
+	var first error
+	for _, f := range files {
+		f.mu.Lock()
+		if err := f.flushLocked(ctx); err != nil && first == nil {
+			first = err
+		}
+		f.mu.Unlock()
+	}
+	return first
+}
+
+// bufferWrite adds data at off to the buffer of f, writing out what is
+// buffered first when data does not follow it or does not fit. It returns
+// false when data has to be written directly. f.mu must be held.
+func (f *sdfsFile) bufferWrite(ctx context.Context, data []byte, off int64) bool {
+	if f.writes == nil || len(data) >= f.writes.size {
+		f.flushLocked(ctx)
+		return false
+	}
+	if len(f.wbuf) > 0 && (off != f.woff+int64(len(f.wbuf)) || len(f.wbuf)+len(data) > cap(f.wbuf)) {
+		f.flushLocked(ctx)
+	}
+	if f.wbuf == nil {
+		if !f.writes.acquire(f) {
+			return false
+		}
+		f.wbuf = make([]byte, 0, f.writes.size)
+		f.woff = off
+	}
+	f.wbuf = append(f.wbuf, data...)
+	if len(f.wbuf) == cap(f.wbuf) {
+		f.flushLocked(ctx)
+	}
+	return true
+}
+
+// flushLocked writes out the buffer of f and gives its memory back. A
+// failure is also kept to be reported by the next Flush or Fsync. The
+// buffered writes already succeeded for the application, so interrupting
+// the request that pushes them out does not stop them. f.mu must be held.
+func (f *sdfsFile) flushLocked(ctx context.Context) error {
+	if f.wbuf == nil {
+		return nil
+	}
+	var err error
+	if len(f.wbuf) > 0 {
+		err = f.con.Write(uninterruptible(ctx), f.fd, f.wbuf, f.woff, int32(len(f.wbuf)))
+		f.changed()
+	}
+	f.wbuf = nil
+	f.writes.release(f)
+	if err != nil {
+		log.Debugf("write error for %s at %d %v", f.path, f.woff, err)
+		if f.werr == nil {
+			f.werr = err
+		}
+	}
+	return err
+}
+
+// flush writes out the buffer of f and returns, once, the first write
+// error since the last call.
+func (f *sdfsFile) flush(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.flushLocked(ctx)
+	err := f.werr
+	f.werr = nil
+	return err
+}
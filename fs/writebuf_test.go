@@ -0,0 +1,154 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	spb "github.com/opendedup/sdfs-client-go/api"
+)
+
+func TestWriteCoalescing(t *testing.T) {
+	root, mb := newTestRoot(t)
+	ctx := context.Background()
+	root.writes = newWriteBuffers(64<<10, 1<<20)
+	_, fh := create(t, &root.sdfsNode, "file")
+	defer fh.Release(ctx)
+	mb.ResetCalls()
+
+	block := bytes.Repeat([]byte{'x'}, 4096)
+	for i := int64(0); i < 8; i++ {
+		if n, errno := fh.Write(ctx, block, i*4096); errno != 0 || n != 4096 {
+			t.Fatalf("Write = %d, %v", n, errno)
+		}
+	}
+	if got := mb.Calls("Write"); got != 0 {
+		t.Errorf("%d writes reached the server before Flush, want 0", got)
+	}
+
+	// Another handle sees the data.
+	other := lookupOpen(t, root, "file")
+	if got := readAll(t, other, 0, 16*4096); len(got) != 8*4096 {
+		t.Errorf("other handle read %d bytes, want %d", len(got), 8*4096)
+	}
+	other.Release(ctx)
+	if got := mb.Calls("Write"); got != 1 {
+		t.Errorf("%d writes reached the server, want one coalesced write", got)
+	}
+
+	// A write elsewhere in the file pushes out what is buffered.
+	fh.Write(ctx, block, 0)
+	fh.Write(ctx, block, 100*4096)
+	if got := mb.Calls("Write"); got != 2 {
+		t.Errorf("%d writes after a non-adjacent write, want 2", got)
+	}
+	if errno := fh.Flush(ctx); errno != 0 {
+		t.Fatalf("Flush: %v", errno)
+	}
+	var out fuse.AttrOut
+	if errno := fh.Getattr(ctx, &out); errno != 0 || out.Size != 101*4096 {
+		t.Errorf("Getattr = %d, %v, want size %d", out.Size, errno, 101*4096)
+	}
+}
+
+func TestWriteBufferMemory(t *testing.T) {
+	root, mb := newTestRoot(t)
+	ctx := context.Background()
+	root.writes = newWriteBuffers(64<<10, 64<<10)
+	_, f1 := create(t, &root.sdfsNode, "a")
+	defer f1.Release(ctx)
+	_, f2 := create(t, &root.sdfsNode, "b")
+	defer f2.Release(ctx)
+	mb.ResetCalls()
+
+	f1.Write(ctx, []byte("buffered"), 0)
+	f2.Write(ctx, []byte("direct"), 0)
+	if got := mb.Calls("Write"); got != 1 {
+		t.Errorf("%d writes reached the server, want only the one over the limit", got)
+	}
+	f1.Flush(ctx)
+	f2.Write(ctx, []byte("buffered"), 6)
+	if got := mb.Calls("Write"); got != 2 {
+		t.Errorf("%d writes reached the server, want the flushed one", got)
+	}
+}
+
+func TestWriteBufferSetattrSize(t *testing.T) {
+	root, _ := newTestRoot(t)
+	ctx := context.Background()
+	root.writes = newWriteBuffers(64<<10, 1<<20)
+	_, fh := create(t, &root.sdfsNode, "file")
+	defer fh.Release(ctx)
+
+	fh.Write(ctx, []byte("hello world"), 0)
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE, Size: 5}}
+	var out fuse.AttrOut
+	if errno := fh.Setattr(ctx, in, &out); errno != 0 {
+		t.Fatalf("Setattr: %v", errno)
+	}
+	if got := readAll(t, fh, 0, 64); string(got) != "hello" {
+		t.Errorf("after truncating buffered data read %q, want hello", got)
+	}
+}
+
+func TestWriteBufferOverwrite(t *testing.T) {
+	root, _ := newTestRoot(t)
+	ctx := context.Background()
+	root.writes = newWriteBuffers(16, 1<<20)
+	_, first := create(t, &root.sdfsNode, "file")
+	second := lookupOpen(t, root, "file")
+
+	// The later writes through second, buffered or too large for a buffer,
+	// win over what first buffered before them, although first closes last.
+	first.Write(ctx, []byte("aaaaaaaa"), 0)
+	second.Write(ctx, []byte("bb"), 0)
+	second.Flush(ctx)
+	first.Write(ctx, []byte("cccccccc"), 16)
+	second.Write(ctx, bytes.Repeat([]byte{'d'}, 16), 12)
+	second.Release(ctx)
+	first.Release(ctx)
+
+	check := lookupOpen(t, root, "file")
+	defer check.Release(ctx)
+	if got, want := string(readAll(t, check, 0, 64)), "bbaaaaaa\x00\x00\x00\x00"+strings.Repeat("d", 16); got != want {
+		t.Errorf("file holds %q, want %q", got, want)
+	}
+}
+
+// failingWrites fails every Write with EIO.
+type failingWrites struct {
+	Backend
+}
+
+func (b failingWrites) Write(ctx context.Context, fd int64, data []byte, offset int64, length int32) error {
+	return &spb.SdfsError{Err: "write failed", ErrorCode: syscall.EIO}
+}
+
+func TestDeferredWriteError(t *testing.T) {
+	root, mb := newTestRoot(t)
+	ctx := context.Background()
+	root.writes = newWriteBuffers(64<<10, 1<<20)
+	_, fh := create(t, &root.sdfsNode, "file")
+	defer fh.Release(ctx)
+	fh.con = failingWrites{mb}
+
+	if _, errno := fh.Write(ctx, []byte("lost"), 0); errno != 0 {
+		t.Fatalf("buffered Write: %v", errno)
+	}
+	if errno := fh.Flush(ctx); errno != syscall.EIO {
+		t.Errorf("Flush = %v, want the deferred EIO", errno)
+	}
+	if errno := fh.Flush(ctx); errno != 0 {
+		t.Errorf("second Flush = %v, want the error reported once", errno)
+	}
+
+	fh.Write(ctx, []byte("lost"), 0)
+	var out fuse.AttrOut
+	lookup(t, &root.sdfsNode, "file").Getattr(ctx, nil, &out)
+	if errno := fh.Fsync(ctx, 0); errno != syscall.EIO {
+		t.Errorf("Fsync = %v, want the EIO of a write pushed out by another operation", errno)
+	}
+}
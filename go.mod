@@ -1,13 +1,21 @@
 module github.com/opendedup/gofuse-sdfs
 
-go 1.13
+go 1.16
 
 require (
-	github.com/hanwen/go-fuse v1.0.0
+	github.com/BurntSushi/toml v0.4.1
 	github.com/hanwen/go-fuse/v2 v2.1.0
 	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0 // indirect
 	github.com/opendedup/sdfs-client-go v0.1.37-0.20220320182158-7ceb101ef696
+	github.com/prometheus/client_golang v1.12.2
 	github.com/sevlyar/go-daemon v0.1.5
 	github.com/sirupsen/logrus v1.8.1
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc v1.0.0
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
 	golang.org/x/sys v0.0.0-20220128215802-99c3d69c2c27
+	google.golang.org/grpc v1.40.1
+	gopkg.in/yaml.v3 v3.0.1
 )